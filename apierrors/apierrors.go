@@ -0,0 +1,126 @@
+package apierrors
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Supported values for config.Config.ErrorFormat.
+const (
+	// FormatSimple renders errors as {"code": "<CODE>", "message": "<message>"}.
+	FormatSimple = "simple"
+	// FormatProblem renders errors as RFC 7807 Problem Details (application/problem+json).
+	FormatProblem = "problem"
+)
+
+// ProblemTypeBaseURI is the prefix of the "type" member of Problem Details responses.
+const ProblemTypeBaseURI = "https://ms-user/problems/"
+
+// format holds the error format selected at startup. Like zerolog's global logger,
+// it is configured once in main.go and shared by handlers and middleware.
+var format = FormatSimple
+
+// SetFormat selects how Respond renders errors. Unknown values fall back to FormatSimple.
+func SetFormat(f string) {
+	if f == FormatProblem {
+		format = FormatProblem
+		return
+	}
+	format = FormatSimple
+}
+
+// Machine-readable error codes carried by every error response.
+const (
+	CodeValidationFailed      = "VALIDATION_FAILED"
+	CodeUnauthorized          = "UNAUTHORIZED"
+	CodeForbidden             = "FORBIDDEN"
+	CodeImpersonationDisabled = "IMPERSONATION_DISABLED"
+	CodeNotFound              = "NOT_FOUND"
+	CodeUserNotFound          = "USER_NOT_FOUND"
+	CodeGroupNotFound         = "GROUP_NOT_FOUND"
+	CodeRoleNotFound          = "ROLE_NOT_FOUND"
+	CodeCredentialNotFound    = "CREDENTIAL_NOT_FOUND"
+	CodeAmbiguousResult       = "AMBIGUOUS_RESULT"
+	CodeConflict              = "CONFLICT"
+	CodeFederatedUser         = "FEDERATED_USER_READ_ONLY"
+	CodeRateLimited           = "RATE_LIMITED"
+	CodeUpstreamUnavailable   = "UPSTREAM_UNAVAILABLE"
+	CodeUpstreamError         = "UPSTREAM_ERROR"
+	CodeEmailNotSent          = "EMAIL_NOT_SENT"
+	CodeServiceUnavailable    = "SERVICE_UNAVAILABLE"
+	CodeInternal              = "INTERNAL_ERROR"
+)
+
+// APIError is the error returned to clients. Code is stable and meant for programs;
+// Message is meant for humans and may change.
+type APIError struct {
+	Status  int         `json:"-"`
+	Code    string      `json:"code"`
+	Message string      `json:"message"`
+	Details interface{} `json:"details,omitempty"`
+}
+
+// New returns an APIError with the given HTTP status, code and message.
+func New(status int, code, message string) *APIError {
+	return &APIError{Status: status, Code: code, Message: message}
+}
+
+// WithDetails attaches additional, code-specific information to the error.
+func (e *APIError) WithDetails(details interface{}) *APIError {
+	e.Details = details
+	return e
+}
+
+// Error implements the error interface.
+func (e *APIError) Error() string {
+	return e.Code + ": " + e.Message
+}
+
+// Problem is an RFC 7807 Problem Details object. Code and Details are extension members
+// carrying the same values as in the simple format.
+type Problem struct {
+	Type     string      `json:"type"`
+	Title    string      `json:"title"`
+	Status   int         `json:"status"`
+	Detail   string      `json:"detail"`
+	Instance string      `json:"instance"`
+	Code     string      `json:"code"`
+	Details  interface{} `json:"details,omitempty"`
+}
+
+// Respond writes an error response with the given HTTP status, code and message in the configured
+// format and aborts the remaining handlers of the request.
+func Respond(c *gin.Context, status int, code, message string) {
+	Write(c, New(status, code, message))
+}
+
+// Write renders apiErr in the configured format and aborts the remaining handlers of the request.
+func Write(c *gin.Context, apiErr *APIError) {
+	if format != FormatProblem {
+		c.AbortWithStatusJSON(apiErr.Status, apiErr)
+		return
+	}
+	problem := Problem{
+		Type:     typeURI(apiErr.Code),
+		Title:    http.StatusText(apiErr.Status),
+		Status:   apiErr.Status,
+		Detail:   apiErr.Message,
+		Instance: c.Request.URL.Path,
+		Code:     apiErr.Code,
+		Details:  apiErr.Details,
+	}
+	// Set the content type before rendering; gin keeps an existing Content-Type header.
+	c.Header("Content-Type", "application/problem+json")
+	c.AbortWithStatusJSON(apiErr.Status, problem)
+}
+
+// typeURI maps an error code to a Problem Details type URI, e.g. USER_NOT_FOUND -> ".../user-not-found".
+func typeURI(code string) string {
+	slug := strings.ToLower(strings.ReplaceAll(code, "_", "-"))
+	if slug == "" {
+		return "about:blank"
+	}
+	return ProblemTypeBaseURI + slug
+}
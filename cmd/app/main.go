@@ -1,9 +1,18 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"ms-user/apierrors"
 	"ms-user/config"
 	"ms-user/handlers"
+	"ms-user/metrics"
 	"ms-user/middleware"
+	"ms-user/services"
+	"net/http"
+	"os/signal"
+	"strconv"
+	"syscall"
 
 	"github.com/gin-gonic/gin"
 	"github.com/rs/zerolog/log"
@@ -16,53 +25,173 @@ func main() {
 	// Load configuration from environment variables or defaults.
 	cfg := config.LoadConfig()
 
+	// Fail fast on a misconfigured deployment instead of failing on the first request.
+	if err := cfg.Validate(); err != nil {
+		log.Fatal().Err(err).Msg("Invalid configuration")
+	}
+	for old, current := range config.RenamedVariablesSet() {
+		log.Warn().Msgf("%s is deprecated; set %s instead", old, current)
+	}
+	if cfg.UsesDefaultCredentials() {
+		log.Warn().Msg("Using default Keycloak admin credentials (admin/admin); set KEYCLOAK_USERNAME and KEYCLOAK_PASSWORD")
+	}
+
+	// Select how error responses are rendered ("simple" or RFC 7807 "problem").
+	apierrors.SetFormat(cfg.ErrorFormat)
+
 	// Create a new Gin router instance.
 	r := gin.New()
+	// Only the proxies listed in TRUSTED_PROXIES may set the client IP with X-Forwarded-For. Otherwise any
+	// client could pick the IP its rate limit is keyed on by sending that header.
+	if err := r.SetTrustedProxies(cfg.TrustedProxies); err != nil {
+		log.Fatal().Err(err).Msg("Invalid TRUSTED_PROXIES")
+	}
 
-	// Register global middleware.
-	// LoggingMiddleware logs each incoming request.
-	// AuthMiddleware enforces a simple token-based authentication.
-	r.Use(middleware.LoggingMiddleware())
-	r.Use(middleware.AuthMiddleware())
+	// A single KeycloakService is shared by all handlers, so that they share one admin token and one
+	// pool of connections to Keycloak.
+	// Without an admin token every request would fail: refuse to start rather than report healthy.
+	keycloakService, err := services.NewKeycloakService(cfg)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Unable to authenticate with Keycloak")
+	}
 
 	// Initialize handler instances for user, group, and membership operations.
 	// Handlers interact with Keycloak via the service layer.
-	userHandler := handlers.NewUserHandler(cfg)
-	groupHandler := handlers.NewGroupHandler(cfg)
-	membershipHandler := handlers.NewMembershipHandler(cfg)
+	healthHandler := handlers.NewHealthHandler(keycloakService)
+	userHandler := handlers.NewUserHandler(cfg, keycloakService)
+	groupHandler := handlers.NewGroupHandler(keycloakService)
+	membershipHandler := handlers.NewMembershipHandler(keycloakService)
+	adminHandler := handlers.NewAdminHandler(cfg, keycloakService)
+	roleHandler := handlers.NewRoleHandler(keycloakService)
+
+	// Register global middleware.
+	// RecoveryMiddleware turns a panic into a logged 500 response instead of a dropped connection. It comes
+	// first so that it also catches panics in the middleware below, which still log and count such requests.
+	r.Use(middleware.RecoveryMiddleware())
+	// RequestIDMiddleware assigns each request an ID (X-Request-ID) carried by all of its log lines.
+	r.Use(middleware.RequestIDMiddleware())
+	// LoggingMiddleware logs each request with its status and latency once handled.
+	r.Use(middleware.LoggingMiddleware())
+	// MetricsMiddleware records per-operation request counts, statuses and latencies.
+	r.Use(middleware.MetricsMiddleware())
 
-	// Register User-related routes under the base path "ms-user/v1/users".
+	// Probe and metrics endpoints are registered before AuthMiddleware so Kubernetes probes and
+	// Prometheus don't need a token.
+	// GET /health - Liveness probe.
+	r.GET("/health", healthHandler.Health)
+	// GET /ready - Readiness probe; checks that Keycloak accepts the admin token.
+	r.GET("/ready", healthHandler.Ready)
+	// GET /metrics - Prometheus metrics, scraped without a token like the probes.
+	r.GET("/metrics", gin.WrapH(metrics.Handler()))
+
+	// CORSMiddleware answers browser preflight requests; it comes before AuthMiddleware because
+	// preflight requests carry no token.
+	r.Use(middleware.CORSMiddleware(cfg))
+
+	// RateLimitMiddleware rejects request storms with 429 before they reach Keycloak. Probes and metrics
+	// are registered above and are not limited.
+	r.Use(middleware.RateLimitMiddleware(cfg))
+
+	// GET /ms-user/v1/swagger/*any - OpenAPI specification (doc.json) and Swagger UI (index.html). Registered
+	// before AuthMiddleware so the page can be opened in a browser; the spec declares the bearer scheme.
+	if cfg.SwaggerEnabled {
+		swaggerHandler := handlers.NewSwaggerHandler(cfg)
+		r.GET("/"+cfg.BasePath+"/swagger/*any", swaggerHandler.Serve)
+	}
+
+	// AuthMiddleware enforces a simple token-based authentication on every route registered below.
+	r.Use(middleware.AuthMiddleware(cfg))
+
+	// All API routes live under Config.BasePath ("ms-user/v1" by default); the route comments below
+	// show the default paths. The X-Realm header selects the Keycloak realm of user, group, membership
+	// and role routes; admin routes always target KEYCLOAK_REALM.
+	api := r.Group(cfg.BasePath, middleware.RealmMiddleware(cfg))
+
+	// Register User-related routes under "<base path>/users".
 	// These endpoints handle user CRUD operations and membership management.
-	userRoutes := r.Group("ms-user/v1/users")
+	userRoutes := api.Group("/users")
 	{
 		// GET /ms-user/v1/users - List all users.
 		userRoutes.GET("", userHandler.ListUsers)
-		// Search user by email: GET /ms-user/v1/users/search?email=<email>
-		userRoutes.GET("/search", userHandler.SearchUserByEmail)
+		// GET /ms-user/v1/users/count - Count the users in the realm.
+		userRoutes.GET("/count", userHandler.CountUsers)
+		// GET /ms-user/v1/users/export?format=csv|json - Download every user as a CSV or JSON file.
+		userRoutes.GET("/export", userHandler.ExportUsers)
+		// Search users: GET /ms-user/v1/users/search?email=&username=&firstName=&lastName=&search=
+		userRoutes.GET("/search", userHandler.SearchUsers)
 		// POST /ms-user/v1/users - Create a new user.
 		userRoutes.POST("", userHandler.CreateUser)
+		// POST /ms-user/v1/users/bulk - Create several users, reporting the result of each one.
+		userRoutes.POST("/bulk", userHandler.CreateUsersBulk)
+		// POST /ms-user/v1/users/import?dryRun=<bool> - Create users from an uploaded CSV or JSON file.
+		userRoutes.POST("/import", userHandler.ImportUsers)
+		// GET /ms-user/v1/users/by-username/:username - Retrieve a user by exact username.
+		userRoutes.GET("/by-username/:username", userHandler.GetUserByUsername)
 		// GET /ms-user/v1/users/:id - Retrieve a specific user by ID.
 		userRoutes.GET("/:id", userHandler.GetUser)
+		// GET /ms-user/v1/users/:id/full - Retrieve a user together with its groups and realm roles.
+		userRoutes.GET("/:id/full", userHandler.GetUserDetails)
 		// PUT /ms-user/v1/users/:id - Update an existing user by ID.
 		userRoutes.PUT("/:id", userHandler.UpdateUser)
 		// DELETE /ms-user/v1/users/:id - Delete a user by ID.
 		userRoutes.DELETE("/:id", userHandler.DeleteUser)
+		// PUT /ms-user/v1/users/:id/reset-password - Set a new password for a user.
+		userRoutes.PUT("/:id/reset-password", userHandler.ResetPassword)
+		// PUT /ms-user/v1/users/:id/send-actions-email - Email the user a link to perform required actions
+		// (VERIFY_EMAIL by default).
+		userRoutes.PUT("/:id/send-actions-email", userHandler.ExecuteActionsEmail)
+		// PUT /ms-user/v1/users/:id/execute-actions-email - Same as send-actions-email, named after the Keycloak endpoint.
+		userRoutes.PUT("/:id/execute-actions-email", userHandler.ExecuteActionsEmail)
+		// PUT /ms-user/v1/users/:id/required-actions - Set the actions a user must perform at the next login.
+		userRoutes.PUT("/:id/required-actions", userHandler.SetRequiredActions)
+		// PATCH /ms-user/v1/users/:id/enabled - Enable or disable a user without deleting it.
+		userRoutes.PATCH("/:id/enabled", userHandler.SetUserEnabled)
+		// PATCH /ms-user/v1/users/:id/attributes - Merge custom attributes into a user's attributes.
+		userRoutes.PATCH("/:id/attributes", userHandler.UpdateUserAttributes)
+		// GET /ms-user/v1/users/:id/passkeys - List a user's WebAuthn (passkey) credentials.
+		userRoutes.GET("/:id/passkeys", userHandler.ListPasskeys)
+		// DELETE /ms-user/v1/users/:id/passkeys/:credentialId - Remove a user's passkey.
+		userRoutes.DELETE("/:id/passkeys/:credentialId", userHandler.RemovePasskey)
+		// GET /ms-user/v1/users/:id/sessions - List a user's active sessions.
+		userRoutes.GET("/:id/sessions", userHandler.ListUserSessions)
+		// POST /ms-user/v1/users/:id/logout - End all of a user's sessions.
+		userRoutes.POST("/:id/logout", userHandler.LogoutUser)
+		// POST /ms-user/v1/users/:id/impersonate - Open a session on behalf of a user (impersonation token only).
+		userRoutes.POST("/:id/impersonate", middleware.ImpersonatorMiddleware(), userHandler.ImpersonateUser)
 
 		// Membership endpoints for users:
 		// GET /ms-user/v1/users/:id/groups - List groups for a specific user.
 		userRoutes.GET("/:id/groups", membershipHandler.ListUserGroups)
 		// Add user to group by email: PUT /ms-user/v1/users/email/:email/groups/:groupId
 		userRoutes.PUT("/email/:email/groups/:groupId", membershipHandler.AddUserToGroupByEmail)
+		// Add user to group by email and group path: PUT /ms-user/v1/users/email/:email/groups/by-path/*path
+		userRoutes.PUT("/email/:email/groups/by-path/*path", membershipHandler.AddUserToGroupByEmailAndPath)
+		// GET /ms-user/v1/users/:id/groups/:groupId - Check whether a user is a direct member of a group.
+		userRoutes.GET("/:id/groups/:groupId", membershipHandler.IsUserInGroup)
 		// PUT /ms-user/v1/users/:id/groups/:groupId - Add a user to a group.
 		userRoutes.PUT("/:id/groups/:groupId", membershipHandler.AddUserToGroup)
+		// PUT /ms-user/v1/users/:id/groups - Add a user to several groups, reporting the result of each one.
+		userRoutes.PUT("/:id/groups", membershipHandler.AddUserToGroups)
 		// DELETE /ms-user/v1/users/:id/groups/:groupId - Remove a user from a group.
 		userRoutes.DELETE("/:id/groups/:groupId", membershipHandler.RemoveUserFromGroup)
+		// DELETE /ms-user/v1/users/:id/groups - Remove a user from all of its groups, reporting the result of each one.
+		userRoutes.DELETE("/:id/groups", membershipHandler.RemoveUserFromAllGroups)
+		// POST /ms-user/v1/users/:id/move-group - Move a user from one group to another.
+		userRoutes.POST("/:id/move-group", membershipHandler.MoveUserBetweenGroups)
+
+		// Realm role endpoints for users:
+		// GET /ms-user/v1/users/:id/roles - List realm roles assigned to a user.
+		userRoutes.GET("/:id/roles", roleHandler.ListUserRoles)
+		// PUT /ms-user/v1/users/:id/roles/:roleName - Assign a realm role to a user.
+		userRoutes.PUT("/:id/roles/:roleName", roleHandler.AddRoleToUser)
+		// DELETE /ms-user/v1/users/:id/roles/:roleName - Remove a realm role from a user.
+		userRoutes.DELETE("/:id/roles/:roleName", roleHandler.RemoveRoleFromUser)
 
 	}
 
-	// Register Group-related routes under the base path "ms-user/v1/groups".
+	// Register Group-related routes under "<base path>/groups".
 	// These endpoints handle group CRUD operations and listing users within a group.
-	groupRoutes := r.Group("ms-user/v1/groups")
+	groupRoutes := api.Group("/groups")
 	{
 		// GET /ms-user/v1/groups - List all groups.
 		groupRoutes.GET("", groupHandler.ListGroups)
@@ -70,22 +199,81 @@ func main() {
 		groupRoutes.POST("", groupHandler.CreateGroup)
 		// GET /ms-user/v1/groups/:id - Retrieve a specific group by ID.
 		groupRoutes.GET("/:id", groupHandler.GetGroup)
+		// GET /ms-user/v1/groups/by-path/*path - Retrieve a group by its path (e.g. /engineering/backend).
+		groupRoutes.GET("/by-path/*path", groupHandler.GetGroupByPath)
 		// PUT /ms-user/v1/groups/:id - Update an existing group by ID.
 		groupRoutes.PUT("/:id", groupHandler.UpdateGroup)
 		// DELETE /ms-user/v1/groups/:id - Delete a group by ID.
 		groupRoutes.DELETE("/:id", groupHandler.DeleteGroup)
+		// GET /ms-user/v1/groups/:id/children - List the child groups of a group.
+		groupRoutes.GET("/:id/children", groupHandler.ListSubGroups)
+		// POST /ms-user/v1/groups/:id/children - Create a child group under a group.
+		groupRoutes.POST("/:id/children", groupHandler.CreateSubGroup)
 
 		// Membership endpoint for groups:
 		// GET /ms-user/v1/groups/:id/users - List all users in a specific group.
 		groupRoutes.GET("/:id/users", membershipHandler.ListGroupUsers)
+		// GET /ms-user/v1/groups/:id/members/count - Count the direct members of a group.
+		groupRoutes.GET("/:id/members/count", groupHandler.CountGroupMembers)
 
 		// New endpoint: List groups with their associated users.
 		groupRoutes.GET("/with-users", groupHandler.ListGroupsWithUsers)
 	}
 
-	// Log the startup information and start the HTTP server on port 18080.
-	log.Info().Msg("Starting ms-user service on port 18080")
-	if err := r.Run(":18080"); err != nil {
-		log.Fatal().Err(err).Msg("Failed to start server")
+	// Register realm role routes under "<base path>/roles".
+	roleRoutes := api.Group("/roles")
+	{
+		// GET /ms-user/v1/roles/:name/users - List users holding a realm role.
+		roleRoutes.GET("/:name/users", roleHandler.ListRoleUsers)
+		// DELETE /ms-user/v1/roles/:name - Delete a realm role (?dryRun=true previews affected users).
+		// Restricted to the admin token, like the other destructive administrative operations.
+		roleRoutes.DELETE("/:name", middleware.AdminMiddleware(), roleHandler.DeleteRole)
+	}
+
+	// GET /ms-user/v1/required-actions - List the required actions enabled in the realm.
+	api.GET("/required-actions", userHandler.ListRequiredActions)
+
+	// GET /ms-user/v1/memberships - Export all memberships as a user -> groups mapping (JSON or CSV).
+	api.GET("/memberships", membershipHandler.ListMemberships)
+
+	// Register administrative routes under "<base path>/admin".
+	// These endpoints require the admin token (see AdminMiddleware).
+	adminRoutes := api.Group("/admin", middleware.AdminMiddleware())
+	{
+		// POST /ms-user/v1/admin/user-storage/:id/sync - Trigger a user storage (LDAP) synchronization.
+		adminRoutes.POST("/user-storage/:id/sync", adminHandler.SyncUserStorage)
+		// GET /ms-user/v1/admin/selftest - Run a diagnostic self-test against Keycloak (rate-limited).
+		adminRoutes.GET("/selftest", adminHandler.SelfTest)
+		// POST /ms-user/v1/admin/backfill-defaults - Assign the default roles and groups to users missing them.
+		adminRoutes.POST("/backfill-defaults", adminHandler.BackfillDefaults)
+	}
+
+	// Start the HTTP server on the configured port (18080 by default) in the background, so main can
+	// wait for a termination signal.
+	server := &http.Server{
+		Addr:    ":" + strconv.Itoa(cfg.Port),
+		Handler: r,
+	}
+	go func() {
+		log.Info().Int("port", cfg.Port).Str("basePath", "/"+cfg.BasePath).Msg("Starting ms-user service")
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			log.Fatal().Err(err).Msg("Failed to start server")
+		}
+	}()
+
+	// On SIGINT/SIGTERM (e.g. a Kubernetes rolling deploy) stop accepting connections and give in-flight
+	// requests, including their calls to Keycloak, up to ShutdownTimeout to complete.
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+	<-ctx.Done()
+	stop()
+
+	log.Info().Dur("timeout", cfg.ShutdownTimeout).Msg("Shutting down, draining in-flight requests")
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		log.Error().Err(err).Msg("Shutdown timed out before all in-flight requests completed")
+		return
 	}
+	log.Info().Msg("Server stopped, all in-flight requests completed")
 }
@@ -1,20 +1,117 @@
 package config
 
-import "os"
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
 
 type Config struct {
 	KeycloakURL      string
-	KeycloakRealm    string
+	KeycloakRealm    string   // Realm the admin user logs in to and requests target by default.
+	KeycloakRealms   []string // Other realms a request may target with the X-Realm header.
 	KeycloakUsername string
 	KeycloakPassword string
+	AuthToken        string // Bearer token accepted for regular API calls.
+	AdminToken       string // Bearer token granting access to admin routes; admin routes are disabled when empty.
+	// ImpersonationToken is the bearer token granting the impersonator role, the only role allowed to
+	// impersonate users; impersonation is disabled when empty.
+	ImpersonationToken  string
+	ErrorFormat         string   // Error response format: "simple" ({"code": ..., "message": ...}) or "problem" (RFC 7807).
+	PublicPaths         []string // Path prefixes that bypass AuthMiddleware (e.g. health and metrics).
+	KeycloakConcurrency int      // Max number of parallel Keycloak calls a single operation fans out to.
+	// EmailLookupRetries is how many extra searches are made when resolving a user by email finds nothing,
+	// to tolerate Keycloak's search indexing lag right after a user is created.
+	EmailLookupRetries    int
+	EmailLookupRetryDelay time.Duration // Wait between email lookup retries.
+	SelfTestMinInterval   time.Duration // Minimum time between two runs of the admin self-test.
+	// PublicBaseURL is the externally visible base URL (e.g. "https://api.example.com") used to build
+	// absolute pagination links behind a reverse proxy. When empty, the request's host is used.
+	PublicBaseURL string
+	// KeycloakMaxRetries is how many times a request answered with 429 or 503 is retried.
+	KeycloakMaxRetries     int
+	KeycloakRetryBaseDelay time.Duration // Initial backoff between retries when Keycloak sends no Retry-After.
+	// KeycloakStartupRetries is how many times fetching the initial admin token is retried at startup
+	// while Keycloak is unreachable or failing, before the service gives up.
+	KeycloakStartupRetries int
+	KeycloakStartupBackoff time.Duration // Initial backoff between those retries, doubled each time.
+	KeycloakTokenTimeout   time.Duration // Timeout of a request to Keycloak's token endpoint; none when 0.
+	DefaultRoles           []string      // Realm role names every user should have (see the admin defaults backfill).
+	DefaultGroups          []string      // Group IDs every user should belong to (see the admin defaults backfill).
+	// MembershipPrevalidate makes membership changes look up the user and the group first, so that a
+	// missing one is reported precisely even if Keycloak's error message cannot be interpreted.
+	MembershipPrevalidate bool
+	Port                  int    // HTTP port the service listens on.
+	BasePath              string // Path prefix of all API routes, without leading or trailing slash (e.g. "ms-user/v1").
+	// ShutdownTimeout is how long in-flight requests are given to complete after SIGINT/SIGTERM.
+	ShutdownTimeout time.Duration
+	// CORSAllowedOrigins lists the origins (e.g. "https://admin.example.com", or "*" for any) allowed to
+	// call the API from a browser. CORS headers are not sent when empty.
+	CORSAllowedOrigins []string
+	// RateLimitRPS is the sustained number of requests per second accepted by RateLimitMiddleware, with
+	// bursts of up to RateLimitBurst requests. It is on by default to protect Keycloak from request storms;
+	// 0 explicitly disables rate limiting.
+	RateLimitRPS       float64
+	RateLimitBurst     int
+	RateLimitPerClient bool // Limit each client IP separately instead of all requests together.
+	// TrustedProxies lists the proxy IPs or CIDRs (e.g. "10.0.0.0/8") whose X-Forwarded-For header gives
+	// the client IP. When empty, the client IP is the address of the connection and the header is ignored.
+	TrustedProxies []string
+	// SwaggerEnabled serves the OpenAPI specification and the Swagger UI under "<base path>/swagger/";
+	// disable it in production to keep the API surface undocumented to the public.
+	SwaggerEnabled bool
+	// GroupCacheEnabled keeps the group listings (all groups, and groups with their users) in memory for
+	// GroupCacheTTL. Group and membership changes made through the service clear the cache.
+	GroupCacheEnabled bool
+	GroupCacheTTL     time.Duration
+	// CallerTokens makes user, group, membership and role calls use the caller's own Keycloak access token,
+	// sent in the X-Keycloak-Token header, instead of the admin token, so Keycloak enforces its permissions.
+	CallerTokens bool
 }
 
 func LoadConfig() *Config {
 	return &Config{
-		KeycloakURL:      getEnv("KEYCLOAK_URL", "http://localhost:8080"),
-		KeycloakRealm:    getEnv("KEYCLOAK_REALM", "master"),
-		KeycloakUsername: getEnv("KEYCLOAK_USERNAME", "admin"),
-		KeycloakPassword: getEnv("KEYCLOAK_PASSWORD", "admin"),
+		KeycloakURL:            getEnv("KEYCLOAK_URL", "http://localhost:8080"),
+		KeycloakRealm:          getEnv("KEYCLOAK_REALM", "master"),
+		KeycloakRealms:         getEnvList("KEYCLOAK_REALMS", []string{}),
+		KeycloakUsername:       getEnv("KEYCLOAK_USERNAME", "admin"),
+		KeycloakPassword:       getEnv("KEYCLOAK_PASSWORD", "admin"),
+		AuthToken:              getEnv("AUTH_TOKEN", "secret-token"),
+		AdminToken:             getEnv("ADMIN_TOKEN", ""),
+		ImpersonationToken:     getEnv("IMPERSONATION_TOKEN", ""),
+		ErrorFormat:            getEnv("ERROR_FORMAT", "simple"),
+		PublicPaths:            getEnvList("PUBLIC_PATHS", []string{"/health", "/metrics"}),
+		KeycloakConcurrency:    getEnvInt("KEYCLOAK_CONCURRENCY", getEnvInt("GROUP_FETCH_CONCURRENCY", 8)), // Formerly GROUP_FETCH_CONCURRENCY.
+		EmailLookupRetries:     getEnvInt("EMAIL_LOOKUP_RETRIES", 2),
+		EmailLookupRetryDelay:  getEnvDuration("EMAIL_LOOKUP_RETRY_DELAY", 500*time.Millisecond),
+		SelfTestMinInterval:    getEnvDuration("SELFTEST_MIN_INTERVAL", 10*time.Second),
+		PublicBaseURL:          strings.TrimSuffix(getEnv("PUBLIC_BASE_URL", ""), "/"),
+		KeycloakMaxRetries:     getEnvInt("KEYCLOAK_MAX_RETRIES", 3),
+		KeycloakRetryBaseDelay: getEnvDuration("KEYCLOAK_RETRY_BASE_DELAY", 200*time.Millisecond),
+		KeycloakStartupRetries: getEnvInt("KEYCLOAK_STARTUP_RETRIES", 5),
+		// Long enough by default to let a Keycloak instance that is still starting come up.
+		KeycloakStartupBackoff: getEnvDuration("KEYCLOAK_STARTUP_BACKOFF", time.Second),
+		KeycloakTokenTimeout:   getEnvDuration("KEYCLOAK_TOKEN_TIMEOUT", 10*time.Second),
+		DefaultRoles:           getEnvList("DEFAULT_ROLES", []string{}),
+		DefaultGroups:          getEnvList("DEFAULT_GROUPS", []string{}),
+		MembershipPrevalidate:  getEnvBool("MEMBERSHIP_PREVALIDATE", false),
+		Port:                   getEnvInt("PORT", 18080),
+		BasePath:               strings.Trim(getEnv("BASE_PATH", "ms-user/v1"), "/"),
+		ShutdownTimeout:        getEnvDuration("SHUTDOWN_TIMEOUT", 20*time.Second),
+		CORSAllowedOrigins:     getEnvList("CORS_ALLOWED_ORIGINS", []string{}),
+		RateLimitRPS:           getEnvFloat("RATE_LIMIT_RPS", 20),
+		RateLimitBurst:         getEnvInt("RATE_LIMIT_BURST", 40),
+		RateLimitPerClient:     getEnvBool("RATE_LIMIT_PER_CLIENT", true),
+		TrustedProxies:         getEnvList("TRUSTED_PROXIES", []string{}),
+		SwaggerEnabled:         getEnvBool("SWAGGER_ENABLED", true),
+		GroupCacheEnabled:      getEnvBool("GROUP_CACHE_ENABLED", true),
+		GroupCacheTTL:          getEnvDuration("GROUP_CACHE_TTL", 30*time.Second),
+		CallerTokens:           getEnvBool("CALLER_TOKENS_ENABLED", false),
 	}
 }
 
@@ -24,3 +121,158 @@ func getEnv(key, defaultValue string) string {
 	}
 	return defaultValue
 }
+
+// getEnvInt reads an integer from the environment, falling back to defaultValue when the
+// variable is unset or not a valid integer.
+func getEnvInt(key string, defaultValue int) int {
+	if value, exists := os.LookupEnv(key); exists {
+		if parsed, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getEnvFloat reads a number (e.g. "2.5") from the environment, falling back to defaultValue when the
+// variable is unset or not a valid number.
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, exists := os.LookupEnv(key); exists {
+		if parsed, err := strconv.ParseFloat(strings.TrimSpace(value), 64); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getEnvBool reads a boolean (e.g. "true", "1", "false") from the environment, falling back to
+// defaultValue when the variable is unset or not a valid boolean.
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, exists := os.LookupEnv(key); exists {
+		if parsed, err := strconv.ParseBool(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getEnvDuration reads a duration (e.g. "500ms", "2s") from the environment, falling back to
+// defaultValue when the variable is unset or not a valid duration.
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, exists := os.LookupEnv(key); exists {
+		if parsed, err := time.ParseDuration(strings.TrimSpace(value)); err == nil {
+			return parsed
+		}
+	}
+	return defaultValue
+}
+
+// getEnvList reads a comma-separated list from the environment, trimming blanks around each item.
+// An unset variable yields defaultValue; a set but empty variable yields an empty list.
+func getEnvList(key string, defaultValue []string) []string {
+	value, exists := os.LookupEnv(key)
+	if !exists {
+		return defaultValue
+	}
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// Validate checks that the configuration can be used to talk to Keycloak and returns a
+// descriptive error for the first problem found.
+func (c *Config) Validate() error {
+	if c.KeycloakURL == "" {
+		return errors.New("KEYCLOAK_URL must be set")
+	}
+	parsed, err := url.Parse(c.KeycloakURL)
+	if err != nil {
+		return fmt.Errorf("KEYCLOAK_URL %q is not a valid URL: %v", c.KeycloakURL, err)
+	}
+	if (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return fmt.Errorf("KEYCLOAK_URL %q must be an absolute http(s) URL", c.KeycloakURL)
+	}
+	if c.KeycloakRealm == "" {
+		return errors.New("KEYCLOAK_REALM must be set")
+	}
+	// Keycloak only lets admins of the master realm manage other realms: the admin token of any other
+	// realm would be rejected by the Admin API of the realms listed.
+	for _, realm := range c.KeycloakRealms {
+		if realm != c.KeycloakRealm && c.KeycloakRealm != "master" {
+			return fmt.Errorf("KEYCLOAK_REALMS can only list realm %q when KEYCLOAK_REALM is master, got %q", realm, c.KeycloakRealm)
+		}
+	}
+	if c.KeycloakUsername == "" {
+		return errors.New("KEYCLOAK_USERNAME must be set")
+	}
+	if c.ErrorFormat != "simple" && c.ErrorFormat != "problem" {
+		return fmt.Errorf("ERROR_FORMAT %q must be simple or problem", c.ErrorFormat)
+	}
+	if c.Port < 1 || c.Port > 65535 {
+		return fmt.Errorf("PORT must be between 1 and 65535, got %d", c.Port)
+	}
+	if c.ShutdownTimeout <= 0 {
+		return fmt.Errorf("SHUTDOWN_TIMEOUT must be positive, got %s", c.ShutdownTimeout)
+	}
+	if c.KeycloakMaxRetries < 0 {
+		return fmt.Errorf("KEYCLOAK_MAX_RETRIES must not be negative, got %d", c.KeycloakMaxRetries)
+	}
+	if c.KeycloakStartupRetries < 0 {
+		return fmt.Errorf("KEYCLOAK_STARTUP_RETRIES must not be negative, got %d", c.KeycloakStartupRetries)
+	}
+	if c.KeycloakTokenTimeout < 0 {
+		return fmt.Errorf("KEYCLOAK_TOKEN_TIMEOUT must not be negative, got %s", c.KeycloakTokenTimeout)
+	}
+	if c.GroupCacheEnabled && c.GroupCacheTTL <= 0 {
+		return fmt.Errorf("GROUP_CACHE_TTL must be positive when the group cache is enabled, got %s", c.GroupCacheTTL)
+	}
+	if c.RateLimitRPS < 0 {
+		return fmt.Errorf("RATE_LIMIT_RPS must not be negative, got %g", c.RateLimitRPS)
+	}
+	if c.RateLimitRPS > 0 && c.RateLimitBurst < 1 {
+		return fmt.Errorf("RATE_LIMIT_BURST must be at least 1 when rate limiting is enabled, got %d", c.RateLimitBurst)
+	}
+	for _, proxy := range c.TrustedProxies {
+		if net.ParseIP(proxy) == nil {
+			if _, _, err := net.ParseCIDR(proxy); err != nil {
+				return fmt.Errorf("TRUSTED_PROXIES entry %q must be an IP address or a CIDR", proxy)
+			}
+		}
+	}
+	// A shared token would make AuthMiddleware grant the first matching role, silently widening access.
+	if c.ImpersonationToken != "" && (c.ImpersonationToken == c.AuthToken || c.ImpersonationToken == c.AdminToken) {
+		return errors.New("IMPERSONATION_TOKEN must differ from AUTH_TOKEN and ADMIN_TOKEN")
+	}
+	if c.PublicBaseURL != "" {
+		parsed, err := url.Parse(c.PublicBaseURL)
+		if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+			return fmt.Errorf("PUBLIC_BASE_URL %q must be an absolute http(s) URL", c.PublicBaseURL)
+		}
+	}
+	return nil
+}
+
+// renamedVariables maps the environment variables that were renamed to their new name.
+var renamedVariables = map[string]string{
+	"GROUP_FETCH_CONCURRENCY": "KEYCLOAK_CONCURRENCY",
+}
+
+// RenamedVariablesSet returns, for each renamed environment variable still set, its old name mapped to
+// its new one, so that a warning can ask to switch to the new name.
+func RenamedVariablesSet() map[string]string {
+	set := map[string]string{}
+	for old, current := range renamedVariables {
+		if _, exists := os.LookupEnv(old); exists {
+			set[old] = current
+		}
+	}
+	return set
+}
+
+// UsesDefaultCredentials reports whether the Keycloak admin credentials are the insecure admin/admin defaults.
+func (c *Config) UsesDefaultCredentials() bool {
+	return c.KeycloakUsername == "admin" && c.KeycloakPassword == "admin"
+}
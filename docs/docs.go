@@ -0,0 +1,11 @@
+// Package docs embeds the OpenAPI specification of the service, so that it is served by the
+// binary itself and cannot drift from the deployed version.
+package docs
+
+import _ "embed"
+
+// OpenAPI is the OpenAPI 3 specification (docs/openapi.yaml). Its server URL assumes the default
+// base path; the Swagger handler rewrites it to the configured one.
+//
+//go:embed openapi.yaml
+var OpenAPI []byte
@@ -0,0 +1,127 @@
+package handlers
+
+import (
+	"math"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"ms-user/services"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// AdminHandler handles HTTP requests for administrative operations.
+// It leverages the KeycloakService to interact with Keycloak's Admin API.
+type AdminHandler struct {
+	keycloakService services.AdminProvider
+	// selfTestMinInterval rate-limits SelfTest; lastSelfTest is guarded by selfTestMu.
+	selfTestMinInterval time.Duration
+	selfTestMu          sync.Mutex
+	lastSelfTest        time.Time
+	// backfillMu prevents two default-assignment backfills from running at the same time.
+	backfillMu sync.Mutex
+}
+
+// NewAdminHandler creates and returns a new AdminHandler instance.
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewAdminHandler(cfg *config.Config, keycloakService services.AdminProvider) *AdminHandler {
+	return &AdminHandler{
+		keycloakService:     keycloakService,
+		selfTestMinInterval: cfg.SelfTestMinInterval,
+	}
+}
+
+// SyncUserStorage handles the HTTP POST request to trigger a user storage (e.g. LDAP) synchronization.
+// Endpoint: POST /admin/user-storage/:id/sync?action=<action>
+//
+// Input:
+//   - id: the user storage provider component ID, from the URL path.
+//   - action: optional query parameter, "triggerFullSync" (default) or "triggerChangedUsersSync".
+//
+// Output:
+//   - On success: HTTP 200 with the synchronization result reported by Keycloak.
+//   - On error: HTTP 400 for an unknown action, HTTP 404 for an unknown provider, otherwise an error mapped
+//     by respondServiceError.
+func (h *AdminHandler) SyncUserStorage(c *gin.Context) {
+	id := c.Param("id")
+	action := c.DefaultQuery("action", "triggerFullSync")
+	if action != "triggerFullSync" && action != "triggerChangedUsersSync" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "action must be triggerFullSync or triggerChangedUsersSync")
+		return
+	}
+
+	result, err := h.keycloakService.SyncUserStorage(id, action)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error syncing user storage")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, result)
+}
+
+// SelfTest handles the HTTP GET request running a diagnostic self-test against Keycloak.
+// Endpoint: GET /admin/selftest
+//
+// The self-test sequentially checks token acquisition, listing groups and counting users.
+// It is rate-limited to one run per Config.SelfTestMinInterval.
+//
+// Output:
+//   - HTTP 200 with the report when every step passed, or HTTP 503 with the report when a step failed.
+//   - HTTP 429 with a Retry-After header when called again within the minimum interval.
+func (h *AdminHandler) SelfTest(c *gin.Context) {
+	h.selfTestMu.Lock()
+	if wait := h.selfTestMinInterval - time.Since(h.lastSelfTest); !h.lastSelfTest.IsZero() && wait > 0 {
+		h.selfTestMu.Unlock()
+		c.Header("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		apierrors.Respond(c, http.StatusTooManyRequests, apierrors.CodeRateLimited, "self-test was run recently, retry later")
+		return
+	}
+	h.lastSelfTest = time.Now()
+	h.selfTestMu.Unlock()
+
+	report := h.keycloakService.SelfTest()
+	if !report.Passed {
+		requestLogger(c).Error().Interface("report", report).Msg("Self-test failed")
+		c.JSON(http.StatusServiceUnavailable, report)
+		return
+	}
+	c.JSON(http.StatusOK, report)
+}
+
+// BackfillDefaults handles the HTTP POST request assigning the configured default roles and groups
+// to every existing user that lacks them.
+// Endpoint: POST /admin/backfill-defaults
+//
+// The operation is idempotent: users that already have every default are left untouched, so it can
+// safely be re-run, e.g. after a partial failure. Only one backfill runs at a time.
+//
+// Output:
+//   - On success: HTTP 200 with a models.BackfillResult summarizing scanned, changed and failed users.
+//   - On error: HTTP 409 if a backfill is already running, otherwise an error mapped by respondServiceError
+//     (e.g. HTTP 404 if a configured default role or group does not exist).
+func (h *AdminHandler) BackfillDefaults(c *gin.Context) {
+	if !h.backfillMu.TryLock() {
+		apierrors.Respond(c, http.StatusConflict, apierrors.CodeConflict, "a backfill is already running")
+		return
+	}
+	defer h.backfillMu.Unlock()
+
+	result, err := h.keycloakService.BackfillDefaults()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error backfilling default roles and groups")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	requestLogger(c).Info().Int("scanned", result.UsersScanned).Int("changed", result.UsersChanged).Int("failed", result.UsersFailed).
+		Msg("Backfilled default roles and groups")
+	c.JSON(http.StatusOK, result)
+}
+
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *AdminHandler) SetKeycloakService(svc services.AdminProvider) {
+	h.keycloakService = svc
+}
@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"encoding/json"
+	"errors"
+	"ms-user/apierrors"
+	"ms-user/services"
+	"net"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// notFoundMessages holds the client-facing message for each resource-specific not-found code.
+var notFoundMessages = map[string]string{
+	apierrors.CodeUserNotFound:  "user not found",
+	apierrors.CodeGroupNotFound: "group not found",
+	apierrors.CodeRoleNotFound:  "role not found",
+	apierrors.CodeNotFound:      "resource not found",
+}
+
+// respondServiceError maps an error returned by the service layer to an API error and writes it.
+// notFoundCode is the code used when Keycloak answers 404 (e.g. USER_NOT_FOUND for GET /users/:id).
+//
+//	Sentinel errors map to their own codes, Keycloak 400/404/409 keep their status, any other
+//	Keycloak status becomes 502 UPSTREAM_ERROR, network failures become 502 UPSTREAM_UNAVAILABLE,
+//	and anything else is a 500 INTERNAL_ERROR.
+//
+//	When the request carries the caller's Keycloak token, a Keycloak 403 means the caller lacks the
+//	permission, not that the service is misconfigured, and becomes 403 FORBIDDEN.
+func respondServiceError(c *gin.Context, err error, notFoundCode string) {
+	var kcErr *services.KeycloakError
+	if requestCallerToken(c) != "" && errors.As(err, &kcErr) && kcErr.StatusCode == http.StatusForbidden {
+		apierrors.Respond(c, http.StatusForbidden, apierrors.CodeForbidden, "Keycloak does not allow the caller to "+kcErr.Operation)
+		return
+	}
+	apierrors.Write(c, toAPIError(err, notFoundCode))
+}
+
+// toAPIError performs the mapping described on respondServiceError.
+func toAPIError(err error, notFoundCode string) *apierrors.APIError {
+	switch {
+	case errors.Is(err, services.ErrUserNotFound):
+		return apierrors.New(http.StatusNotFound, apierrors.CodeUserNotFound, err.Error())
+	case errors.Is(err, services.ErrGroupNotFound):
+		return apierrors.New(http.StatusNotFound, apierrors.CodeGroupNotFound, err.Error())
+	case errors.Is(err, services.ErrAmbiguousUser):
+		return apierrors.New(http.StatusBadRequest, apierrors.CodeAmbiguousResult, err.Error())
+	case errors.Is(err, services.ErrCredentialNotFound):
+		return apierrors.New(http.StatusNotFound, apierrors.CodeCredentialNotFound, err.Error())
+	// Federated (e.g. LDAP) users can only be changed in their source directory.
+	case errors.Is(err, services.ErrFederatedUser):
+		return apierrors.New(http.StatusConflict, apierrors.CodeFederatedUser, err.Error())
+	case errors.Is(err, services.ErrImpersonationDisabled):
+		return apierrors.New(http.StatusForbidden, apierrors.CodeImpersonationDisabled, services.ErrImpersonationDisabled.Error())
+	case errors.Is(err, services.ErrImpersonationForbidden):
+		return apierrors.New(http.StatusForbidden, apierrors.CodeForbidden, services.ErrImpersonationForbidden.Error())
+	case errors.Is(err, services.ErrCallerTokenRejected):
+		return apierrors.New(http.StatusUnauthorized, apierrors.CodeUnauthorized, err.Error())
+	case errors.Is(err, services.ErrEmailNotSent):
+		return apierrors.New(http.StatusBadGateway, apierrors.CodeEmailNotSent, services.ErrEmailNotSent.Error())
+	// Only Keycloak's 404 means the resource is missing: clients may treat it as safe to create.
+	case errors.Is(err, services.ErrNotFound):
+		return apierrors.New(http.StatusNotFound, notFoundCode, notFoundMessages[notFoundCode])
+	}
+
+	var kcErr *services.KeycloakError
+	if errors.As(err, &kcErr) {
+		switch kcErr.StatusCode {
+		case http.StatusBadRequest:
+			return apierrors.New(http.StatusBadRequest, apierrors.CodeValidationFailed, upstreamMessage(kcErr))
+		case http.StatusConflict:
+			return apierrors.New(http.StatusConflict, apierrors.CodeConflict, upstreamMessage(kcErr))
+		}
+		return apierrors.New(http.StatusBadGateway, apierrors.CodeUpstreamError, "Keycloak returned an unexpected response").
+			WithDetails(gin.H{"operation": kcErr.Operation, "upstreamStatus": kcErr.StatusCode})
+	}
+
+	// *url.Error (returned by http.Client) implements net.Error, as do dial and DNS errors.
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return apierrors.New(http.StatusBadGateway, apierrors.CodeUpstreamUnavailable, "Keycloak is unreachable")
+	}
+	return apierrors.New(http.StatusInternalServerError, apierrors.CodeInternal, err.Error())
+}
+
+// upstreamMessage extracts Keycloak's own explanation (e.g. a password policy violation)
+// from an error response body, falling back to the full error string.
+func upstreamMessage(kcErr *services.KeycloakError) string {
+	var body struct {
+		ErrorMessage string `json:"errorMessage"`
+		Error        string `json:"error"`
+	}
+	if err := json.Unmarshal([]byte(kcErr.Body), &body); err == nil {
+		if body.ErrorMessage != "" {
+			return body.ErrorMessage
+		}
+		if body.Error != "" {
+			return body.Error
+		}
+	}
+	return kcErr.Error()
+}
@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"ms-user/apierrors"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// respondWithETag responds with HTTP 200 and value serialized as JSON, tagged with an ETag computed over
+// the serialized body. When the request's If-None-Match header matches that ETag, it responds with
+// HTTP 304 Not Modified and no body instead, so that polling clients skip unchanged listings.
+func respondWithETag(c *gin.Context, value interface{}) {
+	body, err := json.Marshal(value)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error serializing response")
+		apierrors.Respond(c, http.StatusInternalServerError, apierrors.CodeInternal, "unable to serialize response")
+		return
+	}
+	sum := sha256.Sum256(body)
+	etag := `"` + hex.EncodeToString(sum[:16]) + `"`
+	c.Header("ETag", etag)
+	if etagMatches(c.GetHeader("If-None-Match"), etag) {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
+
+// etagMatches reports whether an If-None-Match header value lists etag or is "*". Weak validators
+// (W/"...") match their strong counterpart, as RFC 9110 requires for If-None-Match.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -1,73 +1,150 @@
 package handlers
 
 import (
-	"ms-user/config"
+	"ms-user/apierrors"
 	"ms-user/models"
 	"ms-user/services"
 	"net/http"
+	"sort"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
 )
 
 // GroupHandler handles HTTP requests for group-related operations.
 // It leverages the KeycloakService to interact with Keycloak's Admin API.
 type GroupHandler struct {
-	keycloakService *services.KeycloakService
+	keycloakService services.GroupProvider
 }
 
 // NewGroupHandler creates and returns a new GroupHandler instance.
-// It initializes a new KeycloakService with the provided configuration.
-func NewGroupHandler(cfg *config.Config) *GroupHandler {
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewGroupHandler(keycloakService services.GroupProvider) *GroupHandler {
 	return &GroupHandler{
-		keycloakService: services.NewKeycloakService(cfg),
+		keycloakService: keycloakService,
 	}
 }
 
+// service returns the provider targeting the realm chosen by the request, authorized with the caller's
+// Keycloak token when it sent one (see requestScope).
+func (h *GroupHandler) service(c *gin.Context) services.GroupProvider {
+	return h.keycloakService.ScopedGroups(requestScope(c))
+}
+
 // ListGroups handles the HTTP GET request for retrieving all groups.
 // It calls the KeycloakService.ListGroups method and returns the result.
-// On success, it responds with HTTP 200 and the list of groups.
-// On error, it logs the error and responds with HTTP 500.
+// With ?sort=members (and optional order=asc|desc, default desc) each group is returned with its
+// member count and the list is sorted by it; counting is opt-in as it costs one lookup per group.
+// On success, it responds with HTTP 200 and the list of groups, or HTTP 304 if If-None-Match carries its ETag.
+// On invalid sort parameters it responds with HTTP 400; on other errors it logs the error and responds as
+// described on respondServiceError.
 func (h *GroupHandler) ListGroups(c *gin.Context) {
-	groups, err := h.keycloakService.ListGroups()
+	if sortBy := c.Query("sort"); sortBy != "" {
+		h.listGroupsByMemberCount(c, sortBy, c.DefaultQuery("order", "desc"))
+		return
+	}
+	groups, err := h.service(c).ListGroups()
 	if err != nil {
-		log.Error().Err(err).Msg("Error listing groups")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error listing groups")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
-	c.JSON(http.StatusOK, groups)
+	respondWithETag(c, groups)
+}
+
+// listGroupsByMemberCount responds with all groups augmented with their member count and sorted by it.
+func (h *GroupHandler) listGroupsByMemberCount(c *gin.Context, sortBy, order string) {
+	if sortBy != "members" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "sort must be members")
+		return
+	}
+	if order != "asc" && order != "desc" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "order must be asc or desc")
+		return
+	}
+	groups, err := h.service(c).ListGroupsWithMemberCounts()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing groups with member counts")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
+		return
+	}
+	// Stable sort keeps Keycloak's order among groups with the same count.
+	sort.SliceStable(groups, func(i, j int) bool {
+		if order == "asc" {
+			return groups[i].MemberCount < groups[j].MemberCount
+		}
+		return groups[i].MemberCount > groups[j].MemberCount
+	})
+	respondWithETag(c, groups)
 }
 
 // CreateGroup handles the HTTP POST request for creating a new group.
 // It expects a valid JSON body that matches the models.Group structure.
 // On success, it responds with HTTP 201 and the created group.
-// On validation error, it responds with HTTP 400, or HTTP 500 for internal errors.
+// On validation error, it responds with HTTP 400; other errors are mapped by respondServiceError.
 func (h *GroupHandler) CreateGroup(c *gin.Context) {
 	var group models.Group
 	// Bind the incoming JSON payload to the group model.
 	if err := c.ShouldBindJSON(&group); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierrors.Write(c, bindingError(err))
 		return
 	}
-	createdGroup, err := h.keycloakService.CreateGroup(group)
+	createdGroup, err := h.service(c).CreateGroup(group)
 	if err != nil {
-		log.Error().Err(err).Msg("Error creating group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error creating group")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
 	c.JSON(http.StatusCreated, createdGroup)
 }
 
 // ListGroupsWithUsers handles GET /groups/with-users.
-// It retrieves all groups along with their associated users.
+// It retrieves all top-level groups along with their direct members; subgroups are not expanded.
+// The response carries an ETag; HTTP 304 is returned when If-None-Match matches it.
 func (h *GroupHandler) ListGroupsWithUsers(c *gin.Context) {
-	groupsWithUsers, err := h.keycloakService.ListGroupsWithUsers()
+	groupsWithUsers, err := h.service(c).ListGroupsWithUsers()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing groups with users")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
+		return
+	}
+	respondWithETag(c, groupsWithUsers)
+}
+
+// CreateSubGroup handles the HTTP POST request for creating a child group under an existing group.
+// It expects the parent group ID as a path parameter and a valid JSON body that matches the models.Group structure.
+// On success, it responds with HTTP 201 and the created group.
+// On validation error, it responds with HTTP 400; other errors are mapped by respondServiceError.
+func (h *GroupHandler) CreateSubGroup(c *gin.Context) {
+	parentID := c.Param("id")
+	var group models.Group
+	// Bind the incoming JSON payload to the group model.
+	if err := c.ShouldBindJSON(&group); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	createdGroup, err := h.service(c).CreateSubGroup(parentID, group)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error creating subgroup")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
+		return
+	}
+	c.JSON(http.StatusCreated, createdGroup)
+}
+
+// ListSubGroups handles the HTTP GET request for retrieving the direct child groups of a group.
+// It expects the parent group ID as a path parameter.
+// On success, it responds with HTTP 200 and the list of child groups.
+// On error, it logs the error and responds as described on respondServiceError (404 for an unknown parent).
+func (h *GroupHandler) ListSubGroups(c *gin.Context) {
+	parentID := c.Param("id")
+	groups, err := h.service(c).ListSubGroups(parentID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error listing groups with users")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error listing subgroups")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
-	c.JSON(http.StatusOK, groupsWithUsers)
+	c.JSON(http.StatusOK, groups)
 }
 
 // GetGroup handles the HTTP GET request for retrieving a specific group by ID.
@@ -76,15 +153,49 @@ func (h *GroupHandler) ListGroupsWithUsers(c *gin.Context) {
 // If the group is not found, it responds with HTTP 404.
 func (h *GroupHandler) GetGroup(c *gin.Context) {
 	id := c.Param("id")
-	group, err := h.keycloakService.GetGroup(id)
+	group, err := h.service(c).GetGroup(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error fetching group")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, group)
+}
+
+// GetGroupByPath handles the HTTP GET request for retrieving a group by its path instead of its ID.
+// It expects the full group path (e.g. /engineering/backend) after "by-path".
+// On success, it responds with HTTP 200 and the group details.
+// If no group has that path, it responds with HTTP 404.
+func (h *GroupHandler) GetGroupByPath(c *gin.Context) {
+	path := strings.Trim(c.Param("path"), "/")
+	if path == "" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "group path is required")
+		return
+	}
+	group, err := h.service(c).GetGroupByPath(path)
 	if err != nil {
-		log.Error().Err(err).Msg("Error fetching group")
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error fetching group by path")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, group)
 }
 
+// CountGroupMembers handles the HTTP GET request for the number of direct members of a group.
+// It expects the group ID as a path parameter; members are counted without being returned.
+// On success, it responds with HTTP 200 and {"count": <number of members>}.
+// If the group is not found, it responds with HTTP 404.
+func (h *GroupHandler) CountGroupMembers(c *gin.Context) {
+	id := c.Param("id")
+	count, err := h.service(c).CountGroupMembers(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error counting group members")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": count})
+}
+
 // UpdateGroup handles the HTTP PUT request for updating an existing group.
 // It expects the group ID as a path parameter and a valid JSON body with the updated data.
 // On success, it responds with HTTP 200 and the updated group.
@@ -94,13 +205,13 @@ func (h *GroupHandler) UpdateGroup(c *gin.Context) {
 	var group models.Group
 	// Bind the JSON payload to the group model.
 	if err := c.ShouldBindJSON(&group); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierrors.Write(c, bindingError(err))
 		return
 	}
-	updatedGroup, err := h.keycloakService.UpdateGroup(id, group)
+	updatedGroup, err := h.service(c).UpdateGroup(id, group)
 	if err != nil {
-		log.Error().Err(err).Msg("Error updating group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error updating group")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, updatedGroup)
@@ -109,20 +220,21 @@ func (h *GroupHandler) UpdateGroup(c *gin.Context) {
 // DeleteGroup handles the HTTP DELETE request for deleting a group by ID.
 // It expects the group ID as a path parameter.
 // On success, it responds with HTTP 204 and no content.
-// On error, it logs the error and responds with HTTP 500.
+// On error, it logs the error and responds as described on respondServiceError (404 for an unknown group).
 func (h *GroupHandler) DeleteGroup(c *gin.Context) {
 	id := c.Param("id")
-	err := h.keycloakService.DeleteGroup(id)
+	err := h.service(c).DeleteGroup(id)
 	if err != nil {
-		log.Error().Err(err).Msg("Error deleting group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error deleting group")
+		respondServiceError(c, err, apierrors.CodeGroupNotFound)
 		return
 	}
 	// Respond with HTTP 204 No Content when deletion is successful.
 	c.JSON(http.StatusNoContent, nil)
 }
 
-// SetKeycloakService overrides the underlying KeycloakService (useful for testing).
-func (h *GroupHandler) SetKeycloakService(svc *services.KeycloakService) {
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *GroupHandler) SetKeycloakService(svc services.GroupProvider) {
 	h.keycloakService = svc
 }
@@ -0,0 +1,52 @@
+package handlers
+
+import (
+	"ms-user/services"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// HealthHandler handles liveness and readiness probes.
+// The readiness probe verifies that Keycloak can be reached with the configured credentials.
+type HealthHandler struct {
+	keycloakService services.HealthChecker
+}
+
+// NewHealthHandler creates and returns a new HealthHandler instance.
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewHealthHandler(keycloakService services.HealthChecker) *HealthHandler {
+	return &HealthHandler{
+		keycloakService: keycloakService,
+	}
+}
+
+// Health handles the HTTP GET liveness probe.
+// Endpoint: GET /health
+//
+// Output: Always HTTP 200 with {"status": "up"} while the process is running.
+func (h *HealthHandler) Health(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "up"})
+}
+
+// Ready handles the HTTP GET readiness probe.
+// Endpoint: GET /ready
+//
+// Output:
+//   - HTTP 200 with {"status": "ready"} when Keycloak answers an Admin API call with the admin token.
+//   - HTTP 503 with {"status": "unavailable", "reason": "keycloak unavailable"} otherwise. The probe is
+//     public, so the details (which may include Keycloak's response) are only logged.
+func (h *HealthHandler) Ready(c *gin.Context) {
+	if err := h.keycloakService.Ping(); err != nil {
+		requestLogger(c).Error().Err(err).Msg("Readiness check failed")
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "unavailable", "reason": "keycloak unavailable"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready"})
+}
+
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *HealthHandler) SetKeycloakService(svc services.HealthChecker) {
+	h.keycloakService = svc
+}
@@ -0,0 +1,13 @@
+package handlers
+
+import (
+	"ms-user/middleware"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+)
+
+// requestLogger returns the request-scoped logger, so that handler log lines carry the request ID.
+func requestLogger(c *gin.Context) *zerolog.Logger {
+	return middleware.RequestLogger(c)
+}
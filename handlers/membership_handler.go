@@ -1,28 +1,37 @@
 package handlers
 
 import (
-	"ms-user/config"
+	"encoding/csv"
+	"errors"
+	"ms-user/apierrors"
+	"ms-user/models"
 	"ms-user/services"
 	"net/http"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
 )
 
 // MembershipHandler handles HTTP requests for user-group membership operations.
 // It leverages the KeycloakService to interact with Keycloak's Admin API for membership management.
 type MembershipHandler struct {
-	keycloakService *services.KeycloakService
+	keycloakService services.MembershipProvider
 }
 
 // NewMembershipHandler creates a new MembershipHandler instance.
-// It initializes a KeycloakService using the provided configuration.
-func NewMembershipHandler(cfg *config.Config) *MembershipHandler {
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewMembershipHandler(keycloakService services.MembershipProvider) *MembershipHandler {
 	return &MembershipHandler{
-		keycloakService: services.NewKeycloakService(cfg),
+		keycloakService: keycloakService,
 	}
 }
 
+// service returns the provider targeting the realm chosen by the request, authorized with the caller's
+// Keycloak token when it sent one (see requestScope).
+func (h *MembershipHandler) service(c *gin.Context) services.MembershipProvider {
+	return h.keycloakService.ScopedMemberships(requestScope(c))
+}
+
 // ListUserGroups handles the HTTP GET request for retrieving all groups that a given user belongs to.
 // Endpoint: GET /users/:id/groups
 //
@@ -31,18 +40,37 @@ func NewMembershipHandler(cfg *config.Config) *MembershipHandler {
 //
 // Output:
 //   - On success: HTTP 200 with a JSON array of groups.
-//   - On error: An error message with HTTP 500.
+//   - On error: HTTP 404 if the user does not exist, otherwise an error mapped by respondServiceError.
 func (h *MembershipHandler) ListUserGroups(c *gin.Context) {
 	userID := c.Param("id")
-	groups, err := h.keycloakService.ListUserGroups(userID)
+	groups, err := h.service(c).ListUserGroups(userID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error listing groups for user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error listing groups for user")
+		respondServiceError(c, err, apierrors.CodeNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, groups)
 }
 
+// IsUserInGroup handles the HTTP GET request for checking whether a user is a direct member of a group.
+// Endpoint: GET /users/:id/groups/:groupId
+//
+// Input:
+//   - userID and groupID from URL path parameters.
+//
+// Output:
+//   - On success: HTTP 200 with {"member": true} or {"member": false}.
+//   - On error: HTTP 404 USER_NOT_FOUND or GROUP_NOT_FOUND, otherwise an error mapped by respondServiceError.
+func (h *MembershipHandler) IsUserInGroup(c *gin.Context) {
+	member, err := h.service(c).IsUserInGroup(c.Param("id"), c.Param("groupId"))
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error checking group membership")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"member": member})
+}
+
 // AddUserToGroup handles the HTTP PUT request to assign a user to a group.
 // Endpoint: PUT /users/:id/groups/:groupId
 //
@@ -50,20 +78,67 @@ func (h *MembershipHandler) ListUserGroups(c *gin.Context) {
 //   - userID and groupID from URL path parameters.
 //
 // Output:
-//   - On success: HTTP 204 No Content.
-//   - On error: An error message with HTTP 500.
+//   - On success: HTTP 204 No Content, also when the user already was a member (the call is idempotent).
+//   - On error: HTTP 404 USER_NOT_FOUND or GROUP_NOT_FOUND, HTTP 403 FORBIDDEN if Keycloak denies the change,
+//     otherwise an error mapped by respondServiceError.
 func (h *MembershipHandler) AddUserToGroup(c *gin.Context) {
 	userID := c.Param("id")
 	groupID := c.Param("groupId")
-	err := h.keycloakService.AddUserToGroup(userID, groupID)
+	added, err := h.service(c).EnsureUserInGroup(userID, groupID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error adding user to group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error adding user to group")
+		respondMembershipError(c, err)
 		return
 	}
+	if !added {
+		requestLogger(c).Info().Str("user_id", userID).Str("group_id", groupID).Msg("User already is a member of the group")
+	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
+// addUserToGroupsRequest is the JSON body accepted by AddUserToGroups.
+type addUserToGroupsRequest struct {
+	GroupIDs []string `json:"groupIds" binding:"required,min=1"`
+}
+
+// AddUserToGroups handles the HTTP PUT request to add a user to several groups at once.
+// Endpoint: PUT /users/:id/groups
+//
+// Input:
+//   - userID from the URL path parameter.
+//   - A JSON body {"groupIds": ["...", "..."]}.
+//
+// Output:
+//   - HTTP 207 with a models.GroupJoinResponse: one result per group (success flag or error code and
+//     message) in request order, plus joined/failed counts. A failing group does not abort the others.
+//   - HTTP 400 if the body does not hold a non-empty list of group IDs.
+func (h *MembershipHandler) AddUserToGroups(c *gin.Context) {
+	userID := c.Param("id")
+	var body addUserToGroupsRequest
+	// Bind the JSON payload to the groups request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+
+	errs := h.service(c).AddUserToGroups(userID, body.GroupIDs)
+	response := models.GroupJoinResponse{Results: make([]models.GroupJoinResult, len(body.GroupIDs))}
+	for i, groupID := range body.GroupIDs {
+		result := models.GroupJoinResult{GroupID: groupID}
+		if errs[i] != nil {
+			requestLogger(c).Error().Err(errs[i]).Str("groupId", groupID).Msg("Error adding user to group in batch")
+			apiErr := membershipAPIError(errs[i])
+			result.Code, result.Error = apiErr.Code, apiErr.Message
+			response.Failed++
+		} else {
+			result.Success = true
+			response.Joined++
+		}
+		response.Results[i] = result
+	}
+	c.JSON(http.StatusMultiStatus, response)
+}
+
 // AddUserToGroupByEmail handles the HTTP PUT request to add a user (searched by email) to a group.
 // Endpoint: PUT /ms-user/v1/users/email/:email/groups/:groupId
 //
@@ -73,39 +148,52 @@ func (h *MembershipHandler) AddUserToGroup(c *gin.Context) {
 //
 // Output:
 //   - On success: HTTP 204 No Content.
-//   - On error: Returns an appropriate HTTP status and error message.
+//   - On error: HTTP 404 USER_NOT_FOUND / GROUP_NOT_FOUND, HTTP 400 AMBIGUOUS_RESULT if the email matches
+//     several users, or HTTP 403 FORBIDDEN (see membershipAPIError).
 func (h *MembershipHandler) AddUserToGroupByEmail(c *gin.Context) {
 	email := c.Param("email")
 	groupID := c.Param("groupId")
 
 	if email == "" || groupID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email and groupId are required"})
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "email and groupId are required")
 		return
 	}
 
-	// Search for the user by email.
-	users, err := h.keycloakService.SearchUserByEmail(email)
+	// Resolve the user by email and add them to the group.
+	err := h.service(c).AddUserToGroupByEmail(email, groupID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error searching user by email")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error adding user to group by email")
+		respondMembershipError(c, err)
 		return
 	}
+	c.JSON(http.StatusNoContent, nil)
+}
 
-	if len(users) == 0 {
-		c.JSON(http.StatusNotFound, gin.H{"error": "no user found with the provided email"})
-		return
-	}
-	if len(users) > 1 {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "multiple users found with the provided email"})
+// AddUserToGroupByEmailAndPath handles the HTTP PUT request to add a user (searched by email) to a group
+// identified by its path, so that callers don't need the group ID.
+// Endpoint: PUT /ms-user/v1/users/email/:email/groups/by-path/*path
+//
+// Input:
+//   - email: provided as a URL path parameter.
+//   - path: the full group path (e.g. /engineering/backend) after "by-path".
+//
+// Output:
+//   - On success: HTTP 204 No Content.
+//   - On error: mapped as for AddUserToGroupByEmail.
+func (h *MembershipHandler) AddUserToGroupByEmailAndPath(c *gin.Context) {
+	email := c.Param("email")
+	groupPath := strings.Trim(c.Param("path"), "/")
+
+	if email == "" || groupPath == "" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "email and group path are required")
 		return
 	}
 
-	// Use the found user's ID to add the user to the group.
-	userID := users[0].ID
-	err = h.keycloakService.AddUserToGroup(userID, groupID)
+	// Resolve the user by email and the group by path, then add the user to the group.
+	err := h.service(c).AddUserToGroupByEmailAndPath(email, groupPath)
 	if err != nil {
-		log.Error().Err(err).Msg("Error adding user to group by email")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error adding user to group by email and path")
+		respondMembershipError(c, err)
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
@@ -119,40 +207,181 @@ func (h *MembershipHandler) AddUserToGroupByEmail(c *gin.Context) {
 //
 // Output:
 //   - On success: HTTP 204 No Content.
-//   - On error: An error message with HTTP 500.
+//   - On error: HTTP 404 USER_NOT_FOUND or GROUP_NOT_FOUND, HTTP 403 FORBIDDEN if Keycloak denies the change,
+//     otherwise an error mapped by respondServiceError.
 func (h *MembershipHandler) RemoveUserFromGroup(c *gin.Context) {
 	userID := c.Param("id")
 	groupID := c.Param("groupId")
-	err := h.keycloakService.RemoveUserFromGroup(userID, groupID)
+	err := h.service(c).RemoveUserFromGroup(userID, groupID)
 	if err != nil {
-		log.Error().Err(err).Msg("Error removing user from group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error removing user from group")
+		respondMembershipError(c, err)
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
+// RemoveUserFromAllGroups handles the HTTP DELETE request to remove a user from every group it belongs to.
+// Endpoint: DELETE /users/:id/groups
+//
+// Input:
+//   - userID from the URL path parameter.
+//
+// Output:
+//   - HTTP 207 with a models.GroupLeaveResponse: one result per group the user was a member of (group ID
+//     and path, success flag or error code and message), plus removed/failed counts. A failing group does
+//     not abort the others.
+//   - On error listing the user's groups: HTTP 404 USER_NOT_FOUND, otherwise an error mapped by respondServiceError.
+func (h *MembershipHandler) RemoveUserFromAllGroups(c *gin.Context) {
+	userID := c.Param("id")
+	groups, errs, err := h.service(c).RemoveUserFromAllGroups(userID)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing groups to remove user from")
+		respondMembershipError(c, err)
+		return
+	}
+
+	response := models.GroupLeaveResponse{Results: make([]models.GroupJoinResult, len(groups))}
+	for i, group := range groups {
+		result := models.GroupJoinResult{GroupID: group.ID, GroupPath: group.Path}
+		if errs[i] != nil {
+			requestLogger(c).Error().Err(errs[i]).Str("groupId", group.ID).Msg("Error removing user from group in batch")
+			apiErr := membershipAPIError(errs[i])
+			result.Code, result.Error = apiErr.Code, apiErr.Message
+			response.Failed++
+		} else {
+			result.Success = true
+			response.Removed++
+		}
+		response.Results[i] = result
+	}
+	c.JSON(http.StatusMultiStatus, response)
+}
+
 // ListGroupUsers handles the HTTP GET request for retrieving all users that are members of a specific group.
-// Endpoint: GET /groups/:id/users
+// Endpoint: GET /groups/:id/users?brief=<bool>
 //
 // Input:
 //   - groupID from URL path parameter.
+//   - Optional "brief=true" query parameter, returning Keycloak's brief user representation (see models.User).
 //
 // Output:
 //   - On success: HTTP 200 with a JSON array of users.
-//   - On error: An error message with HTTP 500.
+//   - On error: HTTP 400 for an invalid "brief" value, otherwise an error mapped by respondServiceError.
 func (h *MembershipHandler) ListGroupUsers(c *gin.Context) {
 	groupID := c.Param("id")
-	users, err := h.keycloakService.ListGroupUsers(groupID)
+	brief, err := parseBrief(c)
+	if err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+	users, err := h.service(c).ListGroupUsers(groupID, brief)
 	if err != nil {
-		log.Error().Err(err).Msg("Error listing users in group")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error listing users in group")
+		respondServiceError(c, err, apierrors.CodeNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, users)
 }
 
-// SetKeycloakService overrides the underlying KeycloakService (useful for testing).
-func (h *MembershipHandler) SetKeycloakService(svc *services.KeycloakService) {
+// ListMemberships handles the HTTP GET request for exporting all memberships as a flat user -> groups mapping.
+// Endpoint: GET /memberships?format=json|csv
+//
+// Input:
+//   - format: optional query parameter, "json" (default) or "csv".
+//
+// Output:
+//   - On success: HTTP 200 with one entry per user listing the paths of their groups. The CSV variant has the
+//     columns userId, username, email, groups (group paths separated by ";").
+//   - On error: HTTP 400 for an unknown format, otherwise an error mapped by respondServiceError.
+func (h *MembershipHandler) ListMemberships(c *gin.Context) {
+	format := c.DefaultQuery("format", "json")
+	if format != "json" && format != "csv" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "format must be json or csv")
+		return
+	}
+
+	rows, err := h.service(c).MembershipMatrix()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error building membership matrix")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	if format == "json" {
+		c.JSON(http.StatusOK, rows)
+		return
+	}
+
+	c.Header("Content-Type", "text/csv")
+	c.Header("Content-Disposition", `attachment; filename="memberships.csv"`)
+	c.Status(http.StatusOK)
+	writer := csv.NewWriter(c.Writer)
+	writer.Write([]string{"userId", "username", "email", "groups"})
+	for _, row := range rows {
+		writer.Write([]string{row.UserID, row.Username, row.Email, strings.Join(row.Groups, ";")})
+	}
+	writer.Flush()
+	if err := writer.Error(); err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error writing membership CSV")
+	}
+}
+
+// moveGroupRequest is the JSON body accepted by MoveUserBetweenGroups.
+type moveGroupRequest struct {
+	From string `json:"from" binding:"required"`
+	To   string `json:"to" binding:"required"`
+}
+
+// MoveUserBetweenGroups handles the HTTP POST request to transfer a user from one group to another.
+// Endpoint: POST /users/:id/move-group
+//
+// Input:
+//   - userID from the URL path parameter.
+//   - A JSON body {"from": "<groupId>", "to": "<groupId>"}.
+//
+// Output:
+//   - On success: HTTP 204 No Content.
+//   - On error: HTTP 400 for an invalid body, otherwise mapped as for AddUserToGroup. The user is added to
+//     the destination before being removed from the source, so a failed move never leaves the user in neither group.
+func (h *MembershipHandler) MoveUserBetweenGroups(c *gin.Context) {
+	userID := c.Param("id")
+	var body moveGroupRequest
+	// Bind the JSON payload to the move request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	if body.From == body.To {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "from and to must be different groups")
+		return
+	}
+
+	err := h.service(c).MoveUserBetweenGroups(userID, body.From, body.To)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error moving user between groups")
+		respondMembershipError(c, err)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// respondMembershipError maps a failed membership change as described on membershipAPIError.
+func respondMembershipError(c *gin.Context, err error) {
+	apierrors.Write(c, membershipAPIError(err))
+}
+
+// membershipAPIError maps a failed membership change. Unlike other endpoints, a Keycloak 403 is passed on
+// as 403 FORBIDDEN: it means the group is protected by fine-grained permissions the service account lacks.
+func membershipAPIError(err error) *apierrors.APIError {
+	var kcErr *services.KeycloakError
+	if errors.As(err, &kcErr) && kcErr.StatusCode == http.StatusForbidden {
+		return apierrors.New(http.StatusForbidden, apierrors.CodeForbidden, "not allowed to change this group membership")
+	}
+	return toAPIError(err, apierrors.CodeNotFound)
+}
+
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *MembershipHandler) SetKeycloakService(svc services.MembershipProvider) {
 	h.keycloakService = svc
 }
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// defaultPageSize is the page size used when only "first" is given.
+const defaultPageSize = 100
+
+// maxPageSize caps the "max" query parameter of paginated endpoints.
+const maxPageSize = 1000
+
+// parsePage reads the "first" and "max" query parameters of a paginated request.
+// paged is false when neither parameter is given, in which case the endpoint returns everything.
+func parsePage(c *gin.Context, defaultMax int) (first, max int, paged bool, err error) {
+	firstParam, hasFirst := c.GetQuery("first")
+	maxParam, hasMax := c.GetQuery("max")
+	if !hasFirst && !hasMax {
+		return 0, 0, false, nil
+	}
+	first, max = 0, defaultMax
+	if hasFirst {
+		if first, err = strconv.Atoi(firstParam); err != nil || first < 0 {
+			return 0, 0, true, fmt.Errorf("first must be a non-negative integer")
+		}
+	}
+	if hasMax {
+		if max, err = strconv.Atoi(maxParam); err != nil || max < 1 || max > maxPageSize {
+			return 0, 0, true, fmt.Errorf("max must be an integer between 1 and %d", maxPageSize)
+		}
+	}
+	return first, max, true, nil
+}
+
+// setPaginationLinks sets an RFC 8288 Link header with "next" (when the page is full) and "prev"
+// (when it is not the first page) relations. Links are absolute: they are built on publicBaseURL,
+// the externally visible URL configured behind a reverse proxy, or on the request's own host when empty.
+func setPaginationLinks(c *gin.Context, publicBaseURL string, first, max, count int) {
+	var links []string
+	if count == max {
+		links = append(links, fmt.Sprintf(`<%s>; rel="next"`, pageURL(c, publicBaseURL, first+max, max)))
+	}
+	if first > 0 {
+		prev := first - max
+		if prev < 0 {
+			prev = 0
+		}
+		links = append(links, fmt.Sprintf(`<%s>; rel="prev"`, pageURL(c, publicBaseURL, prev, max)))
+	}
+	if len(links) > 0 {
+		c.Header("Link", strings.Join(links, ", "))
+	}
+}
+
+// pageURL returns the absolute URL of the current request with first and max replaced.
+// Other query parameters are kept.
+func pageURL(c *gin.Context, publicBaseURL string, first, max int) string {
+	base := publicBaseURL
+	if base == "" {
+		scheme := "http"
+		if c.Request.TLS != nil {
+			scheme = "https"
+		}
+		base = scheme + "://" + c.Request.Host
+	}
+	query := c.Request.URL.Query()
+	query.Set("first", strconv.Itoa(first))
+	query.Set("max", strconv.Itoa(max))
+	u := url.URL{Path: c.Request.URL.Path, RawQuery: query.Encode()}
+	return base + u.RequestURI()
+}
@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"ms-user/apierrors"
+	"ms-user/models"
+	"ms-user/services"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RoleHandler handles HTTP requests for realm role operations.
+// It leverages the KeycloakService to interact with Keycloak's Admin API for role management.
+type RoleHandler struct {
+	keycloakService services.RoleProvider
+}
+
+// NewRoleHandler creates a new RoleHandler instance.
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewRoleHandler(keycloakService services.RoleProvider) *RoleHandler {
+	return &RoleHandler{
+		keycloakService: keycloakService,
+	}
+}
+
+// service returns the provider targeting the realm chosen by the request, authorized with the caller's
+// Keycloak token when it sent one (see requestScope).
+func (h *RoleHandler) service(c *gin.Context) services.RoleProvider {
+	return h.keycloakService.ScopedRoles(requestScope(c))
+}
+
+// ListUserRoles handles the HTTP GET request for retrieving the realm roles assigned to a user.
+// Endpoint: GET /users/:id/roles
+//
+// Input:
+//   - userID from URL path parameter.
+//
+// Output:
+//   - On success: HTTP 200 with a JSON array of roles.
+//   - On error: HTTP 404 USER_NOT_FOUND if the user does not exist, otherwise an error mapped by respondServiceError.
+func (h *RoleHandler) ListUserRoles(c *gin.Context) {
+	userID := c.Param("id")
+	roles, err := h.service(c).ListUserRealmRoles(userID)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing realm roles for user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, roles)
+}
+
+// AddRoleToUser handles the HTTP PUT request to assign a realm role to a user.
+// Endpoint: PUT /users/:id/roles/:roleName
+//
+// Input:
+//   - userID and roleName from URL path parameters.
+//
+// Output:
+//   - On success: HTTP 204 No Content.
+//   - On error: HTTP 404 ROLE_NOT_FOUND if the role or the user does not exist, otherwise an error mapped by respondServiceError.
+func (h *RoleHandler) AddRoleToUser(c *gin.Context) {
+	userID := c.Param("id")
+	roleName := c.Param("roleName")
+	err := h.service(c).AddRealmRoleToUser(userID, roleName)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error adding realm role to user")
+		respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// RemoveRoleFromUser handles the HTTP DELETE request to remove a realm role from a user.
+// Endpoint: DELETE /users/:id/roles/:roleName
+//
+// Input:
+//   - userID and roleName from URL path parameters.
+//
+// Output:
+//   - On success: HTTP 204 No Content.
+//   - On error: HTTP 404 ROLE_NOT_FOUND if the role or the user does not exist, otherwise an error mapped by respondServiceError.
+func (h *RoleHandler) RemoveRoleFromUser(c *gin.Context) {
+	userID := c.Param("id")
+	roleName := c.Param("roleName")
+	err := h.service(c).RemoveRealmRoleFromUser(userID, roleName)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error removing realm role from user")
+		respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// ListRoleUsers handles the HTTP GET request for retrieving the users that hold a realm role.
+// Endpoint: GET /roles/:name/users
+//
+// Input:
+//   - role name from URL path parameter.
+//
+// Output:
+//   - On success: HTTP 200 with a JSON array of users.
+//   - On error: HTTP 404 ROLE_NOT_FOUND if the role does not exist, otherwise an error mapped by respondServiceError.
+func (h *RoleHandler) ListRoleUsers(c *gin.Context) {
+	roleName := c.Param("name")
+	users, err := h.service(c).ListUsersWithRealmRole(roleName)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing users with realm role")
+		respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusOK, users)
+}
+
+// DeleteRole handles the HTTP DELETE request for deleting a realm role.
+// Endpoint: DELETE /roles/:name?dryRun=true
+//
+// Input:
+//   - role name from URL path parameter.
+//   - dryRun: optional boolean query parameter (true, 1, ...); when set nothing is deleted. Any value
+//     that is not a boolean is rejected with HTTP 400 rather than treated as a real deletion.
+//
+// Output:
+//   - On success: HTTP 204 No Content, or with dryRun HTTP 200 with {"role", "dryRun", "affectedUsers"}
+//     listing the users that would lose the role.
+//   - On error: HTTP 400 for an invalid dryRun, HTTP 404 ROLE_NOT_FOUND if the role does not exist,
+//     otherwise an error mapped by respondServiceError.
+func (h *RoleHandler) DeleteRole(c *gin.Context) {
+	roleName := c.Param("name")
+	dryRun := false
+	if value := c.Query("dryRun"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "dryRun must be true or false")
+			return
+		}
+		dryRun = parsed
+	}
+	if dryRun {
+		users, err := h.service(c).ListUsersWithRealmRole(roleName)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Msg("Error previewing realm role deletion")
+			respondRoleError(c, err)
+			return
+		}
+		if users == nil {
+			users = []models.User{}
+		}
+		c.JSON(http.StatusOK, gin.H{"role": roleName, "dryRun": true, "affectedUsers": users})
+		return
+	}
+
+	err := h.service(c).DeleteRealmRole(roleName)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error deleting realm role")
+		respondRoleError(c, err)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// respondRoleError maps a Keycloak 404 (unknown role or user) to ROLE_NOT_FOUND; other errors
+// are mapped like in every other handler.
+func respondRoleError(c *gin.Context, err error) {
+	respondServiceError(c, err, apierrors.CodeRoleNotFound)
+}
+
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *RoleHandler) SetKeycloakService(svc services.RoleProvider) {
+	h.keycloakService = svc
+}
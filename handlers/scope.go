@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"ms-user/middleware"
+	"ms-user/services"
+
+	"github.com/gin-gonic/gin"
+)
+
+// requestScope returns the scope of the provider calls made for the request: the realm chosen with
+// X-Realm and, when enabled, the caller's Keycloak token.
+func requestScope(c *gin.Context) services.Scope {
+	return services.Scope{Realm: requestRealm(c), CallerToken: requestCallerToken(c)}
+}
+
+// requestRealm returns the realm chosen by the request's X-Realm header (see middleware.RealmMiddleware),
+// or "" for the configured realm.
+func requestRealm(c *gin.Context) string {
+	return c.GetString(middleware.RealmKey)
+}
+
+// requestCallerToken returns the caller's Keycloak access token stored by middleware.AuthMiddleware, or ""
+// when the calls must use the admin token.
+func requestCallerToken(c *gin.Context) string {
+	return c.GetString(middleware.CallerTokenKey)
+}
@@ -0,0 +1,88 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"ms-user/docs"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"gopkg.in/yaml.v3"
+)
+
+// swaggerUIVersion is the swagger-ui-dist release the documentation page loads from the CDN.
+const swaggerUIVersion = "5.17.14"
+
+// swaggerUIPage is the Swagger UI page; %[1]s is the swagger-ui-dist version and %[2]s the URL of the spec.
+const swaggerUIPage = `<!DOCTYPE html>
+<html lang="en">
+<head>
+  <meta charset="utf-8" />
+  <title>ms-user API</title>
+  <link rel="stylesheet" href="https://unpkg.com/swagger-ui-dist@%[1]s/swagger-ui.css" />
+</head>
+<body>
+  <div id="swagger-ui"></div>
+  <script src="https://unpkg.com/swagger-ui-dist@%[1]s/swagger-ui-bundle.js" crossorigin></script>
+  <script>
+    window.onload = () => {
+      window.ui = SwaggerUIBundle({ url: "%[2]s", dom_id: "#swagger-ui" });
+    };
+  </script>
+</body>
+</html>
+`
+
+// SwaggerHandler serves the OpenAPI specification of the service and a Swagger UI page to explore it.
+type SwaggerHandler struct {
+	spec     []byte // The specification as JSON, with the server URL set to the configured base path.
+	specErr  error  // Set when the embedded specification could not be parsed.
+	basePath string
+}
+
+// NewSwaggerHandler creates and returns a new SwaggerHandler instance.
+// It converts the embedded OpenAPI specification to JSON once, pointing its server URL at cfg.BasePath.
+func NewSwaggerHandler(cfg *config.Config) *SwaggerHandler {
+	h := &SwaggerHandler{basePath: "/" + cfg.BasePath}
+	h.spec, h.specErr = openAPIJSON(docs.OpenAPI, h.basePath)
+	return h
+}
+
+// openAPIJSON converts a YAML OpenAPI specification to JSON and replaces its servers with basePath.
+// Path-level servers (e.g. those of the probes served at the root) are kept.
+func openAPIJSON(spec []byte, basePath string) ([]byte, error) {
+	var doc map[string]interface{}
+	if err := yaml.Unmarshal(spec, &doc); err != nil {
+		return nil, fmt.Errorf("failed to parse OpenAPI specification: %w", err)
+	}
+	doc["servers"] = []map[string]string{{"url": basePath}}
+	return json.Marshal(doc)
+}
+
+// Serve handles the HTTP GET requests for the API documentation.
+// Endpoint: GET /swagger/*any
+//
+// Input: The requested file as the "any" path parameter.
+// Output:
+//   - "/doc.json" returns the OpenAPI specification as JSON.
+//   - "/" and "/index.html" return the Swagger UI page.
+//   - Any other file returns HTTP 404; HTTP 500 is returned if the embedded specification is invalid.
+func (h *SwaggerHandler) Serve(c *gin.Context) {
+	switch strings.TrimPrefix(c.Param("any"), "/") {
+	case "doc.json":
+		if h.specErr != nil {
+			requestLogger(c).Error().Err(h.specErr).Msg("Error serving OpenAPI specification")
+			apierrors.Respond(c, http.StatusInternalServerError, apierrors.CodeInternal, "OpenAPI specification unavailable")
+			return
+		}
+		c.Data(http.StatusOK, "application/json; charset=utf-8", h.spec)
+	case "", "index.html":
+		page := fmt.Sprintf(swaggerUIPage, swaggerUIVersion, h.basePath+"/swagger/doc.json")
+		c.Data(http.StatusOK, "text/html; charset=utf-8", []byte(page))
+	default:
+		apierrors.Respond(c, http.StatusNotFound, apierrors.CodeNotFound, "documentation file not found")
+	}
+}
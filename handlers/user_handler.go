@@ -1,69 +1,459 @@
 package handlers
 
 import (
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"ms-user/apierrors"
 	"ms-user/config"
 	"ms-user/models"
 	"ms-user/services"
 	"net/http"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
+	"github.com/gin-gonic/gin/binding"
 )
 
 // UserHandler handles HTTP requests related to user management.
 // It utilizes the KeycloakService to perform CRUD operations on users through Keycloak's Admin API.
 type UserHandler struct {
-	keycloakService *services.KeycloakService
+	keycloakService services.UserProvider
+	publicBaseURL   string // Base of absolute pagination links; the request host is used when empty.
 }
 
 // NewUserHandler initializes and returns a new UserHandler instance.
-// It sets up a new KeycloakService using the provided configuration.
-func NewUserHandler(cfg *config.Config) *UserHandler {
+// keycloakService is usually the *services.KeycloakService shared by all handlers.
+func NewUserHandler(cfg *config.Config, keycloakService services.UserProvider) *UserHandler {
 	return &UserHandler{
-		keycloakService: services.NewKeycloakService(cfg),
+		keycloakService: keycloakService,
+		publicBaseURL:   cfg.PublicBaseURL,
 	}
 }
 
+// service returns the provider targeting the realm chosen by the request, authorized with the caller's
+// Keycloak token when it sent one (see requestScope).
+func (h *UserHandler) service(c *gin.Context) services.UserProvider {
+	return h.keycloakService.ScopedUsers(requestScope(c))
+}
+
 // ListUsers handles the HTTP GET request for retrieving all users.
-// Endpoint: GET /users
+// Endpoint: GET /users?first=<offset>&max=<count>&enabled=<bool>&emailVerified=<bool>&brief=<bool>
 //
-// Input: No body parameters. The request may include headers (e.g., for authentication).
+// Input: Optional "first" and "max" query parameters. Without them the first defaultPageSize users are
+// returned, with the user count in X-Total-Count and "X-Listing-Incomplete: true" if there are more;
+// either way a page is returned along with a Link header pointing at the next/previous pages.
+// Optional "enabled" and "emailVerified" restrict the users to those with that state, and "brief=true"
+// returns Keycloak's brief user representation (see models.User).
 // Output: On success, returns HTTP 200 with a JSON array of user objects.
 //
-//	On error, returns HTTP 500 with an error message.
+//	On error, returns HTTP 400 for invalid paging or filter parameters or an error mapped by respondServiceError.
 func (h *UserHandler) ListUsers(c *gin.Context) {
-	users, err := h.keycloakService.ListUsers()
+	first, max, paged, err := parsePage(c, defaultPageSize)
+	if err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+	filter, err := parseUserFilter(c)
 	if err != nil {
-		log.Error().Err(err).Msg("Error listing users")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+	if filter.Brief, err = parseBrief(c); err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+	if !paged {
+		users, total, err := h.service(c).ListUsers(filter, defaultPageSize)
+		if err != nil {
+			requestLogger(c).Error().Err(err).Msg("Error listing users")
+			respondServiceError(c, err, apierrors.CodeUserNotFound)
+			return
+		}
+		if total >= 0 {
+			c.Header("X-Total-Count", strconv.Itoa(total))
+			if total > len(users) {
+				c.Header("X-Listing-Incomplete", "true")
+			}
+		}
+		setPaginationLinks(c, h.publicBaseURL, 0, defaultPageSize, len(users))
+		c.JSON(http.StatusOK, users)
 		return
 	}
+
+	users, err := h.service(c).ListUsersPage(filter, first, max)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing users page")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	setPaginationLinks(c, h.publicBaseURL, first, max, len(users))
 	c.JSON(http.StatusOK, users)
 }
 
+// ExportUsers handles the HTTP GET request for exporting every user as a file download.
+// Endpoint: GET /users/export?format=csv|json&enabled=<bool>&emailVerified=<bool>
+//
+// Input: Optional "format" ("csv", the default, or "json") and the same state filters as ListUsers.
+// Output: On success, returns HTTP 200 with an attachment: a CSV with the columns id, username, email,
+// firstName, lastName, enabled, emailVerified, or a JSON array of users. Users are fetched page by page
+// and each page is written as soon as it arrives, so the export never holds all users in memory.
+//
+//	On error, returns HTTP 400 for invalid parameters, or an error mapped by respondServiceError if the
+//	first page fails. A later failure can no longer change the status: it is logged and the download is cut short.
+func (h *UserHandler) ExportUsers(c *gin.Context) {
+	format := c.DefaultQuery("format", "csv")
+	if format != "csv" && format != "json" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "format must be csv or json")
+		return
+	}
+	filter, err := parseUserFilter(c)
+	if err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+
+	// Fetch the first page before writing anything, so that a failure still gets a proper error response.
+	page, err := h.service(c).ListUsersPage(filter, 0, defaultPageSize)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error exporting users")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+
+	var export userExportWriter
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv")
+		export = newCSVUserExport(c.Writer)
+	} else {
+		c.Header("Content-Type", "application/json")
+		export = &jsonUserExport{w: c.Writer}
+	}
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="users.%s"`, format))
+	c.Status(http.StatusOK)
+
+	for first := 0; ; first += defaultPageSize {
+		if err := export.writeUsers(page); err != nil {
+			requestLogger(c).Error().Err(err).Msg("Error writing user export")
+			return
+		}
+		c.Writer.Flush()
+		if len(page) < defaultPageSize {
+			break
+		}
+		if page, err = h.service(c).ListUsersPage(filter, first+defaultPageSize, defaultPageSize); err != nil {
+			requestLogger(c).Error().Err(err).Int("first", first+defaultPageSize).Msg("Error exporting users, export truncated")
+			return
+		}
+	}
+	if err := export.close(); err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error writing user export")
+	}
+}
+
+// userExportWriter writes the users of an export in a given file format, page by page.
+type userExportWriter interface {
+	writeUsers(users []models.User) error
+	close() error
+}
+
+// csvUserExport writes users as CSV rows after a header row.
+type csvUserExport struct {
+	w *csv.Writer
+}
+
+func newCSVUserExport(w io.Writer) *csvUserExport {
+	writer := csv.NewWriter(w)
+	writer.Write([]string{"id", "username", "email", "firstName", "lastName", "enabled", "emailVerified"})
+	return &csvUserExport{w: writer}
+}
+
+func (e *csvUserExport) writeUsers(users []models.User) error {
+	for _, user := range users {
+		e.w.Write([]string{user.ID, user.Username, user.Email, user.FirstName, user.LastName,
+			formatOptionalBool(user.Enabled), formatOptionalBool(user.EmailVerified)})
+	}
+	e.w.Flush()
+	return e.w.Error()
+}
+
+func (e *csvUserExport) close() error {
+	return nil
+}
+
+// jsonUserExport writes users as the elements of a single JSON array.
+type jsonUserExport struct {
+	w       io.Writer
+	written int
+}
+
+func (e *jsonUserExport) writeUsers(users []models.User) error {
+	for _, user := range users {
+		separator := ","
+		if e.written == 0 {
+			separator = "["
+		}
+		data, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		if _, err := io.WriteString(e.w, separator+string(data)); err != nil {
+			return err
+		}
+		e.written++
+	}
+	return nil
+}
+
+func (e *jsonUserExport) close() error {
+	closing := "]"
+	if e.written == 0 {
+		closing = "[]"
+	}
+	_, err := io.WriteString(e.w, closing)
+	return err
+}
+
+// formatOptionalBool renders an optional boolean for CSV: "true", "false", or empty when unknown.
+func formatOptionalBool(b *bool) string {
+	if b == nil {
+		return ""
+	}
+	return strconv.FormatBool(*b)
+}
+
+// parseUserFilter reads the optional "enabled" and "emailVerified" boolean query parameters.
+func parseUserFilter(c *gin.Context) (services.UserFilter, error) {
+	var filter services.UserFilter
+	for name, field := range map[string]**bool{"enabled": &filter.Enabled, "emailVerified": &filter.EmailVerified} {
+		value, ok := c.GetQuery(name)
+		if !ok {
+			continue
+		}
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			return filter, fmt.Errorf("%s must be true or false", name)
+		}
+		*field = &parsed
+	}
+	return filter, nil
+}
+
+// parseBrief reads the optional "brief" boolean query parameter of user listings.
+func parseBrief(c *gin.Context) (bool, error) {
+	value, ok := c.GetQuery("brief")
+	if !ok {
+		return false, nil
+	}
+	brief, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("brief must be true or false")
+	}
+	return brief, nil
+}
+
+// CountUsers handles the HTTP GET request for the number of users in the realm.
+// Endpoint: GET /users/count
+//
+// Input: None.
+// Output: On success, returns HTTP 200 with {"count": <number of users>}.
+//
+//	On error, returns an error mapped by respondServiceError.
+func (h *UserHandler) CountUsers(c *gin.Context) {
+	count, err := h.service(c).CountUsers()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error counting users")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"count": count})
+}
+
 // CreateUser handles the HTTP POST request for creating a new user.
 // Endpoint: POST /users
 //
-// Input: A JSON body representing the user to be created (models.User).
+// Input: A JSON body representing the user to be created (models.User); username and a valid email are required.
 // Output: On success, returns HTTP 201 with the created user object.
 //
-//	On error (e.g., validation issues or internal errors), returns HTTP 400 or 500 with an error message.
+//	On error, returns HTTP 400 listing the invalid fields before Keycloak is called, or an error mapped by
+//	respondServiceError.
 func (h *UserHandler) CreateUser(c *gin.Context) {
 	var user models.User
 	// Bind the incoming JSON payload to the user model.
 	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		apierrors.Write(c, bindingError(err))
 		return
 	}
-	createdUser, err := h.keycloakService.CreateUser(user)
+	createdUser, err := h.service(c).CreateUser(user)
 	if err != nil {
-		log.Error().Err(err).Msg("Error creating user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error creating user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
 		return
 	}
 	c.JSON(http.StatusCreated, createdUser)
 }
 
+// CreateUsersBulk handles the HTTP POST request for creating several users at once.
+// Endpoint: POST /users/bulk
+//
+// Input: A JSON array of users to be created (models.User).
+// Output: HTTP 207 with a models.BulkUserResponse: one result per user (email, success flag, ID or error)
+//
+//	in submission order, plus created/failed counts. A failing user does not abort the batch: users that
+//	fail validation are reported with VALIDATION_FAILED and not sent to Keycloak.
+//	Returns HTTP 400 if the body is not a non-empty array.
+func (h *UserHandler) CreateUsersBulk(c *gin.Context) {
+	var users []models.User
+	// Decode without binding validation, which would reject the whole batch for a single invalid user.
+	if err := json.NewDecoder(c.Request.Body).Decode(&users); err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+	if len(users) == 0 {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "at least one user is required")
+		return
+	}
+
+	invalid := make([]error, len(users))
+	var valid []models.User
+	for i, user := range users {
+		if invalid[i] = binding.Validator.ValidateStruct(user); invalid[i] == nil {
+			valid = append(valid, user)
+		}
+	}
+	var created []*models.User
+	var errs []error
+	if len(valid) > 0 {
+		created, errs = h.service(c).CreateUsers(valid)
+	}
+
+	response := models.BulkUserResponse{Results: make([]models.BulkUserResult, len(users))}
+	// created and errs are aligned with valid: next is the position of the current user in it.
+	next := 0
+	for i, user := range users {
+		result := models.BulkUserResult{Email: user.Email}
+		if invalid[i] != nil {
+			result.Code, result.Error = apierrors.CodeValidationFailed, validationMessage(invalid[i])
+			response.Failed++
+		} else if errs[next] != nil {
+			requestLogger(c).Error().Err(errs[next]).Str("email", user.Email).Msg("Error creating user in bulk")
+			apiErr := toAPIError(errs[next], apierrors.CodeNotFound)
+			result.Code, result.Error = apiErr.Code, apiErr.Message
+			response.Failed++
+			next++
+		} else {
+			result.Success, result.ID = true, created[next].ID
+			response.Created++
+			next++
+		}
+		response.Results[i] = result
+	}
+	c.JSON(http.StatusMultiStatus, response)
+}
+
+// ImportUsers handles the HTTP POST request for importing users from an uploaded file.
+// Endpoint: POST /users/import?format=csv|json&dryRun=<bool>
+//
+// Input: A multipart form with the file in the "file" field: a CSV with a header row (the columns of
+// ExportUsers; username and email are required) or a JSON array of users. The format is taken from the
+// "format" query parameter, then the file extension, then the content. With dryRun=true the rows are
+// only validated.
+// Output: HTTP 207 with a models.ImportResult (HTTP 200 for a dry run). Rows that cannot be parsed or
+// validated and users Keycloak fails to create are reported with their line number; users that already
+// exist (same username or email) are counted as skipped. A bad row never aborts the import.
+//
+//	Returns HTTP 400 if the file is missing or cannot be read as a whole (e.g. no username column).
+func (h *UserHandler) ImportUsers(c *gin.Context) {
+	dryRun := false
+	if value := c.Query("dryRun"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "dryRun must be true or false")
+			return
+		}
+		dryRun = parsed
+	}
+	format := strings.ToLower(c.Query("format"))
+	if format != "" && format != "csv" && format != "json" {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "format must be csv or json")
+		return
+	}
+	header, err := c.FormFile("file")
+	if err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "a file must be uploaded in the \"file\" form field")
+		return
+	}
+	if format == "" {
+		switch strings.ToLower(filepath.Ext(header.Filename)) {
+		case ".csv":
+			format = "csv"
+		case ".json":
+			format = "json"
+		}
+	}
+	file, err := header.Open()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error opening uploaded user file")
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, "unable to read the uploaded file")
+		return
+	}
+	defer file.Close()
+	rows, err := parseImportFile(file, format)
+	if err != nil {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+		return
+	}
+
+	result := models.ImportResult{DryRun: dryRun, Rows: len(rows)}
+	var users []models.User
+	var lines []int
+	for _, row := range rows {
+		if row.err == nil {
+			row.err = validateImportUser(row.user)
+		}
+		if row.err != nil {
+			result.Failed++
+			result.Failures = append(result.Failures, models.ImportRowError{
+				Line: row.line, Username: row.user.Username, Code: apierrors.CodeValidationFailed, Error: row.err.Error(),
+			})
+			continue
+		}
+		users = append(users, row.user)
+		lines = append(lines, row.line)
+	}
+	result.Valid = len(users)
+	if dryRun {
+		c.JSON(http.StatusOK, result)
+		return
+	}
+
+	_, errs := h.service(c).CreateUsers(users)
+	for i, user := range users {
+		if errs[i] == nil {
+			result.Created++
+			continue
+		}
+		apiErr := toAPIError(errs[i], apierrors.CodeNotFound)
+		rowErr := models.ImportRowError{Line: lines[i], Username: user.Username, Code: apiErr.Code, Error: apiErr.Message}
+		if apiErr.Code == apierrors.CodeConflict {
+			result.Skipped++
+			result.SkippedRows = append(result.SkippedRows, rowErr)
+			continue
+		}
+		requestLogger(c).Error().Err(errs[i]).Str("username", user.Username).Int("line", lines[i]).Msg("Error importing user")
+		result.Failed++
+		result.Failures = append(result.Failures, rowErr)
+	}
+	// Keep failures in file order: validation failures were recorded before the creation ones.
+	sort.SliceStable(result.Failures, func(i, j int) bool { return result.Failures[i].Line < result.Failures[j].Line })
+	c.JSON(http.StatusMultiStatus, result)
+}
+
 // GetUser handles the HTTP GET request for retrieving a specific user by ID.
 // Endpoint: GET /users/:id
 //
@@ -73,32 +463,76 @@ func (h *UserHandler) CreateUser(c *gin.Context) {
 //	On error (e.g., user not found), returns HTTP 404 with an error message.
 func (h *UserHandler) GetUser(c *gin.Context) {
 	id := c.Param("id")
-	user, err := h.keycloakService.GetUser(id)
+	user, err := h.service(c).GetUser(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error fetching user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, user)
+}
+
+// GetUserByUsername handles the HTTP GET request for retrieving a user by exact username.
+// Endpoint: GET /users/by-username/:username
+//
+// Input: The username is provided as a URL path parameter.
+// Output: On success, returns HTTP 200 with the user object.
+//
+//	On error, returns HTTP 404 if no user has this username, HTTP 400 if several users match,
+//	or an error mapped by respondServiceError.
+func (h *UserHandler) GetUserByUsername(c *gin.Context) {
+	username := c.Param("username")
+	user, err := h.service(c).GetUserByUsername(username)
 	if err != nil {
-		log.Error().Err(err).Msg("Error fetching user")
-		c.JSON(http.StatusNotFound, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error fetching user by username")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, user)
 }
 
-// SearchUserByEmail handles the HTTP GET request to search for users by email.
-// Endpoint: GET /ms-user/v1/users/search?email=<email>
-// Input: Query parameter "email".
+// GetUserDetails handles the HTTP GET request for a consolidated view of a user.
+// Endpoint: GET /users/:id/full
+//
+// Input: The user ID is provided as a URL path parameter.
+// Output: On success, returns HTTP 200 with {user, groups, roles}. If the groups or the roles could not be
+// loaded, that section is null and the reason is given under "errors".
+//
+//	On error (e.g., user not found), returns an error mapped by respondServiceError.
+func (h *UserHandler) GetUserDetails(c *gin.Context) {
+	id := c.Param("id")
+	details, err := h.service(c).GetUserDetails(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error fetching user details")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, details)
+}
+
+// SearchUsers handles the HTTP GET request to search for users.
+// Endpoint: GET /ms-user/v1/users/search?email=<email>&username=<username>&firstName=<first>&lastName=<last>&search=<text>
+// Input: Any combination of the query parameters above; users must match all of them.
 // Output: On success, returns HTTP 200 with a JSON array of matching users.
 //
-//	On error, returns an appropriate HTTP status with an error message.
-func (h *UserHandler) SearchUserByEmail(c *gin.Context) {
-	email := c.Query("email")
-	if email == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "email query parameter is required"})
+//	On error, returns HTTP 400 if no search criteria are given, or an error mapped by respondServiceError.
+func (h *UserHandler) SearchUsers(c *gin.Context) {
+	params := map[string]string{}
+	for _, field := range services.UserSearchFields {
+		if value := c.Query(field); value != "" {
+			params[field] = value
+		}
+	}
+	if len(params) == 0 {
+		apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed,
+			"at least one of search, username, email, firstName or lastName is required")
 		return
 	}
 
-	users, err := h.keycloakService.SearchUserByEmail(email)
+	users, err := h.service(c).SearchUsers(params)
 	if err != nil {
-		log.Error().Err(err).Msg("Error searching user by email")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error searching users")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, users)
@@ -107,22 +541,24 @@ func (h *UserHandler) SearchUserByEmail(c *gin.Context) {
 // UpdateUser handles the HTTP PUT request for updating an existing user.
 // Endpoint: PUT /users/:id
 //
-// Input: The user ID is provided as a URL path parameter, and the request body contains the updated user data in JSON format.
+// Input: The user ID is provided as a URL path parameter, and the request body contains the fields to change
+// in JSON format (models.UserUpdate); absent fields are left unchanged.
 // Output: On success, returns HTTP 200 with the updated user object.
 //
-//	On error, returns HTTP 400 for invalid input or HTTP 500 for internal errors.
+//	On error, returns HTTP 400 listing the invalid fields, HTTP 409 if the user is managed by a read-only
+//	federation provider, or another error mapped by respondServiceError.
 func (h *UserHandler) UpdateUser(c *gin.Context) {
 	id := c.Param("id")
-	var user models.User
-	// Bind the JSON payload to the user model.
-	if err := c.ShouldBindJSON(&user); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+	var update models.UserUpdate
+	// Bind the JSON payload to the partial user model.
+	if err := c.ShouldBindJSON(&update); err != nil {
+		apierrors.Write(c, bindingError(err))
 		return
 	}
-	updatedUser, err := h.keycloakService.UpdateUser(id, user)
+	updatedUser, err := h.service(c).UpdateUser(id, update)
 	if err != nil {
-		log.Error().Err(err).Msg("Error updating user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error updating user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
 		return
 	}
 	c.JSON(http.StatusOK, updatedUser)
@@ -134,19 +570,332 @@ func (h *UserHandler) UpdateUser(c *gin.Context) {
 // Input: The user ID is provided as a URL path parameter.
 // Output: On success, returns HTTP 204 with no content.
 //
-//	On error, returns HTTP 500 with an error message.
+//	On error, returns HTTP 409 if the user is managed by a read-only federation provider,
+//	or another error mapped by respondServiceError.
 func (h *UserHandler) DeleteUser(c *gin.Context) {
 	id := c.Param("id")
-	err := h.keycloakService.DeleteUser(id)
+	err := h.service(c).DeleteUser(id)
 	if err != nil {
-		log.Error().Err(err).Msg("Error deleting user")
-		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		requestLogger(c).Error().Err(err).Msg("Error deleting user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// setEnabledRequest is the JSON body accepted by SetUserEnabled.
+// Enabled is a pointer so that a missing field can be told apart from false.
+type setEnabledRequest struct {
+	Enabled *bool `json:"enabled" binding:"required"`
+}
+
+// SetUserEnabled handles the HTTP PATCH request for enabling or disabling a user without deleting it.
+// Endpoint: PATCH /users/:id/enabled
+//
+// Input: The user ID is provided as a URL path parameter, and the request body contains {"enabled": true|false}.
+// Output: On success, returns HTTP 204 with no content.
+//
+//	On error, returns HTTP 400 for invalid input, HTTP 409 if the user is managed by a read-only
+//	federation provider, or another error mapped by respondServiceError.
+func (h *UserHandler) SetUserEnabled(c *gin.Context) {
+	id := c.Param("id")
+	var body setEnabledRequest
+	// Bind the JSON payload to the enabled request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	err := h.service(c).SetUserEnabled(id, *body.Enabled)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error setting user enabled state")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// updateAttributesRequest is the JSON body accepted by UpdateUserAttributes.
+type updateAttributesRequest struct {
+	Attributes map[string][]string `json:"attributes" binding:"required"`
+}
+
+// UpdateUserAttributes handles the HTTP PATCH request for setting custom attributes on a user.
+// Endpoint: PATCH /users/:id/attributes
+//
+// Input: The user ID as a URL path parameter and a JSON body {"attributes": {"department": ["sales"]}}.
+// The given attributes are merged with the existing ones; an attribute given with an empty list is removed.
+// Output: On success, returns HTTP 200 with {"attributes": ...} holding all of the user's attributes.
+//
+//	On error, returns HTTP 400 for an invalid body or an error mapped by respondServiceError.
+func (h *UserHandler) UpdateUserAttributes(c *gin.Context) {
+	id := c.Param("id")
+	var body updateAttributesRequest
+	// Bind the JSON payload to the attributes request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	attrs, err := h.service(c).UpdateUserAttributes(id, body.Attributes)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error updating user attributes")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, updateAttributesRequest{Attributes: attrs})
+}
+
+// resetPasswordRequest is the JSON body accepted by ResetPassword.
+type resetPasswordRequest struct {
+	Password  string `json:"password" binding:"required"`
+	Temporary bool   `json:"temporary"`
+}
+
+// ResetPassword handles the HTTP PUT request for setting a new password for a user.
+// Endpoint: PUT /users/:id/reset-password
+//
+// Input: The user ID is provided as a URL path parameter, and the request body contains
+// the new password and a "temporary" flag in JSON format.
+// Output: On success, returns HTTP 204 with no content.
+//
+//	On error, returns HTTP 400 for invalid input or a password policy violation, HTTP 409 if the user's
+//	credentials are managed by a federation provider, or another error mapped by respondServiceError.
+func (h *UserHandler) ResetPassword(c *gin.Context) {
+	id := c.Param("id")
+	var body resetPasswordRequest
+	// Bind the JSON payload to the reset password request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	err := h.service(c).ResetPassword(id, body.Password, body.Temporary)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error resetting user password")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// ListPasskeys handles the HTTP GET request for listing a user's WebAuthn (passkey) credentials.
+// Endpoint: GET /users/:id/passkeys
+//
+// Input: The user ID is provided as a URL path parameter.
+// Output: On success, returns HTTP 200 with a JSON array of credential metadata (id, type, userLabel, createdDate).
+//
+//	No key material is included. On error, returns an error mapped by respondServiceError.
+func (h *UserHandler) ListPasskeys(c *gin.Context) {
+	id := c.Param("id")
+	passkeys, err := h.service(c).ListPasskeys(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing user passkeys")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, passkeys)
+}
+
+// RemovePasskey handles the HTTP DELETE request for removing a user's WebAuthn (passkey) credential.
+// Endpoint: DELETE /users/:id/passkeys/:credentialId
+//
+// Input: The user ID and credential ID are provided as URL path parameters.
+// Output: On success, returns HTTP 204 with no content.
+//
+//	On error, returns HTTP 404 if the user has no such passkey, or another error mapped by respondServiceError.
+func (h *UserHandler) RemovePasskey(c *gin.Context) {
+	id := c.Param("id")
+	credentialID := c.Param("credentialId")
+	err := h.service(c).RemovePasskey(id, credentialID)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error removing user passkey")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// ListRequiredActions handles the HTTP GET request for listing the required actions enabled in the realm.
+// Endpoint: GET /required-actions
+//
+// Output: On success, returns HTTP 200 with a JSON array of action aliases (e.g. "VERIFY_EMAIL"),
+//
+//	the values accepted by ExecuteActionsEmail. On error, returns an error mapped by respondServiceError.
+func (h *UserHandler) ListRequiredActions(c *gin.Context) {
+	actions, err := h.service(c).ListRequiredActions()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing required actions")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, actions)
+}
+
+// ListUserSessions handles the HTTP GET request for listing a user's active sessions.
+// Endpoint: GET /users/:id/sessions
+//
+// Input: The user ID is provided as a URL path parameter.
+// Output: On success, returns HTTP 200 with a JSON array of sessions (id, ipAddress, start, lastAccess).
+//
+//	On error, returns an error mapped by respondServiceError.
+func (h *UserHandler) ListUserSessions(c *gin.Context) {
+	id := c.Param("id")
+	sessions, err := h.service(c).ListUserSessions(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing user sessions")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusOK, sessions)
+}
+
+// LogoutUser handles the HTTP POST request for ending all of a user's sessions.
+// Endpoint: POST /users/:id/logout
+//
+// Input: The user ID is provided as a URL path parameter.
+// Output: On success, returns HTTP 204 with no content, also when the user had no session.
+//
+//	On error, returns an error mapped by respondServiceError.
+func (h *UserHandler) LogoutUser(c *gin.Context) {
+	id := c.Param("id")
+	if err := h.service(c).LogoutUser(id); err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error logging out user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// ImpersonateUser handles the HTTP POST request for opening a session on behalf of a user.
+// Endpoint: POST /users/:id/impersonate
+//
+// Input: The user ID is provided as a URL path parameter. The route is restricted to the impersonator role.
+// Output: On success, returns HTTP 200 with the redirect URL and the session cookies (see models.ImpersonationResult).
+//
+//	On error, returns HTTP 403 IMPERSONATION_DISABLED when the feature is disabled in Keycloak,
+//	HTTP 403 FORBIDDEN when Keycloak refuses to impersonate the user, or an error mapped by respondServiceError.
+func (h *UserHandler) ImpersonateUser(c *gin.Context) {
+	id := c.Param("id")
+	result, err := h.service(c).ImpersonateUser(id)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Str("userId", id).Msg("Error impersonating user")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	// Impersonation grants the caller the user's access: keep an audit trail of every session opened.
+	requestLogger(c).Warn().Str("userId", id).Str("clientIp", c.ClientIP()).Msg("Impersonation session opened")
+	c.JSON(http.StatusOK, result)
+}
+
+// executeActionsRequest is the optional JSON body accepted by ExecuteActionsEmail.
+type executeActionsRequest struct {
+	Actions []string `json:"actions"`
+}
+
+// defaultEmailActions are the actions ExecuteActionsEmail requests when the body names none.
+var defaultEmailActions = []string{"VERIFY_EMAIL"}
+
+// ExecuteActionsEmail handles the HTTP PUT request for emailing a user a link to perform required actions,
+// e.g. to verify their address and set a password after onboarding.
+// Endpoint: PUT /users/:id/send-actions-email (also PUT /users/:id/execute-actions-email)
+//
+// Input: The user ID is provided as a URL path parameter, and an optional body {"actions": [...]};
+// without actions, ["VERIFY_EMAIL"] is sent.
+// Output: On success, returns HTTP 204 with no content.
+//
+//	On error, returns HTTP 400 if an action is not enabled in the realm (details list the invalid and
+//	valid actions), HTTP 502 EMAIL_NOT_SENT if Keycloak could not send the email, or an error mapped
+//	by respondServiceError.
+func (h *UserHandler) ExecuteActionsEmail(c *gin.Context) {
+	var body executeActionsRequest
+	// The body is optional: only reject one that is present but malformed.
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&body); err != nil && !errors.Is(err, io.EOF) {
+			apierrors.Write(c, bindingError(err))
+			return
+		}
+	}
+	actions := body.Actions
+	if len(actions) == 0 {
+		actions = defaultEmailActions
+	}
+
+	// Validate the actions up front: Keycloak accepts unknown aliases and sends a useless email.
+	if !h.validateRequiredActions(c, actions) {
+		return
+	}
+
+	err := h.service(c).ExecuteActionsEmail(c.Param("id"), actions)
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error sending execute actions email")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
+		return
+	}
+	c.JSON(http.StatusNoContent, nil)
+}
+
+// validateRequiredActions checks that every action is enabled in the realm. Otherwise it writes a
+// 400 response listing the invalid and valid actions (or the error of the lookup) and returns false.
+func (h *UserHandler) validateRequiredActions(c *gin.Context, actions []string) bool {
+	valid, err := h.service(c).ListRequiredActions()
+	if err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error listing required actions")
+		respondServiceError(c, err, apierrors.CodeNotFound)
+		return false
+	}
+	enabled := make(map[string]bool, len(valid))
+	for _, alias := range valid {
+		enabled[alias] = true
+	}
+	var invalid []string
+	for _, action := range actions {
+		if !enabled[action] {
+			invalid = append(invalid, action)
+		}
+	}
+	if len(invalid) > 0 {
+		apierrors.Write(c, apierrors.New(http.StatusBadRequest, apierrors.CodeValidationFailed, "unknown or disabled required actions").
+			WithDetails(gin.H{"invalidActions": invalid, "validActions": valid}))
+		return false
+	}
+	return true
+}
+
+// requiredActionsRequest is the JSON body accepted by SetRequiredActions. The list is required but may be
+// empty, to clear the pending actions.
+type requiredActionsRequest struct {
+	Actions []string `json:"actions" binding:"required"`
+}
+
+// SetRequiredActions handles the HTTP PUT request for setting the actions a user must perform at the
+// next login, without sending an email.
+// Endpoint: PUT /users/:id/required-actions
+//
+// Input: The user ID is provided as a URL path parameter, and the request body contains {"actions": [...]};
+// the list replaces the user's pending actions and may be empty to clear them.
+// Output: On success, returns HTTP 204 with no content.
+//
+//	On error, returns HTTP 400 for a missing list or an action that is not enabled in the realm (details
+//	list the invalid and valid actions), or an error mapped by respondServiceError.
+func (h *UserHandler) SetRequiredActions(c *gin.Context) {
+	var body requiredActionsRequest
+	// Bind the JSON payload to the required actions request.
+	if err := c.ShouldBindJSON(&body); err != nil {
+		apierrors.Write(c, bindingError(err))
+		return
+	}
+	if len(body.Actions) > 0 && !h.validateRequiredActions(c, body.Actions) {
+		return
+	}
+	id := c.Param("id")
+	if err := h.service(c).SetRequiredActions(id, body.Actions); err != nil {
+		requestLogger(c).Error().Err(err).Msg("Error setting required actions")
+		respondServiceError(c, err, apierrors.CodeUserNotFound)
 		return
 	}
 	c.JSON(http.StatusNoContent, nil)
 }
 
-// SetKeycloakService overrides the underlying KeycloakService (useful for testing).
-func (h *UserHandler) SetKeycloakService(svc *services.KeycloakService) {
+// SetKeycloakService overrides the underlying service, e.g. with a *services.KeycloakService
+// pointed at a test server or a hand-written mock (useful for testing).
+func (h *UserHandler) SetKeycloakService(svc services.UserProvider) {
 	h.keycloakService = svc
 }
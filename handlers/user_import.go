@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"ms-user/models"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+)
+
+// importRow is one record of an uploaded user file: the parsed user, or the reason it could not be parsed.
+type importRow struct {
+	line int
+	user models.User
+	err  error
+}
+
+// importColumns are the CSV columns understood by the user import; the export's "id" column is accepted and ignored.
+var importColumns = map[string]bool{
+	"id": true, "username": true, "email": true, "firstName": true, "lastName": true, "enabled": true, "emailVerified": true,
+}
+
+// parseImportFile parses an uploaded user file as CSV or JSON. format is "csv", "json" or empty to detect
+// it from the content (a JSON array starts with "["). A problem with a single record is reported on its
+// row; only a file that cannot be read as a whole (e.g. a CSV without a username column) returns an error.
+func parseImportFile(r io.Reader, format string) ([]importRow, error) {
+	buffered := bufio.NewReader(r)
+	if format == "" {
+		format = "csv"
+		for {
+			b, err := buffered.ReadByte()
+			if err != nil {
+				break
+			}
+			if b == ' ' || b == '\t' || b == '\r' || b == '\n' {
+				continue
+			}
+			if b == '[' {
+				format = "json"
+			}
+			buffered.UnreadByte()
+			break
+		}
+	}
+	if format == "json" {
+		return parseImportJSON(buffered)
+	}
+	return parseImportCSV(buffered)
+}
+
+// parseImportCSV parses a CSV file whose header row names the columns (see importColumns).
+func parseImportCSV(r io.Reader) ([]importRow, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = -1
+	header, err := reader.Read()
+	if err != nil {
+		return nil, fmt.Errorf("unable to read the CSV header: %v", err)
+	}
+	columns := map[string]int{}
+	for i, name := range header {
+		name = strings.TrimSpace(strings.TrimPrefix(name, "\ufeff"))
+		if !importColumns[name] {
+			return nil, fmt.Errorf("unknown CSV column %q", name)
+		}
+		columns[name] = i
+	}
+	for _, required := range []string{"username", "email"} {
+		if _, ok := columns[required]; !ok {
+			return nil, fmt.Errorf("the CSV header must include a %s column", required)
+		}
+	}
+
+	var rows []importRow
+	for {
+		record, err := reader.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		var parseErr *csv.ParseError
+		if errors.As(err, &parseErr) {
+			rows = append(rows, importRow{line: parseErr.StartLine, err: parseErr.Err})
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		line, _ := reader.FieldPos(0)
+		if len(record) != len(header) {
+			rows = append(rows, importRow{line: line, err: fmt.Errorf("expected %d fields, got %d", len(header), len(record))})
+			continue
+		}
+		row := importRow{line: line}
+		field := func(name string) string {
+			if i, ok := columns[name]; ok {
+				return strings.TrimSpace(record[i])
+			}
+			return ""
+		}
+		row.user = models.User{
+			Username:  field("username"),
+			Email:     field("email"),
+			FirstName: field("firstName"),
+			LastName:  field("lastName"),
+		}
+		for name, target := range map[string]**bool{"enabled": &row.user.Enabled, "emailVerified": &row.user.EmailVerified} {
+			if value := field(name); value != "" {
+				parsed, err := strconv.ParseBool(value)
+				if err != nil {
+					row.err = fmt.Errorf("%s must be true or false", name)
+					break
+				}
+				*target = &parsed
+			}
+		}
+		rows = append(rows, row)
+	}
+}
+
+// parseImportJSON parses a JSON array of users.
+func parseImportJSON(r io.Reader) ([]importRow, error) {
+	var elements []json.RawMessage
+	if err := json.NewDecoder(r).Decode(&elements); err != nil {
+		return nil, fmt.Errorf("the file must hold a JSON array of users: %v", err)
+	}
+	rows := make([]importRow, len(elements))
+	for i, element := range elements {
+		rows[i].line = i + 1
+		decoder := json.NewDecoder(bytes.NewReader(element))
+		decoder.DisallowUnknownFields()
+		if err := decoder.Decode(&rows[i].user); err != nil {
+			rows[i].err = err
+		}
+		rows[i].user.ID = ""
+	}
+	return rows, nil
+}
+
+// validateImportUser applies the binding rules of models.User, so invalid rows are reported with the
+// same message as POST /users instead of an opaque Keycloak error.
+func validateImportUser(user models.User) error {
+	if err := binding.Validator.ValidateStruct(user); err != nil {
+		return errors.New(validationMessage(err))
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"errors"
+	"fmt"
+	"ms-user/apierrors"
+	"net/http"
+	"reflect"
+	"strings"
+
+	"github.com/gin-gonic/gin/binding"
+	"github.com/go-playground/validator/v10"
+)
+
+func init() {
+	// Report invalid fields by their JSON name (e.g. "firstName") rather than the Go field name.
+	if v, ok := binding.Validator.Engine().(*validator.Validate); ok {
+		v.RegisterTagNameFunc(func(field reflect.StructField) string {
+			name := strings.SplitN(field.Tag.Get("json"), ",", 2)[0]
+			if name == "-" {
+				return ""
+			}
+			if name == "" {
+				return field.Name
+			}
+			return name
+		})
+	}
+}
+
+// fieldError describes a request body field that failed validation.
+type fieldError struct {
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+// bindingError maps an error returned by ShouldBindJSON to a 400 VALIDATION_FAILED error. When binding
+// tags were violated, the message names every invalid field and the details list them with the reason;
+// other errors (e.g. malformed JSON) keep their own message.
+func bindingError(err error) *apierrors.APIError {
+	fields := invalidFields(err)
+	if fields == nil {
+		return apierrors.New(http.StatusBadRequest, apierrors.CodeValidationFailed, err.Error())
+	}
+	return apierrors.New(http.StatusBadRequest, apierrors.CodeValidationFailed, validationMessage(err)).WithDetails(fields)
+}
+
+// validationMessage summarizes a validation error in one line, e.g.
+// "invalid fields: email must be a valid email address; username is required".
+func validationMessage(err error) string {
+	fields := invalidFields(err)
+	if fields == nil {
+		return err.Error()
+	}
+	messages := make([]string, len(fields))
+	for i, field := range fields {
+		messages[i] = field.Field + " " + field.Message
+	}
+	return "invalid fields: " + strings.Join(messages, "; ")
+}
+
+// invalidFields returns the fields rejected by the binding validator, or nil if err is not a validation error.
+func invalidFields(err error) []fieldError {
+	var validationErrs validator.ValidationErrors
+	if !errors.As(err, &validationErrs) {
+		return nil
+	}
+	fields := make([]fieldError, len(validationErrs))
+	for i, fe := range validationErrs {
+		fields[i] = fieldError{Field: fe.Field(), Message: ruleMessage(fe)}
+	}
+	return fields
+}
+
+// ruleMessage describes the binding rule a field violated.
+func ruleMessage(fe validator.FieldError) string {
+	switch fe.Tag() {
+	case "required":
+		return "is required"
+	case "email":
+		return "must be a valid email address"
+	case "min":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at least %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must contain at least %s element(s)", fe.Param())
+	case "max":
+		if fe.Kind() == reflect.String {
+			return fmt.Sprintf("must be at most %s characters long", fe.Param())
+		}
+		return fmt.Sprintf("must contain at most %s element(s)", fe.Param())
+	}
+	return fmt.Sprintf("failed the %q rule", fe.Tag())
+}
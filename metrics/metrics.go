@@ -0,0 +1,101 @@
+package metrics
+
+import (
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Metrics are registered with the default Prometheus registry, which also exposes the standard
+// Go runtime and process collectors.
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ms_user_http_requests_total",
+		Help: "HTTP requests handled, by operation and response status.",
+	}, []string{"operation", "status"})
+
+	httpErrors = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ms_user_http_errors_total",
+		Help: "HTTP requests answered with a 4xx or 5xx status, by operation and response status.",
+	}, []string{"operation", "status"})
+
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ms_user_http_request_duration_seconds",
+		Help:    "Time spent handling HTTP requests, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+
+	keycloakRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "ms_user_keycloak_requests_total",
+		Help: "Requests sent to Keycloak, by operation and Keycloak response status (\"error\" if none was received).",
+	}, []string{"operation", "status"})
+
+	keycloakDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "ms_user_keycloak_request_duration_seconds",
+		Help:    "Time spent waiting for Keycloak, by operation.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"operation"})
+)
+
+// Handler returns the HTTP handler serving all metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.Handler()
+}
+
+// ObserveHTTPRequest records a handled HTTP request.
+func ObserveHTTPRequest(operation string, status int, duration time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequests.WithLabelValues(operation, code).Inc()
+	if status >= http.StatusBadRequest {
+		httpErrors.WithLabelValues(operation, code).Inc()
+	}
+	httpDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// ObserveKeycloakRequest records a request sent to Keycloak. status is 0 when no response was received.
+func ObserveKeycloakRequest(method, path string, status int, duration time.Duration) {
+	operation := KeycloakOperation(method, path)
+	code := "error"
+	if status != 0 {
+		code = strconv.Itoa(status)
+	}
+	keycloakRequests.WithLabelValues(operation, code).Inc()
+	keycloakDuration.WithLabelValues(operation).Observe(duration.Seconds())
+}
+
+// idSegmentParents lists the Keycloak path segments whose next segment is an identifier
+// (user/group/credential/component ID or role name) rather than a fixed keyword.
+var idSegmentParents = map[string]bool{
+	"users":        true,
+	"groups":       true,
+	"roles":        true,
+	"credentials":  true,
+	"user-storage": true,
+}
+
+// fixedSegments are keywords that may follow an entry of idSegmentParents without being an identifier.
+var fixedSegments = map[string]bool{
+	"count": true,
+}
+
+var realmPrefix = regexp.MustCompile(`^(/admin)?/realms/[^/]+`)
+
+// KeycloakOperation turns a Keycloak Admin API request into a low-cardinality operation label by
+// dropping the realm prefix and replacing identifiers with placeholders,
+// e.g. "PUT /admin/realms/master/users/42/groups/7" becomes "PUT /users/{id}/groups/{id}".
+func KeycloakOperation(method, path string) string {
+	path = realmPrefix.ReplaceAllString(path, "")
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i := 1; i < len(segments); i++ {
+		if idSegmentParents[segments[i-1]] && !fixedSegments[segments[i]] {
+			segments[i] = "{id}"
+		}
+	}
+	return method + " /" + strings.Join(segments, "/")
+}
@@ -1,23 +1,103 @@
 package middleware
 
 import (
+	"ms-user/apierrors"
+	"ms-user/config"
 	"net/http"
 	"strings"
 
 	"github.com/gin-gonic/gin"
 )
 
-func AuthMiddleware() gin.HandlerFunc {
+// RoleKey is the gin context key under which AuthMiddleware stores the caller's role.
+const RoleKey = "role"
+
+// CallerTokenHeader is the request header carrying the caller's own Keycloak access token.
+const CallerTokenHeader = "X-Keycloak-Token"
+
+// CallerTokenKey is the gin context key under which AuthMiddleware stores the caller's Keycloak access token.
+const CallerTokenKey = "callerToken"
+
+// Roles assigned to authenticated callers.
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+	// RoleImpersonator is required by the impersonation endpoint; only the impersonation token grants it.
+	RoleImpersonator = "impersonator"
+)
+
+// AuthMiddleware authenticates requests using a static bearer token and records the caller's role.
+// Requests whose path falls under one of cfg.PublicPaths skip authentication entirely.
+// When cfg.CallerTokens is set, the X-Keycloak-Token header of an authenticated request is stored
+// under CallerTokenKey; Keycloak itself validates that token when the handlers forward it.
+func AuthMiddleware(cfg *config.Config) gin.HandlerFunc {
 	return func(c *gin.Context) {
+		if isPublicPath(c.Request.URL.Path, cfg.PublicPaths) {
+			c.Next()
+			return
+		}
 		authHeader := c.GetHeader("Authorization")
 		if authHeader == "" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing Authorization header"})
+			apierrors.Respond(c, http.StatusUnauthorized, apierrors.CodeUnauthorized, "Missing Authorization header")
 			return
 		}
-		// Simple authentication: expecting "Bearer secret-token"
+		// Simple authentication: expecting "Bearer <AuthToken>", "Bearer <AdminToken>" or "Bearer <ImpersonationToken>"
 		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" || parts[1] != "secret-token" {
-			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token"})
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			apierrors.Respond(c, http.StatusUnauthorized, apierrors.CodeUnauthorized, "Invalid token")
+			return
+		}
+		switch {
+		case cfg.AdminToken != "" && parts[1] == cfg.AdminToken:
+			c.Set(RoleKey, RoleAdmin)
+		case cfg.ImpersonationToken != "" && parts[1] == cfg.ImpersonationToken:
+			c.Set(RoleKey, RoleImpersonator)
+		case parts[1] == cfg.AuthToken:
+			c.Set(RoleKey, RoleUser)
+		default:
+			apierrors.Respond(c, http.StatusUnauthorized, apierrors.CodeUnauthorized, "Invalid token")
+			return
+		}
+		if token := c.GetHeader(CallerTokenHeader); cfg.CallerTokens && token != "" {
+			c.Set(CallerTokenKey, strings.TrimPrefix(token, "Bearer "))
+		}
+		c.Next()
+	}
+}
+
+// isPublicPath reports whether path equals one of the public prefixes or lies beneath it
+// (e.g. "/metrics" matches "/metrics" and "/metrics/foo" but not "/metricsfoo").
+func isPublicPath(path string, publicPaths []string) bool {
+	for _, prefix := range publicPaths {
+		prefix = strings.TrimSuffix(prefix, "/")
+		if prefix == "" {
+			continue
+		}
+		if path == prefix || strings.HasPrefix(path, prefix+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// AdminMiddleware only lets through callers that AuthMiddleware authenticated with the admin token.
+// It must be registered after AuthMiddleware.
+func AdminMiddleware() gin.HandlerFunc {
+	return RoleMiddleware(RoleAdmin, "Admin privileges required")
+}
+
+// ImpersonatorMiddleware only lets through callers that AuthMiddleware authenticated with the
+// impersonation token. It must be registered after AuthMiddleware.
+func ImpersonatorMiddleware() gin.HandlerFunc {
+	return RoleMiddleware(RoleImpersonator, "Impersonation privileges required")
+}
+
+// RoleMiddleware only lets through callers that AuthMiddleware assigned the given role, answering
+// 403 FORBIDDEN with message to everyone else. It must be registered after AuthMiddleware.
+func RoleMiddleware(role, message string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if c.GetString(RoleKey) != role {
+			apierrors.Respond(c, http.StatusForbidden, apierrors.CodeForbidden, message)
 			return
 		}
 		c.Next()
@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"ms-user/apierrors"
+	"ms-user/config"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// CORS response header values. Exposed headers are the custom response headers clients may need to read.
+const (
+	corsAllowMethods  = "GET, POST, PUT, PATCH, DELETE, OPTIONS"
+	corsAllowHeaders  = "Authorization, Content-Type, " + RequestIDHeader + ", " + RealmHeader + ", " + CallerTokenHeader
+	corsExposeHeaders = "Link, Retry-After, X-Total-Count, X-Listing-Incomplete, " + RequestIDHeader
+	corsMaxAge        = 10 * time.Minute
+)
+
+// CORSMiddleware lets browsers on cfg.CORSAllowedOrigins call the API.
+// Preflight requests (OPTIONS with Access-Control-Request-Method) are answered directly with 204, or
+// 403 for an origin that is not allowed, so it must be registered before AuthMiddleware: browsers
+// never send the Authorization header on preflight. Other requests from an allowed origin get the
+// origin echoed in Access-Control-Allow-Origin. Requests without an Origin header are not affected.
+func CORSMiddleware(cfg *config.Config) gin.HandlerFunc {
+	allowAny := false
+	allowed := make(map[string]bool, len(cfg.CORSAllowedOrigins))
+	for _, origin := range cfg.CORSAllowedOrigins {
+		if origin == "*" {
+			allowAny = true
+		}
+		allowed[strings.TrimSuffix(origin, "/")] = true
+	}
+
+	return func(c *gin.Context) {
+		origin := c.GetHeader("Origin")
+		if origin == "" || len(allowed) == 0 {
+			c.Next()
+			return
+		}
+		// The response depends on the Origin header, so caches must key on it.
+		c.Writer.Header().Add("Vary", "Origin")
+		isAllowed := allowAny || allowed[origin]
+		preflight := c.Request.Method == http.MethodOptions && c.GetHeader("Access-Control-Request-Method") != ""
+
+		if !isAllowed {
+			if preflight {
+				apierrors.Respond(c, http.StatusForbidden, apierrors.CodeForbidden, "origin not allowed")
+				return
+			}
+			c.Next()
+			return
+		}
+
+		c.Header("Access-Control-Allow-Origin", origin)
+		if preflight {
+			c.Header("Access-Control-Allow-Methods", corsAllowMethods)
+			c.Header("Access-Control-Allow-Headers", corsAllowHeaders)
+			c.Header("Access-Control-Max-Age", strconv.Itoa(int(corsMaxAge.Seconds())))
+			c.AbortWithStatus(http.StatusNoContent)
+			return
+		}
+		c.Header("Access-Control-Expose-Headers", corsExposeHeaders)
+		c.Next()
+	}
+}
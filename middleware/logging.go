@@ -1,22 +1,82 @@
 package middleware
 
 import (
+	"ms-user/apierrors"
+	"net/http"
+	"runtime/debug"
 	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/rs/zerolog/log"
+	"github.com/rs/zerolog"
 )
 
+// LoggingMiddleware logs each request once it has been handled, with its method, path, matched route,
+// status, latency, client IP and response size. 5xx responses are logged at error level, 4xx at warn
+// and the rest at info. Installed after RequestIDMiddleware, the entry carries the request ID. A request
+// whose handling panicked is logged with status 500, the response RecoveryMiddleware gives it.
 func LoggingMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		start := time.Now()
+		completed := false
+		defer func() {
+			logRequest(c, responseStatus(c, completed), time.Since(start))
+		}()
+		c.Next()
+		completed = true
+	}
+}
+
+// responseStatus returns the status of the response to c, or 500 when completed is false because the
+// handling panicked: the panic is still unwinding towards RecoveryMiddleware, which answers 500.
+func responseStatus(c *gin.Context, completed bool) int {
+	if !completed {
+		return http.StatusInternalServerError
+	}
+	return c.Writer.Status()
+}
+
+// logRequest writes the "Handled request" entry of LoggingMiddleware.
+func logRequest(c *gin.Context, status int, duration time.Duration) {
+	logger := RequestLogger(c)
+	var event *zerolog.Event
+	switch {
+	case status >= http.StatusInternalServerError:
+		event = logger.Error()
+	case status >= http.StatusBadRequest:
+		event = logger.Warn()
+	default:
+		event = logger.Info()
+	}
+	event.
+		Str("method", c.Request.Method).
+		Str("path", c.Request.URL.Path).
+		Str("route", c.FullPath()).
+		Int("status", status).
+		Float64("latency_ms", float64(duration.Microseconds())/1000).
+		Str("client_ip", c.ClientIP()).
+		Int("bytes", c.Writer.Size()).
+		Msg("Handled request")
+}
+
+// RecoveryMiddleware recovers from panics in later handlers, logs the panic with its stack trace and
+// answers 500 INTERNAL_ERROR, so a bug fails one request instead of dropping the connection. Install it
+// first so that it also catches panics in the other middleware; LoggingMiddleware and MetricsMiddleware
+// still record such requests, with status 500.
+func RecoveryMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		defer func() {
+			if recovered := recover(); recovered != nil {
+				RequestLogger(c).Error().
+					Interface("panic", recovered).
+					Bytes("stack", debug.Stack()).
+					Msg("Recovered from panic")
+				if c.Writer.Written() {
+					c.Abort()
+					return
+				}
+				apierrors.Respond(c, http.StatusInternalServerError, apierrors.CodeInternal, "internal server error")
+			}
+		}()
 		c.Next()
-		duration := time.Since(start)
-		log.Info().
-			Str("method", c.Request.Method).
-			Str("path", c.Request.URL.Path).
-			Int("status", c.Writer.Status()).
-			Dur("duration", duration).
-			Msg("Handled request")
 	}
 }
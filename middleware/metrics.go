@@ -0,0 +1,56 @@
+package middleware
+
+import (
+	"ms-user/metrics"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/gin-gonic/gin"
+)
+
+// MetricsMiddleware records the count, status and latency of every request, labeled by operation.
+// The operation is the snake_cased name of the route's handler method (e.g. UserHandler.ListUsers
+// becomes "list_users"); requests matching no route are labeled "unmatched". A request whose handling
+// panicked is recorded with status 500.
+func MetricsMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		start := time.Now()
+		completed := false
+		defer func() {
+			metrics.ObserveHTTPRequest(operationName(c), responseStatus(c, completed), time.Since(start))
+		}()
+		c.Next()
+		completed = true
+	}
+}
+
+// operationName derives a low-cardinality operation label for the current request.
+func operationName(c *gin.Context) string {
+	if c.FullPath() == "" {
+		return "unmatched"
+	}
+	// Method values are named like "ms-user/handlers.(*UserHandler).ListUsers-fm".
+	name := strings.TrimSuffix(c.HandlerName(), "-fm")
+	name = name[strings.LastIndex(name, ".")+1:]
+	if name == "" || strings.HasPrefix(name, "func") {
+		// Anonymous handlers (e.g. wrapped http.Handlers) have no meaningful name.
+		return c.Request.Method + " " + c.FullPath()
+	}
+	return toSnakeCase(name)
+}
+
+// toSnakeCase converts a Go identifier such as "AddUserToGroupByEmail" to "add_user_to_group_by_email".
+func toSnakeCase(name string) string {
+	var b strings.Builder
+	for i, r := range name {
+		if unicode.IsUpper(r) {
+			if i > 0 {
+				b.WriteByte('_')
+			}
+			r = unicode.ToLower(r)
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
@@ -0,0 +1,87 @@
+package middleware
+
+import (
+	"math"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/time/rate"
+)
+
+// maxRateLimitClients bounds the number of per-client buckets kept at once. Past it, new clients share
+// one overflow bucket until idle clients are dropped, so that many client IPs cannot exhaust memory.
+const maxRateLimitClients = 10000
+
+// clientLimiter is the token bucket of one client IP.
+type clientLimiter struct {
+	limiter  *rate.Limiter
+	lastSeen time.Time
+}
+
+// RateLimitMiddleware limits the request rate with a token bucket refilled at cfg.RateLimitRPS tokens
+// per second and holding up to cfg.RateLimitBurst tokens. With cfg.RateLimitPerClient each client IP
+// has its own bucket, otherwise all requests share one. A request finding the bucket empty gets 429
+// RATE_LIMITED with a Retry-After header (in seconds) and never reaches Keycloak.
+// The client IP is gin's ClientIP, which only honours X-Forwarded-For from the router's trusted proxies
+// (see config.Config.TrustedProxies). The middleware does nothing when cfg.RateLimitRPS is 0.
+func RateLimitMiddleware(cfg *config.Config) gin.HandlerFunc {
+	if cfg.RateLimitRPS <= 0 {
+		return func(c *gin.Context) { c.Next() }
+	}
+	limit, burst := rate.Limit(cfg.RateLimitRPS), cfg.RateLimitBurst
+	global := rate.NewLimiter(limit, burst)
+	overflow := rate.NewLimiter(limit, burst)
+	// A client idle for the time its bucket takes to refill has a full bucket again, so dropping its
+	// limiter changes nothing.
+	idleTTL := time.Duration(float64(burst) / cfg.RateLimitRPS * float64(time.Second))
+
+	var mu sync.Mutex
+	clients := map[string]*clientLimiter{}
+	lastSweep := time.Now()
+	// limiterFor returns the bucket of the given client IP, dropping the buckets of idle clients at most
+	// once per idleTTL, or at once when the map is full, so that it does not grow without bound.
+	limiterFor := func(ip string, now time.Time) *rate.Limiter {
+		mu.Lock()
+		defer mu.Unlock()
+		client, ok := clients[ip]
+		if !ok && (now.Sub(lastSweep) > idleTTL || len(clients) >= maxRateLimitClients) {
+			for key, idle := range clients {
+				if now.Sub(idle.lastSeen) > idleTTL {
+					delete(clients, key)
+				}
+			}
+			lastSweep = now
+		}
+		if !ok {
+			if len(clients) >= maxRateLimitClients {
+				return overflow
+			}
+			client = &clientLimiter{limiter: rate.NewLimiter(limit, burst)}
+			clients[ip] = client
+		}
+		client.lastSeen = now
+		return client.limiter
+	}
+
+	return func(c *gin.Context) {
+		now := time.Now()
+		limiter := global
+		if cfg.RateLimitPerClient {
+			limiter = limiterFor(c.ClientIP(), now)
+		}
+		reservation := limiter.ReserveN(now, 1)
+		if delay := reservation.DelayFrom(now); delay > 0 {
+			// Give the token back: the request is rejected, not delayed.
+			reservation.CancelAt(now)
+			c.Header("Retry-After", strconv.Itoa(int(math.Ceil(delay.Seconds()))))
+			apierrors.Respond(c, http.StatusTooManyRequests, apierrors.CodeRateLimited, "too many requests, retry later")
+			return
+		}
+		c.Next()
+	}
+}
@@ -0,0 +1,53 @@
+package middleware
+
+import (
+	"fmt"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+)
+
+// RealmHeader is the request header selecting the Keycloak realm a request targets.
+const RealmHeader = "X-Realm"
+
+// RealmKey is the gin context key under which RealmMiddleware stores the realm chosen by the request.
+const RealmKey = "realm"
+
+// RealmMiddleware lets a request target another Keycloak realm than cfg.KeycloakRealm through the
+// X-Realm header. The realm must be cfg.KeycloakRealm or one of cfg.KeycloakRealms; any other value is
+// answered with 400 VALIDATION_FAILED, so that callers cannot reach realms the deployment does not serve.
+// The chosen realm is stored under RealmKey (unset without the header) and added to the request logger.
+func RealmMiddleware(cfg *config.Config) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		realm := c.GetHeader(RealmHeader)
+		if realm == "" {
+			c.Next()
+			return
+		}
+		if !servedRealm(realm, cfg) {
+			apierrors.Respond(c, http.StatusBadRequest, apierrors.CodeValidationFailed,
+				fmt.Sprintf("realm %q is not served by this service", realm))
+			return
+		}
+		c.Set(RealmKey, realm)
+
+		logger := RequestLogger(c).With().Str("realm", realm).Logger()
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	}
+}
+
+// servedRealm reports whether realm is the default realm or one of the additional realms of cfg.
+func servedRealm(realm string, cfg *config.Config) bool {
+	if realm == cfg.KeycloakRealm {
+		return true
+	}
+	for _, allowed := range cfg.KeycloakRealms {
+		if realm == allowed {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,72 @@
+package middleware
+
+import (
+	"crypto/rand"
+	"fmt"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// RequestIDHeader is the header carrying the request ID, read from the request and echoed in the response.
+const RequestIDHeader = "X-Request-ID"
+
+// RequestIDKey is the gin context key under which RequestIDMiddleware stores the request ID.
+const RequestIDKey = "requestId"
+
+// maxRequestIDLength bounds client-provided request IDs, which end up in every log line of the request.
+const maxRequestIDLength = 128
+
+// RequestIDMiddleware assigns each request an ID, taken from the X-Request-ID header or generated
+// (UUID v4) when absent or invalid, and echoes it in the response header. The ID is stored under
+// RequestIDKey, and a logger carrying it as "request_id" is attached to the request context so that
+// log lines written through log.Ctx (see LoggingMiddleware and the handlers) can be correlated.
+func RequestIDMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id := c.GetHeader(RequestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+		c.Set(RequestIDKey, id)
+		c.Header(RequestIDHeader, id)
+
+		logger := log.With().Str("request_id", id).Logger()
+		c.Request = c.Request.WithContext(logger.WithContext(c.Request.Context()))
+		c.Next()
+	}
+}
+
+// validRequestID reports whether a client-provided request ID is non-empty, reasonably short and
+// made of printable ASCII only, so it cannot forge or break log lines.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		if id[i] < 0x21 || id[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// newRequestID returns a random UUID v4.
+func newRequestID() string {
+	var b [16]byte
+	// crypto/rand.Read only fails if the OS random source is unavailable, which leaves b zeroed:
+	// the request still gets an ID, just not a unique one.
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40 // version 4
+	b[8] = b[8]&0x3f | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
+
+// RequestLogger returns the logger attached to the request by RequestIDMiddleware, falling back to
+// the global logger when none is attached (e.g. in tests that don't install the middleware).
+func RequestLogger(c *gin.Context) *zerolog.Logger {
+	if logger := log.Ctx(c.Request.Context()); logger.GetLevel() != zerolog.Disabled {
+		return logger
+	}
+	return &log.Logger
+}
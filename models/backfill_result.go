@@ -0,0 +1,19 @@
+package models
+
+// BackfillChange describes what a default-assignment backfill changed (or failed to change) for one user.
+type BackfillChange struct {
+	UserID      string   `json:"userId"`
+	Username    string   `json:"username"`
+	AddedRoles  []string `json:"addedRoles,omitempty"`
+	AddedGroups []string `json:"addedGroups,omitempty"`
+	Error       string   `json:"error,omitempty"`
+}
+
+// BackfillResult summarizes a default-assignment backfill. Changes only lists users that were
+// changed or failed; users that already had every default are only counted in UsersScanned.
+type BackfillResult struct {
+	UsersScanned int              `json:"usersScanned"`
+	UsersChanged int              `json:"usersChanged"`
+	UsersFailed  int              `json:"usersFailed"`
+	Changes      []BackfillChange `json:"changes"`
+}
@@ -0,0 +1,18 @@
+package models
+
+// BulkUserResult is the outcome of creating one user of a bulk request.
+type BulkUserResult struct {
+	Email   string `json:"email"`
+	Success bool   `json:"success"`
+	ID      string `json:"id,omitempty"`
+	Code    string `json:"code,omitempty"`  // Error code (see apierrors) when Success is false.
+	Error   string `json:"error,omitempty"` // Error message when Success is false.
+}
+
+// BulkUserResponse is the response body of a bulk user creation: one result per submitted user,
+// in submission order, plus a summary.
+type BulkUserResponse struct {
+	Created int              `json:"created"`
+	Failed  int              `json:"failed"`
+	Results []BulkUserResult `json:"results"`
+}
@@ -0,0 +1,29 @@
+package models
+
+// Credential represents a Keycloak credential representation.
+// It is used as the payload when setting or resetting a user's password.
+type Credential struct {
+	Type      string `json:"type"`
+	Value     string `json:"value"`
+	Temporary bool   `json:"temporary"`
+}
+
+// Credential types reported by Keycloak for WebAuthn (passkey) credentials.
+const (
+	CredentialTypeWebAuthn             = "webauthn"
+	CredentialTypeWebAuthnPasswordless = "webauthn-passwordless"
+)
+
+// CredentialMetadata describes a credential stored for a user.
+// It intentionally omits Keycloak's credentialData/secretData so no secret or public key material is exposed.
+type CredentialMetadata struct {
+	ID          string `json:"id"`
+	Type        string `json:"type"`
+	UserLabel   string `json:"userLabel,omitempty"`
+	CreatedDate int64  `json:"createdDate,omitempty"`
+}
+
+// IsPasskey reports whether the credential is a WebAuthn (two-factor or passwordless) credential.
+func (c CredentialMetadata) IsPasskey() bool {
+	return c.Type == CredentialTypeWebAuthn || c.Type == CredentialTypeWebAuthnPasswordless
+}
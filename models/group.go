@@ -3,4 +3,8 @@ package models
 type Group struct {
 	ID   string `json:"id"`
 	Name string `json:"name"`
+	// Path is the full hierarchical path of the group, e.g. "/engineering/backend".
+	Path string `json:"path,omitempty"`
+	// SubGroups holds the child groups of this group, as returned by Keycloak's group hierarchy.
+	SubGroups []Group `json:"subGroups"`
 }
@@ -0,0 +1,26 @@
+package models
+
+// GroupJoinResult is the outcome of adding a user to, or removing it from, one group of a batch.
+type GroupJoinResult struct {
+	GroupID   string `json:"groupId"`
+	GroupPath string `json:"groupPath,omitempty"` // Set when the group was looked up, e.g. when leaving all groups.
+	Success   bool   `json:"success"`
+	Code      string `json:"code,omitempty"`  // Error code (see apierrors) when Success is false.
+	Error     string `json:"error,omitempty"` // Error message when Success is false.
+}
+
+// GroupJoinResponse is the response body of adding a user to several groups: one result per
+// requested group, in request order, plus a summary.
+type GroupJoinResponse struct {
+	Joined  int               `json:"joined"`
+	Failed  int               `json:"failed"`
+	Results []GroupJoinResult `json:"results"`
+}
+
+// GroupLeaveResponse is the response body of removing a user from all of its groups: one result per
+// group the user was a member of, plus a summary.
+type GroupLeaveResponse struct {
+	Removed int               `json:"removed"`
+	Failed  int               `json:"failed"`
+	Results []GroupJoinResult `json:"results"`
+}
@@ -5,3 +5,10 @@ type GroupWithUsers struct {
 	Group Group  `json:"group"`
 	Users []User `json:"users"`
 }
+
+// GroupWithMemberCount represents a group along with the number of its direct members.
+// The group fields are embedded so the count appears next to them in JSON.
+type GroupWithMemberCount struct {
+	Group
+	MemberCount int `json:"memberCount"`
+}
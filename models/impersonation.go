@@ -0,0 +1,17 @@
+package models
+
+// SessionCookie is a cookie set by Keycloak for a session, e.g. KEYCLOAK_IDENTITY after an impersonation.
+type SessionCookie struct {
+	Name    string `json:"name"`
+	Value   string `json:"value"`
+	Path    string `json:"path,omitempty"`
+	Expires int64  `json:"expires,omitempty"` // Unix timestamp in seconds; absent for session cookies.
+}
+
+// ImpersonationResult is the outcome of impersonating a user: where to send the browser and the
+// cookies of the session Keycloak opened on behalf of the user.
+type ImpersonationResult struct {
+	SameRealm bool            `json:"sameRealm"` // Whether the impersonated user is in the realm of the admin account.
+	Redirect  string          `json:"redirect"`  // URL to open with the cookies, usually the user's account console.
+	Cookies   []SessionCookie `json:"cookies"`
+}
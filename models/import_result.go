@@ -0,0 +1,24 @@
+package models
+
+// ImportRowError describes a row of a user import that was skipped or failed.
+// Line is the line number in a CSV file (the header being line 1) or the 1-based position of the
+// element in a JSON array.
+type ImportRowError struct {
+	Line     int    `json:"line"`
+	Username string `json:"username,omitempty"`
+	Code     string `json:"code,omitempty"` // Error code (see apierrors).
+	Error    string `json:"error"`
+}
+
+// ImportResult summarizes a user import. In a dry run nothing is created: Valid counts the rows that
+// would be submitted to Keycloak and Created and Skipped stay at zero.
+type ImportResult struct {
+	DryRun      bool             `json:"dryRun"`
+	Rows        int              `json:"rows"`
+	Valid       int              `json:"valid"`
+	Created     int              `json:"created"`
+	Skipped     int              `json:"skipped"` // Users that already exist (same username or email).
+	Failed      int              `json:"failed"`
+	SkippedRows []ImportRowError `json:"skippedRows,omitempty"`
+	Failures    []ImportRowError `json:"failures,omitempty"`
+}
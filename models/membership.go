@@ -0,0 +1,9 @@
+package models
+
+// UserMemberships represents one row of the membership matrix: a user and the paths of the groups they belong to.
+type UserMemberships struct {
+	UserID   string   `json:"userId"`
+	Username string   `json:"username"`
+	Email    string   `json:"email"`
+	Groups   []string `json:"groups"`
+}
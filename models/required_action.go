@@ -0,0 +1,8 @@
+package models
+
+// RequiredAction is a required-action provider registered in the realm (e.g. "VERIFY_EMAIL", "UPDATE_PASSWORD").
+type RequiredAction struct {
+	Alias   string `json:"alias"`
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
+}
@@ -0,0 +1,8 @@
+package models
+
+// Role represents a Keycloak realm role.
+// It is also used as the payload of role-mapping requests, which require both ID and Name.
+type Role struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
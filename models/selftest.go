@@ -0,0 +1,15 @@
+package models
+
+// SelfTestStep is the outcome of a single diagnostic step of the self-test.
+type SelfTestStep struct {
+	Name       string `json:"name"`
+	Passed     bool   `json:"passed"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// SelfTestReport is the outcome of the self-test: it passes only if every step passed.
+type SelfTestReport struct {
+	Passed bool           `json:"passed"`
+	Steps  []SelfTestStep `json:"steps"`
+}
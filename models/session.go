@@ -0,0 +1,10 @@
+package models
+
+// Session describes an active Keycloak session of a user.
+// Start and LastAccess are Unix timestamps in milliseconds, as reported by Keycloak.
+type Session struct {
+	ID         string `json:"id"`
+	IPAddress  string `json:"ipAddress"`
+	Start      int64  `json:"start"`
+	LastAccess int64  `json:"lastAccess"`
+}
@@ -0,0 +1,11 @@
+package models
+
+// SyncResult represents the outcome of a user storage (e.g. LDAP) synchronization reported by Keycloak.
+type SyncResult struct {
+	Ignored bool   `json:"ignored"`
+	Added   int    `json:"added"`
+	Updated int    `json:"updated"`
+	Removed int    `json:"removed"`
+	Failed  int    `json:"failed"`
+	Status  string `json:"status"`
+}
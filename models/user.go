@@ -1,9 +1,43 @@
 package models
 
+// User is a Keycloak user. The binding tags apply when a user is created; updates use UserUpdate.
+// Keycloak's brief representation (requested with ?brief=true on user listings) only holds ID, Username,
+// Email, FirstName, LastName, Enabled, EmailVerified and FederationLink; the other fields are then empty.
 type User struct {
 	ID        string `json:"id"`
-	Username  string `json:"username"`
-	Email     string `json:"email"`
-	FirstName string `json:"firstName"`
-	LastName  string `json:"lastName"`
+	Username  string `json:"username" binding:"required,max=255"`
+	Email     string `json:"email" binding:"required,email"`
+	FirstName string `json:"firstName" binding:"max=255"`
+	LastName  string `json:"lastName" binding:"max=255"`
+	// FederationLink holds the ID of the user storage provider (e.g. LDAP) the user was imported from.
+	// It is empty for users stored locally in Keycloak.
+	FederationLink string `json:"federationLink,omitempty"`
+	// Origin holds the ID of the component the user originates from, when applicable.
+	Origin string `json:"origin,omitempty"`
+	// Enabled and EmailVerified are pointers so that an unspecified state (e.g. in an update) is told
+	// apart from false and left untouched in Keycloak.
+	Enabled       *bool `json:"enabled,omitempty"`
+	EmailVerified *bool `json:"emailVerified,omitempty"`
+	// Attributes holds Keycloak's custom user attributes (e.g. "department", "employeeId"); each may have several values.
+	Attributes map[string][]string `json:"attributes,omitempty"`
+	// RequiredActions lists the actions (e.g. "UPDATE_PASSWORD") the user must perform at the next login.
+	RequiredActions []string `json:"requiredActions,omitempty"`
+}
+
+// IsFederated reports whether the user is backed by a user federation provider such as LDAP.
+func (u User) IsFederated() bool {
+	return u.FederationLink != ""
+}
+
+// UserUpdate is the body of a user update. Every field is optional: absent fields keep their current
+// value, while fields that are present are validated like in User. Attributes are merged with the
+// current ones: attributes not listed are kept and an attribute given with no values is removed.
+type UserUpdate struct {
+	Username      *string             `json:"username,omitempty" binding:"omitempty,min=1,max=255"`
+	Email         *string             `json:"email,omitempty" binding:"omitempty,email"`
+	FirstName     *string             `json:"firstName,omitempty" binding:"omitempty,max=255"`
+	LastName      *string             `json:"lastName,omitempty" binding:"omitempty,max=255"`
+	Enabled       *bool               `json:"enabled,omitempty"`
+	EmailVerified *bool               `json:"emailVerified,omitempty"`
+	Attributes    map[string][]string `json:"attributes,omitempty"`
 }
@@ -0,0 +1,11 @@
+package models
+
+// UserDetails is a consolidated view of a user: the profile along with its groups and realm roles.
+// A section that could not be loaded is null and the reason is reported in Errors under the
+// section's name ("groups" or "roles").
+type UserDetails struct {
+	User   User              `json:"user"`
+	Groups []Group           `json:"groups"`
+	Roles  []Role            `json:"roles"`
+	Errors map[string]string `json:"errors,omitempty"`
+}
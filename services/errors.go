@@ -0,0 +1,102 @@
+package services
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// KeycloakError describes a non-successful response returned by Keycloak's Admin API.
+// It keeps the HTTP status so callers can tell client-side problems (e.g. a rejected
+// password policy) apart from upstream failures.
+type KeycloakError struct {
+	Operation  string // Short description of the failed operation, e.g. "reset password".
+	StatusCode int    // HTTP status code returned by Keycloak.
+	Body       string // Raw response body returned by Keycloak.
+}
+
+// Error implements the error interface using the same wording as the rest of the service layer.
+func (e *KeycloakError) Error() string {
+	return fmt.Sprintf("failed to %s, status: %d, response: %s", e.Operation, e.StatusCode, e.Body)
+}
+
+// Is makes errors.Is(err, ErrNotFound) report whether Keycloak answered 404, so that callers never
+// mistake an outage or an authorization problem for a missing resource.
+func (e *KeycloakError) Is(target error) bool {
+	return target == ErrNotFound && e.StatusCode == http.StatusNotFound
+}
+
+// ErrTokenFetch matches, through errors.Is, every *TokenFetchError.
+var ErrTokenFetch = errors.New("unable to get an admin token from Keycloak")
+
+// Kinds of TokenFetchError.
+const (
+	TokenFetchNetwork          = "network"           // Keycloak could not be reached or did not answer in time.
+	TokenFetchBadCredentials   = "bad credentials"   // Keycloak answered 401: the admin credentials are wrong.
+	TokenFetchUnexpectedStatus = "unexpected status" // Keycloak answered another error status, or no token.
+)
+
+// TokenFetchError describes why an admin token could not be obtained from Keycloak's token endpoint.
+// Err is the underlying error: a network error, or a *KeycloakError for an error status.
+type TokenFetchError struct {
+	Kind string
+	Err  error
+}
+
+// Error implements the error interface, pointing at the configuration when the credentials are wrong.
+func (e *TokenFetchError) Error() string {
+	switch e.Kind {
+	case TokenFetchBadCredentials:
+		return fmt.Sprintf("Keycloak rejected the admin credentials, check KEYCLOAK_USERNAME/KEYCLOAK_PASSWORD: %v", e.Err)
+	case TokenFetchNetwork:
+		return fmt.Sprintf("Keycloak's token endpoint could not be reached: %v", e.Err)
+	}
+	return fmt.Sprintf("%v: %v", ErrTokenFetch, e.Err)
+}
+
+// Unwrap returns the underlying error, so that errors.As still finds a *KeycloakError or a net.Error.
+func (e *TokenFetchError) Unwrap() error {
+	return e.Err
+}
+
+// Is makes errors.Is(err, ErrTokenFetch) report whether err is a token fetch failure.
+func (e *TokenFetchError) Is(target error) bool {
+	return target == ErrTokenFetch
+}
+
+// ErrNotFound matches, through errors.Is, a *KeycloakError for a 404 response: the requested resource
+// does not exist. Any other failure (another status, a network error) does not match it.
+var ErrNotFound = errors.New("resource not found")
+
+// ErrFederatedUser is returned when Keycloak rejects a change to a user that is managed by a
+// user federation provider (e.g. a read-only LDAP), so the change must be made in the source directory.
+var ErrFederatedUser = errors.New("user is managed by a user federation provider and cannot be modified")
+
+// ErrCredentialNotFound is returned when a user has no credential with the requested ID and type.
+var ErrCredentialNotFound = errors.New("credential not found")
+
+// ErrUserNotFound is returned when a lookup by a unique attribute (e.g. email) matches no user,
+// or when a membership change refers to a user that does not exist.
+var ErrUserNotFound = errors.New("no user found")
+
+// ErrAmbiguousUser is returned when a lookup by a unique attribute (e.g. email) matches more than one user.
+var ErrAmbiguousUser = errors.New("multiple users found")
+
+// ErrGroupNotFound is returned when a membership change refers to a group that does not exist.
+var ErrGroupNotFound = errors.New("no group found")
+
+// ErrImpersonationDisabled is returned when the impersonation feature is disabled on the Keycloak server.
+var ErrImpersonationDisabled = errors.New("impersonation is disabled on the Keycloak server")
+
+// ErrImpersonationForbidden is returned when Keycloak answers 403 to an impersonation request. The
+// answer does not say why: the account making the call (the service account, or the caller's token when
+// passed through) may lack the impersonation role, or may not be allowed to impersonate this user.
+var ErrImpersonationForbidden = errors.New("keycloak does not allow impersonating this user with the current credentials")
+
+// ErrCallerTokenRejected is returned when Keycloak answers 401 to a call made with the caller's own
+// access token (see KeycloakService.WithCallerToken): the token is invalid or expired.
+var ErrCallerTokenRejected = errors.New("keycloak rejected the caller's access token")
+
+// ErrEmailNotSent is returned when Keycloak fails to send an email to a user, which almost always
+// means SMTP is not configured (or misconfigured) in the realm.
+var ErrEmailNotSent = errors.New("keycloak could not send the email; check the realm's SMTP settings")
@@ -0,0 +1,87 @@
+package services
+
+import (
+	"sync"
+	"time"
+)
+
+// Keys of the group listings kept in the group cache, prefixed with the realm they belong to.
+const (
+	groupsCacheKey          = "groups"
+	groupsWithUsersCacheKey = "groups-with-users"
+)
+
+// groupCache keeps the group listings for a short time, as clients poll them and ListGroupsWithUsers
+// costs one Keycloak call per group. Its zero value is an empty cache ready to use.
+type groupCache struct {
+	mu      sync.Mutex
+	entries map[string]groupCacheEntry
+	// generation is incremented by invalidate, so that a listing fetched before a change is not stored after it.
+	generation uint64
+}
+
+// groupCacheEntry is a cached listing and the time it expires.
+type groupCacheEntry struct {
+	value   interface{}
+	expires time.Time
+}
+
+// get returns the value cached under key unless it expired, along with the current generation to pass
+// to put once a missing value was fetched.
+func (c *groupCache) get(key string) (interface{}, uint64, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[key]
+	if !ok || time.Now().After(entry.expires) {
+		return nil, c.generation, false
+	}
+	return entry.value, c.generation, true
+}
+
+// put caches value under key for ttl, unless the cache was invalidated since generation was read.
+func (c *groupCache) put(key string, value interface{}, generation uint64, ttl time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if generation != c.generation {
+		return
+	}
+	if c.entries == nil {
+		c.entries = make(map[string]groupCacheEntry)
+	}
+	c.entries[key] = groupCacheEntry{value: value, expires: time.Now().Add(ttl)}
+}
+
+// invalidate drops every cached listing.
+func (c *groupCache) invalidate() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+	c.generation++
+}
+
+// cachedGroupListing returns the listing cached under key, or the result of fetch, which is cached when
+// Config.GroupCacheEnabled is set. Listings fetched with a caller's token are never cached, as they only
+// hold what that caller may see. Callers must not modify the returned value as it may be shared.
+func (k *KeycloakService) cachedGroupListing(key string, fetch func() (interface{}, error)) (interface{}, error) {
+	if !k.config.GroupCacheEnabled || k.config.GroupCacheTTL <= 0 || k.callerToken != "" {
+		return fetch()
+	}
+	key = k.realm + "/" + key
+	value, generation, ok := k.groupCache.get(key)
+	if ok {
+		return value, nil
+	}
+	value, err := fetch()
+	if err != nil {
+		return nil, err
+	}
+	k.groupCache.put(key, value, generation, k.config.GroupCacheTTL)
+	return value, nil
+}
+
+// InvalidateGroupCache drops the cached group listings of every realm, so that the next ListGroups and ListGroupsWithUsers
+// calls reach Keycloak. Group and membership changes made through the service call it; use it after
+// changing groups in Keycloak directly.
+func (k *KeycloakService) InvalidateGroupCache() {
+	k.groupCache.invalidate()
+}
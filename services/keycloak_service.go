@@ -2,112 +2,626 @@ package services
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
+	"math/rand"
 	"ms-user/config"
+	"ms-user/metrics"
 	"ms-user/models"
 	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
+	"golang.org/x/sync/errgroup"
 )
 
 // KeycloakService handles all interactions with Keycloak's Admin API.
 // It manages token retrieval and refresh as well as CRUD operations for users, groups,
 // and membership management.
+// Admin API calls target a single realm; ForRealm returns a KeycloakService targeting another realm that
+// shares the admin token, the connection pool and the caches. WithCallerToken likewise returns one whose
+// calls are made on behalf of a caller rather than with the admin token.
 type KeycloakService struct {
-	config *config.Config
-	client *http.Client
-	token  string // Admin token used for authorization; token refresh logic is implemented.
+	*adminSession
+	realm string // Realm targeted by Admin API calls; Config.KeycloakRealm unless chosen with ForRealm.
+	// callerToken is the caller's own Keycloak access token, sent instead of the admin token when set
+	// (see WithCallerToken).
+	callerToken string
 }
 
+// adminSession is the state shared by a KeycloakService and the copies returned by its ForRealm method.
+// The admin token is always obtained from Config.KeycloakRealm, whatever realm the calls target.
+type adminSession struct {
+	config  *config.Config
+	client  *http.Client
+	tokenMu sync.RWMutex // Guards the token fields below, which concurrent requests may refresh.
+	token   string       // Admin token used for authorization; token refresh logic is implemented.
+	// tokenExpiry is when token expires; zero when unknown (e.g. set through SetToken), which disables
+	// the proactive refresh.
+	tokenExpiry   time.Time
+	refreshToken  string     // Refresh token issued with token, used to renew it without re-sending credentials.
+	refreshExpiry time.Time  // When refreshToken expires; zero when Keycloak did not say.
+	refreshMu     sync.Mutex // Serializes token renewals so concurrent requests don't all renew at once.
+	groupCache    groupCache // Short-lived copies of the group listings (see Config.GroupCacheEnabled).
+}
+
+// tokenExpiryMargin is how long before its expiry the admin token is proactively renewed, so that a
+// request does not race the expiry.
+const tokenExpiryMargin = 30 * time.Second
+
+// tokenResponse is the part of Keycloak's OpenID Connect token response used by the service.
+type tokenResponse struct {
+	AccessToken      string `json:"access_token"`
+	ExpiresIn        int    `json:"expires_in"`
+	RefreshToken     string `json:"refresh_token"`
+	RefreshExpiresIn int    `json:"refresh_expires_in"`
+}
+
+// Connection pool settings of the HTTP client. All requests go to the single Keycloak host, so the
+// per-host limit is what bounds reuse; Go's default of 2 idle connections per host would make most
+// requests under load open a new connection.
+const (
+	maxIdleConns        = 100
+	maxIdleConnsPerHost = 64
+	idleConnTimeout     = 90 * time.Second
+)
+
 // NewKeycloakService initializes a new KeycloakService with the provided configuration.
-// It fetches an initial admin token and sets up the HTTP client.
-func NewKeycloakService(cfg *config.Config) *KeycloakService {
+// It sets up an HTTP client keeping connections to Keycloak alive and fetches an initial admin token,
+// retrying up to Config.KeycloakStartupRetries times with backoff (starting at Config.KeycloakStartupBackoff)
+// while Keycloak is unreachable or failing.
+// A single instance is meant to be shared by all handlers, so they share its token and connection pool.
+// Output: the service; an error when no admin token could be obtained, e.g. because of wrong credentials.
+func NewKeycloakService(cfg *config.Config) (*KeycloakService, error) {
 	service := &KeycloakService{
-		config: cfg,
-		client: &http.Client{},
+		adminSession: &adminSession{
+			config: cfg,
+			client: &http.Client{Transport: newTransport()},
+		},
+		realm: cfg.KeycloakRealm,
 	}
-	// Fetch initial admin token from Keycloak.
-	token, err := service.getAdminToken()
-	if err != nil {
-		log.Error().Err(err).Msg("Failed to get admin token from Keycloak")
+	if err := service.authenticateAtStartup(); err != nil {
+		return nil, err
+	}
+	return service, nil
+}
+
+// authenticateAtStartup fetches the initial admin token. Network errors, 429 and 5xx responses are retried
+// with backoff; any other rejection (e.g. 401 for wrong credentials) will not go away and fails at once.
+func (k *KeycloakService) authenticateAtStartup() error {
+	for attempt := 0; ; attempt++ {
+		err := k.authenticate()
+		if err == nil {
+			return nil
+		}
+		var kcErr *KeycloakError
+		transient := !errors.As(err, &kcErr) || kcErr.StatusCode == http.StatusTooManyRequests || kcErr.StatusCode >= 500
+		if !transient || attempt >= k.config.KeycloakStartupRetries {
+			return fmt.Errorf("unable to get an admin token from Keycloak at %s after %d attempt(s): %w",
+				k.config.KeycloakURL, attempt+1, err)
+		}
+		delay := retryDelay("", attempt, k.config.KeycloakStartupBackoff)
+		log.Warn().Err(err).Int("attempt", attempt+1).Dur("delay", delay).
+			Msg("Failed to get admin token from Keycloak, retrying")
+		time.Sleep(delay)
 	}
-	service.token = token
-	return service
 }
 
-// doRequest executes an HTTP request with the current admin token.
-// If a 401 Unauthorized response is received, it refreshes the token and retries once.
+// newTransport returns a copy of http.DefaultTransport (keeping its proxy, dial and TLS handshake
+// settings) with a connection pool sized for the service's traffic to Keycloak.
+func newTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConnsPerHost
+	transport.IdleConnTimeout = idleConnTimeout
+	return transport
+}
+
+// doRequest executes an HTTP request with the current admin token, or with the caller's token when k
+// carries one. 429 Too Many Requests and 503 Service Unavailable responses are retried by sendWithRetry.
+// If a 401 Unauthorized response is received, it refreshes the admin token (see renewRejectedToken) and
+// retries once (that retry is itself subject to the 429/503 retries); a caller's token cannot be refreshed, so a
+// 401 answered to it is returned as ErrCallerTokenRejected.
 // It returns the HTTP response or an error if the request ultimately fails.
 //
 // Input: A pointer to an http.Request (with no authorization header set).
 // Output: *http.Response if successful; error otherwise.
 func (k *KeycloakService) doRequest(req *http.Request) (*http.Response, error) {
-	req.Header.Set("Authorization", "Bearer "+k.token)
-	resp, err := k.client.Do(req)
+	resp, err := k.sendWithRetry(req)
 	if err != nil {
 		return nil, err
 	}
+	if resp.StatusCode == http.StatusUnauthorized && k.callerToken != "" {
+		resp.Body.Close()
+		return nil, ErrCallerTokenRejected
+	}
 	// If the token is expired or invalid, refresh the token and retry once.
 	if resp.StatusCode == http.StatusUnauthorized {
 		resp.Body.Close() // Ensure the response body is closed.
 		log.Info().Msg("Token expired. Refreshing token and retrying request.")
-		newToken, err := k.getAdminToken()
-		if err != nil {
-			return nil, fmt.Errorf("failed to refresh token: %v", err)
+		rejected := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+		if err := k.renewRejectedToken(rejected); err != nil {
+			return nil, fmt.Errorf("failed to refresh token: %w", err)
+		}
+		if err := rewindBody(req); err != nil {
+			return nil, err
 		}
-		k.token = newToken
-		req.Header.Set("Authorization", "Bearer "+k.token)
-		return k.client.Do(req)
+		return k.sendWithRetry(req)
 	}
 	return resp, nil
 }
 
+// sendWithRetry sends req with the current admin token (or the caller's token), retrying up to Config.KeycloakMaxRetries times
+// while Keycloak answers 429 or 503 (see shouldRetry). Each retry waits for the Retry-After header if present, otherwise
+// for an exponential backoff with jitter based on Config.KeycloakRetryBaseDelay.
+func (k *KeycloakService) sendWithRetry(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		if k.callerToken != "" {
+			req.Header.Set("Authorization", "Bearer "+k.callerToken)
+		} else {
+			k.renewExpiringToken()
+			k.tokenMu.RLock()
+			req.Header.Set("Authorization", "Bearer "+k.token)
+			k.tokenMu.RUnlock()
+		}
+
+		resp, err := k.send(req)
+		if err != nil {
+			return nil, err
+		}
+		if !shouldRetry(req.Method, resp) || attempt >= k.config.KeycloakMaxRetries {
+			return resp, nil
+		}
+		resp.Body.Close()
+
+		delay := retryDelay(resp.Header.Get("Retry-After"), attempt, k.config.KeycloakRetryBaseDelay)
+		log.Warn().Int("status", resp.StatusCode).Int("attempt", attempt+1).Dur("delay", delay).
+			Msgf("Keycloak is throttling %s %s, retrying", req.Method, req.URL.Path)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+		if err := rewindBody(req); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// shouldRetry reports whether a response may be retried. A 429 means the request was turned away before
+// being processed. A 503 may come from a proxy after Keycloak already applied the request, so it is only
+// retried for idempotent methods, or for a POST (e.g. a user creation) when Keycloak itself asks for a
+// retry with Retry-After; otherwise a retry could create a duplicate or fail with a spurious 409.
+func shouldRetry(method string, resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests:
+		return true
+	case http.StatusServiceUnavailable:
+		switch method {
+		case http.MethodGet, http.MethodHead, http.MethodPut, http.MethodDelete:
+			return true
+		}
+		return resp.Header.Get("Retry-After") != ""
+	}
+	return false
+}
+
+// send performs a single HTTP call to Keycloak and records its status and latency in the metrics.
+func (k *KeycloakService) send(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := k.client.Do(req)
+	status := 0
+	if err == nil {
+		status = resp.StatusCode
+	}
+	metrics.ObserveKeycloakRequest(req.Method, req.URL.Path, status, time.Since(start))
+	return resp, err
+}
+
+// maxRetryDelay caps the wait between two retries, whatever Retry-After asks for.
+const maxRetryDelay = 30 * time.Second
+
+// retryDelay returns how long to wait before retry number attempt+1. A Retry-After header, in seconds
+// or as an HTTP date, takes precedence; otherwise the delay is base * 2^attempt with "equal jitter"
+// (a random value between half and all of it), so that throttled callers do not retry in lockstep.
+func retryDelay(retryAfter string, attempt int, base time.Duration) time.Duration {
+	if retryAfter != "" {
+		if seconds, err := strconv.Atoi(strings.TrimSpace(retryAfter)); err == nil && seconds >= 0 {
+			return minDuration(time.Duration(seconds)*time.Second, maxRetryDelay)
+		}
+		if date, err := http.ParseTime(retryAfter); err == nil {
+			return minDuration(maxDuration(time.Until(date), 0), maxRetryDelay)
+		}
+	}
+	if base <= 0 {
+		return 0
+	}
+	backoff := maxRetryDelay
+	if attempt < 30 && base<<uint(attempt) < maxRetryDelay {
+		backoff = base << uint(attempt)
+	}
+	half := backoff / 2
+	return half + time.Duration(rand.Int63n(int64(backoff-half)+1))
+}
+
+func minDuration(a, b time.Duration) time.Duration {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxDuration(a, b time.Duration) time.Duration {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+// rewindBody resets the body of req so that it can be sent again. Requests built by http.NewRequest
+// from a bytes.Buffer, bytes.Reader or strings.Reader support this through GetBody.
+func rewindBody(req *http.Request) error {
+	if req.Body == nil || req.GetBody == nil {
+		return nil
+	}
+	body, err := req.GetBody()
+	if err != nil {
+		return err
+	}
+	req.Body = body
+	return nil
+}
+
 // getAdminToken fetches an admin access token from Keycloak.
 // It sends a POST request to the token endpoint using admin credentials.
-// Returns the access token as a string, or an error if the process fails.
+// Returns the access token as a string, or an error if the process fails. The service's token is not changed.
 func (k *KeycloakService) getAdminToken() (string, error) {
-	url := fmt.Sprintf("%s/realms/%s/protocol/openid-connect/token", k.config.KeycloakURL, k.config.KeycloakRealm)
-	data := "grant_type=password&client_id=admin-cli&username=" + k.config.KeycloakUsername + "&password=" + k.config.KeycloakPassword
-	req, err := http.NewRequest("POST", url, bytes.NewBufferString(data))
+	token, err := k.requestToken(k.passwordGrant())
 	if err != nil {
 		return "", err
 	}
+	return token.AccessToken, nil
+}
+
+// passwordGrant returns the token request form logging in with the configured admin credentials.
+func (k *KeycloakService) passwordGrant() url.Values {
+	return url.Values{
+		"grant_type": {"password"},
+		"client_id":  {"admin-cli"},
+		"username":   {k.config.KeycloakUsername},
+		"password":   {k.config.KeycloakPassword},
+	}
+}
+
+// authenticate logs in with the admin credentials and stores the resulting tokens.
+func (k *KeycloakService) authenticate() error {
+	token, err := k.requestToken(k.passwordGrant())
+	if err != nil {
+		return err
+	}
+	k.storeToken(token)
+	return nil
+}
+
+// refreshAdminToken renews the admin token with the refresh_token grant, so that credentials are not
+// re-sent, and falls back to a full login (authenticate) when there is no usable refresh token or
+// Keycloak rejects it (e.g. the refresh token or the session expired).
+func (k *KeycloakService) refreshAdminToken() error {
+	k.tokenMu.RLock()
+	refreshToken, refreshExpiry := k.refreshToken, k.refreshExpiry
+	k.tokenMu.RUnlock()
+
+	if refreshToken != "" && (refreshExpiry.IsZero() || time.Now().Before(refreshExpiry)) {
+		token, err := k.requestToken(url.Values{
+			"grant_type":    {"refresh_token"},
+			"client_id":     {"admin-cli"},
+			"refresh_token": {refreshToken},
+		})
+		if err == nil {
+			k.storeToken(token)
+			return nil
+		}
+		log.Warn().Err(err).Msg("Unable to refresh admin token, logging in again")
+	}
+	return k.authenticate()
+}
+
+// renewExpiringToken proactively refreshes the admin token when it expires within tokenExpiryMargin.
+// A failed renewal is only logged: the request then goes out with the current token and a 401 is
+// handled by doRequest.
+func (k *KeycloakService) renewExpiringToken() {
+	if !k.tokenExpiring() {
+		return
+	}
+	k.refreshMu.Lock()
+	defer k.refreshMu.Unlock()
+	// Another request may have renewed the token while this one waited for the lock.
+	if !k.tokenExpiring() {
+		return
+	}
+	if err := k.refreshAdminToken(); err != nil {
+		log.Warn().Err(err).Msg("Unable to renew expiring admin token")
+	}
+}
+
+// renewRejectedToken refreshes the admin token after Keycloak answered 401 to a request sent with
+// rejected. Like renewExpiringToken it holds refreshMu, so that a burst of 401s leads to a single renewal:
+// when another request already replaced the rejected token while this one waited, the new token is used
+// as is. Renewing again would spend the refresh token twice, which fails when Keycloak rotates them.
+func (k *KeycloakService) renewRejectedToken(rejected string) error {
+	k.refreshMu.Lock()
+	defer k.refreshMu.Unlock()
+	k.tokenMu.RLock()
+	current := k.token
+	k.tokenMu.RUnlock()
+	if current != rejected {
+		return nil
+	}
+	return k.refreshAdminToken()
+}
+
+// tokenExpiring reports whether the admin token has a known expiry within tokenExpiryMargin.
+func (k *KeycloakService) tokenExpiring() bool {
+	k.tokenMu.RLock()
+	defer k.tokenMu.RUnlock()
+	return !k.tokenExpiry.IsZero() && time.Until(k.tokenExpiry) < tokenExpiryMargin
+}
+
+// storeToken makes token the current admin token, along with its refresh token and expiries.
+func (k *KeycloakService) storeToken(token *tokenResponse) {
+	now := time.Now()
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
+	k.token = token.AccessToken
+	k.tokenExpiry, k.refreshExpiry = time.Time{}, time.Time{}
+	if token.ExpiresIn > 0 {
+		k.tokenExpiry = now.Add(time.Duration(token.ExpiresIn) * time.Second)
+	}
+	k.refreshToken = token.RefreshToken
+	if token.RefreshExpiresIn > 0 {
+		k.refreshExpiry = now.Add(time.Duration(token.RefreshExpiresIn) * time.Second)
+	}
+}
+
+// requestToken posts form to Keycloak's token endpoint and returns the issued tokens.
+// The request is bounded by Config.KeycloakTokenTimeout (when positive), so that a hanging token endpoint
+// fails the requests waiting for a token instead of blocking them. Failures are *TokenFetchError.
+func (k *KeycloakService) requestToken(form url.Values) (*tokenResponse, error) {
+	endpoint := fmt.Sprintf("%s/realms/%s/protocol/openid-connect/token", k.config.KeycloakURL, k.config.KeycloakRealm)
+	ctx := context.Background()
+	if k.config.KeycloakTokenTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, k.config.KeycloakTokenTimeout)
+		defer cancel()
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
 	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
 
-	resp, err := k.client.Do(req)
+	resp, err := k.send(req)
 	if err != nil {
-		return "", err
+		return nil, &TokenFetchError{Kind: TokenFetchNetwork, Err: err}
 	}
 	defer resp.Body.Close()
 
 	// Check for a successful response.
 	if resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return "", fmt.Errorf("failed to get token, status: %d, response: %s %s", resp.StatusCode, string(bodyBytes), string(k.config.KeycloakUsername))
+		kind := TokenFetchUnexpectedStatus
+		if resp.StatusCode == http.StatusUnauthorized {
+			kind = TokenFetchBadCredentials
+		}
+		return nil, &TokenFetchError{Kind: kind, Err: &KeycloakError{Operation: "get token", StatusCode: resp.StatusCode, Body: string(bodyBytes)}}
+	}
+
+	// Decode the JSON response; reading the body is also bounded by the timeout.
+	var token tokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&token); err != nil {
+		if ctx.Err() != nil {
+			return nil, &TokenFetchError{Kind: TokenFetchNetwork, Err: err}
+		}
+		return nil, &TokenFetchError{Kind: TokenFetchUnexpectedStatus, Err: fmt.Errorf("invalid token response: %v", err)}
+	}
+	if token.AccessToken == "" {
+		return nil, &TokenFetchError{Kind: TokenFetchUnexpectedStatus, Err: fmt.Errorf("access token not found")}
 	}
+	return &token, nil
+}
 
-	// Decode the JSON response.
-	var result map[string]interface{}
-	err = json.NewDecoder(resp.Body).Decode(&result)
+// Ping verifies that Keycloak is reachable and accepts the admin token with a cheap Admin API call
+// (one realm role). The cached token is used, so a probe does not log in and open a Keycloak session;
+// it is only renewed as for any other call, which also checks the credentials once it expires.
+// Output: error describing why Keycloak cannot be used; nil otherwise.
+func (k *KeycloakService) Ping() error {
+	url := fmt.Sprintf("%s/admin/realms/%s/roles?first=0&max=1&briefRepresentation=true", k.config.KeycloakURL, k.realm)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
-		return "", err
+		return err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return &KeycloakError{Operation: "ping", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
-	token, ok := result["access_token"].(string)
-	if !ok {
-		return "", fmt.Errorf("access token not found")
+	return nil
+}
+
+// SelfTest runs a sequential diagnostic against Keycloak: admin token acquisition, a ListGroups call
+// and a CountUsers call. Every step runs even if a previous one failed, so the report shows all problems.
+// Output: models.SelfTestReport with per-step results and timings; Passed is true only if all steps passed.
+func (k *KeycloakService) SelfTest() models.SelfTestReport {
+	steps := []struct {
+		name string
+		run  func() error
+	}{
+		{"token", func() error { _, err := k.getAdminToken(); return err }},
+		{"list_groups", func() error { _, err := k.ListGroups(); return err }},
+		{"count_users", func() error { _, err := k.CountUsers(); return err }},
+	}
+
+	report := models.SelfTestReport{Passed: true}
+	for _, step := range steps {
+		start := time.Now()
+		err := step.run()
+		result := models.SelfTestStep{
+			Name:       step.name,
+			Passed:     err == nil,
+			DurationMs: time.Since(start).Milliseconds(),
+		}
+		if err != nil {
+			result.Error = err.Error()
+			report.Passed = false
+		}
+		report.Steps = append(report.Steps, result)
 	}
-	return token, nil
+	return report
 }
 
 // ---------------------- User CRUD operations ----------------------
 
-// ListUsers retrieves all users from Keycloak.
-// Input: None.
-// Output: Slice of models.User if successful; error otherwise.
-func (k *KeycloakService) ListUsers() ([]models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users", k.config.KeycloakURL, k.config.KeycloakRealm)
+// ListUsers retrieves the first page of users from Keycloak, up to max, along with the number of users
+// matching filter. Listing users without paging parameters is bounded this way rather than paging through
+// the whole realm: use ListUsersPage for the following pages, or ListAllUsers to get every user.
+// Input: filter restricting the users by state and the maximum number of users to return.
+// Output: Slice of models.User and the total reported by CountUsers for the same filter (-1 if it could
+// not be retrieved) if successful; error otherwise.
+func (k *KeycloakService) ListUsers(filter UserFilter, max int) ([]models.User, int, error) {
+	users, err := k.ListUsersPage(filter, 0, max)
+	if err != nil {
+		return nil, 0, err
+	}
+	// The count only tells the caller whether more users exist; failing to get it must not fail the listing.
+	total, err := k.countUsers(filter)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to count users")
+		return users, -1, nil
+	}
+	return users, total, nil
+}
+
+// UserFilter restricts a user listing by account state. A nil field does not filter.
+type UserFilter struct {
+	Enabled       *bool
+	EmailVerified *bool
+	// Brief requests Keycloak's brief user representation (see models.User) instead of the full one;
+	// it does not restrict the users returned.
+	Brief bool
+}
+
+// query returns the filter as Keycloak /users (and /users/count) query parameters.
+func (f UserFilter) query() url.Values {
+	query := url.Values{}
+	if f.Enabled != nil {
+		query.Set("enabled", strconv.FormatBool(*f.Enabled))
+	}
+	if f.EmailVerified != nil {
+		query.Set("emailVerified", strconv.FormatBool(*f.EmailVerified))
+	}
+	return query
+}
+
+// usersURL returns the Keycloak /users endpoint restricted by filter.
+func (k *KeycloakService) usersURL(filter UserFilter) string {
+	endpoint := fmt.Sprintf("%s/admin/realms/%s/users", k.config.KeycloakURL, k.realm)
+	// The representation is not a filter, so it is left out of query, which /users/count shares.
+	query := filter.query()
+	if filter.Brief {
+		query.Set("briefRepresentation", "true")
+	}
+	if len(query) > 0 {
+		endpoint += "?" + query.Encode()
+	}
+	return endpoint
+}
+
+// ListUsersPage retrieves a single page of users from Keycloak.
+// Input: filter restricting the users by state, offset of the first user (first) and maximum number of users to return (max).
+// Output: Slice of models.User, shorter than max on the last page, if successful; error otherwise.
+func (k *KeycloakService) ListUsersPage(filter UserFilter, first, max int) ([]models.User, error) {
+	return k.listUsersPage(k.usersURL(filter), "list users", first, max)
+}
+
+// userPageSize is the number of users requested per page when paging through all users.
+const userPageSize = 100
+
+// ListAllUsers retrieves every user of the realm by paging through Keycloak's user listing,
+// which otherwise caps a single response (100 users by default).
+// The result is cross-checked against CountUsers: if the two disagree significantly (see IncompleteListing)
+// a warning is logged, since paging was likely cut short by a server-side cap.
+// Input: filter restricting the users by state (UserFilter{} for every user).
+// Output: Slice of models.User and the total reported by CountUsers for the same filter (-1 if it could
+// not be retrieved) if successful; error otherwise.
+func (k *KeycloakService) ListAllUsers(filter UserFilter) ([]models.User, int, error) {
+	users, err := k.listAllUserPages(k.usersURL(filter), "list users")
+	if err != nil {
+		return nil, 0, err
+	}
+	// The count is only a consistency check; failing to get it must not fail the listing.
+	total, err := k.countUsers(filter)
+	if err != nil {
+		log.Warn().Err(err).Msg("Unable to count users to verify the user listing")
+		return users, -1, nil
+	}
+	if IncompleteListing(len(users), total) {
+		log.Warn().Int("listed", len(users)).Int("count", total).
+			Msg("User listing does not match the user count; pagination may have been incomplete")
+	}
+	return users, total, nil
+}
+
+// IncompleteListing reports whether a listing of listed users differs significantly from the total
+// reported by Keycloak. Users created or deleted while paging cause small differences, so up to
+// 1% (at least one user) is tolerated.
+func IncompleteListing(listed, total int) bool {
+	diff := total - listed
+	if diff < 0 {
+		diff = -diff
+	}
+	tolerance := total / 100
+	if tolerance < 1 {
+		tolerance = 1
+	}
+	return diff > tolerance
+}
+
+// listAllUserPages pages through a Keycloak endpoint returning users (e.g. /users or /roles/{name}/users)
+// using the first/max query parameters until a short page is returned.
+func (k *KeycloakService) listAllUserPages(baseURL, operation string) ([]models.User, error) {
+	all := []models.User{}
+	for first := 0; ; first += userPageSize {
+		page, err := k.listUsersPage(baseURL, operation, first, userPageSize)
+		if err != nil {
+			return nil, err
+		}
+		all = append(all, page...)
+		if len(page) < userPageSize {
+			return all, nil
+		}
+	}
+}
+
+// listUsersPage retrieves a single page of users from baseURL starting at offset first.
+func (k *KeycloakService) listUsersPage(baseURL, operation string, first, max int) ([]models.User, error) {
+	separator := "?"
+	if strings.Contains(baseURL, "?") {
+		separator = "&"
+	}
+	url := fmt.Sprintf("%s%sfirst=%d&max=%d", baseURL, separator, first, max)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -119,19 +633,13 @@ func (k *KeycloakService) ListUsers() ([]models.User, error) {
 	}
 	defer resp.Body.Close()
 
-	// Read the response body.
 	body, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
 		return nil, err
 	}
 
-	// Check for non-OK status and parse error message if available.
 	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("failed to list users: status %d, unable to parse error", resp.StatusCode)
-		}
-		return nil, fmt.Errorf("failed to list users: %v", errResp)
+		return nil, &KeycloakError{Operation: operation, StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	var users []models.User
@@ -142,11 +650,53 @@ func (k *KeycloakService) ListUsers() ([]models.User, error) {
 	return users, nil
 }
 
+// CountUsers retrieves the total number of users in the realm from Keycloak.
+// Input: None.
+// Output: The number of users if successful; error otherwise.
+func (k *KeycloakService) CountUsers() (int, error) {
+	return k.countUsers(UserFilter{})
+}
+
+// countUsers is CountUsers restricted by filter.
+func (k *KeycloakService) countUsers(filter UserFilter) (int, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/count", k.config.KeycloakURL, k.realm)
+	if query := filter.query(); len(query) > 0 {
+		url += "?" + query.Encode()
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return 0, &KeycloakError{Operation: "count users", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	// Keycloak answers with a bare JSON number.
+	var count int
+	if err := json.Unmarshal(body, &count); err != nil {
+		return 0, fmt.Errorf("json: %v", err)
+	}
+	return count, nil
+}
+
 // CreateUser creates a new user in Keycloak.
 // Input: models.User representing the user to create.
-// Output: Pointer to models.User on success (Keycloak does not return the full object by default); error otherwise.
+// Output: Pointer to models.User on success; error otherwise. Keycloak does not return the created object,
+// so the ID is taken from the Location header when present; otherwise the input user is returned as-is.
 func (k *KeycloakService) CreateUser(user models.User) (*models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users", k.config.KeycloakURL, k.config.KeycloakRealm)
+	url := fmt.Sprintf("%s/admin/realms/%s/users", k.config.KeycloakURL, k.realm)
 	payload, err := json.Marshal(user)
 	if err != nil {
 		return nil, err
@@ -166,17 +716,53 @@ func (k *KeycloakService) CreateUser(user models.User) (*models.User, error) {
 	// Successful creation may return 201 or 204.
 	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to create user, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		return nil, &KeycloakError{Operation: "create user", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	// Keycloak does not return the created object, but it points to it in the Location header.
+	// Some proxies strip that header, in which case the input user is returned unchanged.
+	if id := idFromLocation(resp.Header.Get("Location")); id != "" {
+		user.ID = id
 	}
-	// Return the input user as Keycloak does not return the created object.
 	return &user, nil
 }
 
+// CreateUsers creates several users through CreateUser, in parallel bounded by Config.KeycloakConcurrency.
+// A failing user does not stop the others.
+// Input: Slice of models.User to create.
+// Output: Two slices aligned with the input: the created user (nil on failure) and the error (nil on success).
+func (k *KeycloakService) CreateUsers(users []models.User) ([]*models.User, []error) {
+	created := make([]*models.User, len(users))
+	errs := make([]error, len(users))
+	// Each goroutine writes only its own index, so no locking is needed and order is preserved.
+	var g errgroup.Group
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, user := range users {
+		i, user := i, user
+		g.Go(func() error {
+			created[i], errs[i] = k.CreateUser(user)
+			return nil
+		})
+	}
+	g.Wait()
+	return created, errs
+}
+
+// idFromLocation extracts the trailing resource ID from a Location header value such as
+// "http://keycloak/admin/realms/master/users/<uuid>". It returns "" when location is empty.
+func idFromLocation(location string) string {
+	location = strings.TrimRight(location, "/")
+	if location == "" {
+		return ""
+	}
+	return location[strings.LastIndex(location, "/")+1:]
+}
+
 // GetUser retrieves a user by ID from Keycloak.
 // Input: User ID (string).
-// Output: Pointer to models.User if found; error otherwise.
+// Output: Pointer to models.User if found; error otherwise. Only the error returned when the user does not exist
+// matches ErrNotFound; any other Keycloak status is a *KeycloakError to be reported as an upstream failure.
 func (k *KeycloakService) GetUser(id string) (*models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.realm, id)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -189,7 +775,8 @@ func (k *KeycloakService) GetUser(id string) (*models.User, error) {
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("user not found, status: %d", resp.StatusCode)
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "get user", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 	var user models.User
 	if err := json.NewDecoder(resp.Body).Decode(&user); err != nil {
@@ -198,12 +785,78 @@ func (k *KeycloakService) GetUser(id string) (*models.User, error) {
 	return &user, nil
 }
 
-// SearchUserByEmail retrieves users from Keycloak matching the provided email.
-// Input: email (string) to search for.
+// GetUserDetails retrieves a user together with its groups and realm roles, fetched concurrently.
+// Failing to load the groups or the roles does not fail the call: that section is left empty and
+// the error is recorded in UserDetails.Errors. Failing to load the user itself is returned as an error.
+// Input: User ID (string).
+// Output: Pointer to models.UserDetails if the user was found; error otherwise.
+func (k *KeycloakService) GetUserDetails(id string) (*models.UserDetails, error) {
+	var (
+		wg                           sync.WaitGroup
+		user                         *models.User
+		groups                       []models.Group
+		roles                        []models.Role
+		userErr, groupsErr, rolesErr error
+	)
+	wg.Add(3)
+	go func() {
+		defer wg.Done()
+		user, userErr = k.GetUser(id)
+	}()
+	go func() {
+		defer wg.Done()
+		groups, groupsErr = k.ListUserGroups(id)
+	}()
+	go func() {
+		defer wg.Done()
+		roles, rolesErr = k.ListUserRealmRoles(id)
+	}()
+	wg.Wait()
+
+	if userErr != nil {
+		return nil, userErr
+	}
+	details := &models.UserDetails{User: *user, Groups: groups, Roles: roles}
+	for section, err := range map[string]error{"groups": groupsErr, "roles": rolesErr} {
+		if err == nil {
+			continue
+		}
+		log.Warn().Err(err).Str("userId", id).Msgf("Unable to load %s for user details", section)
+		if details.Errors == nil {
+			details.Errors = map[string]string{}
+		}
+		details.Errors[section] = err.Error()
+	}
+	if groupsErr != nil {
+		details.Groups = nil
+	}
+	if rolesErr != nil {
+		details.Roles = nil
+	}
+	return details, nil
+}
+
+// UserSearchFields lists the query parameters accepted by SearchUsers, matching Keycloak's /users search.
+// "search" matches any of username, email, first name and last name.
+var UserSearchFields = []string{"search", "username", "email", "firstName", "lastName"}
+
+// SearchUsers retrieves users from Keycloak matching all of the provided criteria.
+// Input: params mapping fields from UserSearchFields to values; other keys and empty values are ignored.
 // Output: A slice of models.User if found; error otherwise.
-func (k *KeycloakService) SearchUserByEmail(email string) ([]models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users?email=%s", k.config.KeycloakURL, k.config.KeycloakRealm, email)
-	req, err := http.NewRequest("GET", url, nil)
+func (k *KeycloakService) SearchUsers(params map[string]string) ([]models.User, error) {
+	query := url.Values{}
+	for _, field := range UserSearchFields {
+		if value := params[field]; value != "" {
+			query.Set(field, value)
+		}
+	}
+	return k.queryUsers(query)
+}
+
+// queryUsers lists the users matching the given Keycloak /users query parameters.
+func (k *KeycloakService) queryUsers(query url.Values) ([]models.User, error) {
+	endpoint := fmt.Sprintf("%s/admin/realms/%s/users?%s", k.config.KeycloakURL, k.realm, query.Encode())
+	req, err := http.NewRequest("GET", endpoint, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -221,11 +874,7 @@ func (k *KeycloakService) SearchUserByEmail(email string) ([]models.User, error)
 
 	// Check for non-OK status and return error if necessary.
 	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("failed to search users: status %d, unable to parse error", resp.StatusCode)
-		}
-		return nil, fmt.Errorf("failed to search users: %v", errResp)
+		return nil, &KeycloakError{Operation: "search users", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
 	// Unmarshal the response into a slice of models.User.
@@ -237,20 +886,66 @@ func (k *KeycloakService) SearchUserByEmail(email string) ([]models.User, error)
 	return users, nil
 }
 
-// UpdateUser updates an existing user in Keycloak.
-// Input: User ID (string) and models.User containing updated data.
-// Output: Pointer to updated models.User on success; error otherwise.
-func (k *KeycloakService) UpdateUser(id string, user models.User) (*models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
-	payload, err := json.Marshal(user)
+// SearchUserByEmail retrieves users from Keycloak matching the provided email.
+// Input: email (string) to search for.
+// Output: A slice of models.User if found; error otherwise.
+func (k *KeycloakService) SearchUserByEmail(email string) ([]models.User, error) {
+	return k.SearchUsers(map[string]string{"email": email})
+}
+
+// GetUserByUsername retrieves the user with exactly the given username. The search uses Keycloak's
+// exact mode, so "jsmith" does not also match "jsmith2".
+// Input: username (string).
+// Output: Pointer to models.User; ErrUserNotFound or ErrAmbiguousUser (wrapped) if not exactly one user matches.
+func (k *KeycloakService) GetUserByUsername(username string) (*models.User, error) {
+	users, err := k.queryUsers(url.Values{"username": {username}, "exact": {"true"}})
+	if err != nil {
+		return nil, fmt.Errorf("error searching user by username: %w", err)
+	}
+	// Keycloak versions without exact mode ignore the parameter and match by prefix; keep only exact matches.
+	// Usernames are stored in lower case, hence the case-insensitive comparison.
+	var matches []models.User
+	for _, user := range users {
+		if strings.EqualFold(user.Username, username) {
+			matches = append(matches, user)
+		}
+	}
+	if len(matches) > 1 {
+		return nil, fmt.Errorf("%w with the provided username", ErrAmbiguousUser)
+	}
+	if len(matches) == 0 {
+		return nil, fmt.Errorf("%w with the provided username", ErrUserNotFound)
+	}
+	return &matches[0], nil
+}
+
+// UpdateUser updates an existing user in Keycloak, changing only the fields set in update.
+// Keycloak treats the body of a user update as the new representation (with the user profile enabled,
+// absent fields such as email or the attributes may be cleared), so the current representation is read
+// first, the fields set in update are merged into it and the whole of it is sent back. Fields this
+// service does not model are sent back unchanged. Attributes are merged as in UpdateUserAttributes.
+// The user is then read back so that the caller gets its full, current representation.
+// A change made to the user by someone else between the read and the update is overwritten.
+// Input: User ID (string) and models.UserUpdate containing the fields to change.
+// Output: Pointer to updated models.User on success; error otherwise (ErrFederatedUser if the user is read-only federated).
+func (k *KeycloakService) UpdateUser(id string, update models.UserUpdate) (*models.User, error) {
+	err := k.modifyUser(id, "update user", func(representation map[string]json.RawMessage) error {
+		return mergeUserUpdate(representation, update)
+	})
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	return k.GetUser(id)
+}
+
+// getUserRepresentation retrieves a user as Keycloak represents it, keeping the fields models.User
+// does not model, so that it can be sent back in an update without losing them.
+func (k *KeycloakService) getUserRepresentation(id string) (map[string]json.RawMessage, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.realm, id)
+	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
 	}
-	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := k.doRequest(req)
 	if err != nil {
@@ -258,22 +953,47 @@ func (k *KeycloakService) UpdateUser(id string, user models.User) (*models.User,
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to update user, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	return &user, nil
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "get user", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var representation map[string]json.RawMessage
+	if err := json.Unmarshal(body, &representation); err != nil {
+		log.Error().Msgf("Unable to decode response into a user representation: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return representation, nil
 }
 
-// DeleteUser deletes a user by ID in Keycloak.
-// Input: User ID (string).
-// Output: error if deletion fails; nil otherwise.
-func (k *KeycloakService) DeleteUser(id string) error {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
-	req, err := http.NewRequest("DELETE", url, nil)
+// modifyUser reads a user's representation, applies change to it and sends the whole of it back, as
+// Keycloak treats the body of a user update as the new representation (see UpdateUser).
+// Input: User ID (string), the operation named in a *KeycloakError and the change to apply.
+// Output: error if the operation fails (ErrFederatedUser if the user is read-only federated); nil otherwise.
+func (k *KeycloakService) modifyUser(id, operation string, change func(map[string]json.RawMessage) error) error {
+	// Groups with their users list the user as it was.
+	defer k.InvalidateGroupCache()
+	representation, err := k.getUserRepresentation(id)
+	if err != nil {
+		return err
+	}
+	if err := change(representation); err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.realm, id)
+	payload, err := json.Marshal(representation)
 	if err != nil {
 		return err
 	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := k.doRequest(req)
 	if err != nil {
@@ -283,106 +1003,174 @@ func (k *KeycloakService) DeleteUser(id string) error {
 
 	if resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to delete user, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		err := &KeycloakError{Operation: operation, StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		return k.checkFederatedUser(id, err)
 	}
 	return nil
 }
 
-// ---------------------- Group CRUD operations ----------------------
-
-// ListGroupsWithUsers retrieves all groups and for each group, fetches its associated users.
-// Output: a slice of models.GroupWithUsers; error otherwise.
-func (k *KeycloakService) ListGroupsWithUsers() ([]models.GroupWithUsers, error) {
-	groups, err := k.ListGroups()
+// mergeUserUpdate sets the fields present in update on a user representation. Attributes are merged
+// with the current ones by mergeAttributes; every other field present in update replaces the current value.
+func mergeUserUpdate(representation map[string]json.RawMessage, update models.UserUpdate) error {
+	// UserUpdate omits absent fields, so its JSON form holds exactly the fields to change.
+	payload, err := json.Marshal(update)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(payload, &fields); err != nil {
+		return err
+	}
+	delete(fields, "attributes")
+	for name, value := range fields {
+		representation[name] = value
 	}
 
-	var result []models.GroupWithUsers
-	for _, group := range groups {
-		users, err := k.ListGroupUsers(group.ID)
-		if err != nil {
-			return nil, fmt.Errorf("failed to get users for group %s: %v", group.ID, err)
+	if update.Attributes == nil {
+		return nil
+	}
+	var current map[string][]string
+	if raw, ok := representation["attributes"]; ok {
+		if err := json.Unmarshal(raw, &current); err != nil {
+			return fmt.Errorf("json: %v", err)
 		}
-		result = append(result, models.GroupWithUsers{
-			Group: group,
-			Users: users,
-		})
 	}
-	return result, nil
+	attributes, err := json.Marshal(mergeAttributes(current, update.Attributes))
+	if err != nil {
+		return err
+	}
+	representation["attributes"] = attributes
+	return nil
 }
 
-// ListGroups retrieves all groups from Keycloak.
-// Input: None.
-// Output: Slice of models.Group if successful; error otherwise.
-func (k *KeycloakService) ListGroups() ([]models.Group, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups", k.config.KeycloakURL, k.config.KeycloakRealm)
-	req, err := http.NewRequest("GET", url, nil)
+// mergeAttributes returns current with attrs applied: attributes present in attrs are overwritten, an
+// attribute given with no values is removed and the others are kept. current is not modified.
+func mergeAttributes(current, attrs map[string][]string) map[string][]string {
+	merged := make(map[string][]string, len(current)+len(attrs))
+	for name, values := range current {
+		merged[name] = values
+	}
+	for name, values := range attrs {
+		if len(values) == 0 {
+			delete(merged, name)
+			continue
+		}
+		merged[name] = values
+	}
+	return merged
+}
+
+// DeleteUser deletes a user by ID in Keycloak.
+// Input: User ID (string).
+// Output: error if deletion fails (ErrFederatedUser if the user is read-only federated); nil otherwise.
+func (k *KeycloakService) DeleteUser(id string) error {
+	defer k.InvalidateGroupCache()
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s", k.config.KeycloakURL, k.realm, id)
+	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	resp, err := k.doRequest(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		return nil, err
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		err := &KeycloakError{Operation: "delete user", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		return k.checkFederatedUser(id, err)
 	}
+	return nil
+}
 
-	// Check for non-OK status.
-	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("failed to list groups: status %d, unable to parse error", resp.StatusCode)
+// SetUserEnabled enables or disables a user in Keycloak without deleting it.
+// Only "enabled" is changed in the user's current representation, which is sent back whole so that
+// the rest of the user (email, attributes, etc.) is left untouched.
+// Input: User ID (string) and the desired enabled state (bool).
+// Output: error if the operation fails; nil otherwise.
+func (k *KeycloakService) SetUserEnabled(userID string, enabled bool) error {
+	return k.modifyUser(userID, "set user enabled", func(representation map[string]json.RawMessage) error {
+		value, err := json.Marshal(enabled)
+		if err != nil {
+			return err
 		}
-		return nil, fmt.Errorf("failed to list groups: %v", errResp)
-	}
+		representation["enabled"] = value
+		return nil
+	})
+}
 
-	var groups []models.Group
-	if err := json.Unmarshal(body, &groups); err != nil {
-		log.Error().Msgf("Unable to decode response into []models.Group: %s", string(body))
-		return nil, fmt.Errorf("json: %v", err)
+// UpdateUserAttributes merges attrs into a user's custom attributes in Keycloak.
+// Keycloak replaces the whole attribute map on update, so the current attributes are read first:
+// attributes present in attrs are overwritten, an attribute given with no values is removed and
+// the others are kept. The rest of the user's representation is sent back unchanged.
+// Input: User ID (string) and the attributes to set.
+// Output: The user's resulting attributes if successful; error otherwise.
+func (k *KeycloakService) UpdateUserAttributes(userID string, attrs map[string][]string) (map[string][]string, error) {
+	var merged map[string][]string
+	err := k.modifyUser(userID, "update user attributes", func(representation map[string]json.RawMessage) error {
+		var current map[string][]string
+		if raw, ok := representation["attributes"]; ok {
+			if err := json.Unmarshal(raw, &current); err != nil {
+				return fmt.Errorf("json: %v", err)
+			}
+		}
+		merged = mergeAttributes(current, attrs)
+		value, err := json.Marshal(merged)
+		if err != nil {
+			return err
+		}
+		representation["attributes"] = value
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return groups, nil
+	return merged, nil
 }
 
-// CreateGroup creates a new group in Keycloak.
-// Input: models.Group representing the group to create.
-// Output: Pointer to models.Group on success; error otherwise.
-func (k *KeycloakService) CreateGroup(group models.Group) (*models.Group, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups", k.config.KeycloakURL, k.config.KeycloakRealm)
-	payload, err := json.Marshal(group)
+// ResetPassword sets a new password credential for a user in Keycloak.
+// Input: User ID (string), the new password (string) and whether the user must change it on next login (bool).
+// Output: error if the operation fails; nil otherwise. A *KeycloakError with status 400 indicates
+// that Keycloak rejected the password (e.g. a password policy violation), while ErrFederatedUser
+// indicates the user's credentials are managed by a federation provider.
+func (k *KeycloakService) ResetPassword(userID string, newPassword string, temporary bool) error {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/reset-password", k.config.KeycloakURL, k.realm, userID)
+	credential := models.Credential{
+		Type:      "password",
+		Value:     newPassword,
+		Temporary: temporary,
+	}
+	payload, err := json.Marshal(credential)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
 	if err != nil {
-		return nil, err
+		return err
 	}
 	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := k.doRequest(req)
 	if err != nil {
-		return nil, err
+		return err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to create group, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		err := &KeycloakError{Operation: "reset password", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		return k.checkFederatedUser(userID, err)
 	}
-	return &group, nil
+	return nil
 }
 
-// GetGroup retrieves a group by ID from Keycloak.
-// Input: Group ID (string).
-// Output: Pointer to models.Group if found; error otherwise.
-func (k *KeycloakService) GetGroup(id string) (*models.Group, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
+// ListUserCredentials retrieves the credentials stored for a user in Keycloak.
+// Input: User ID (string).
+// Output: Slice of models.CredentialMetadata (without secret or key material) if successful; error otherwise.
+func (k *KeycloakService) ListUserCredentials(userID string) ([]models.CredentialMetadata, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/credentials", k.config.KeycloakURL, k.realm, userID)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -394,49 +1182,62 @@ func (k *KeycloakService) GetGroup(id string) (*models.Group, error) {
 	}
 	defer resp.Body.Close()
 
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("group not found, status: %d", resp.StatusCode)
+		return nil, &KeycloakError{Operation: "list user credentials", StatusCode: resp.StatusCode, Body: string(body)}
 	}
-	var group models.Group
-	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
-		return nil, err
+
+	// Decoding into models.CredentialMetadata drops credentialData, which holds the public key.
+	var credentials []models.CredentialMetadata
+	if err := json.Unmarshal(body, &credentials); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.CredentialMetadata: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
 	}
-	return &group, nil
+	return credentials, nil
 }
 
-// UpdateGroup updates an existing group in Keycloak.
-// Input: Group ID (string) and models.Group with updated data.
-// Output: Pointer to models.Group on success; error otherwise.
-func (k *KeycloakService) UpdateGroup(id string, group models.Group) (*models.Group, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
-	payload, err := json.Marshal(group)
+// ListPasskeys retrieves the WebAuthn credentials ("webauthn" and "webauthn-passwordless") of a user.
+// Input: User ID (string).
+// Output: Slice of models.CredentialMetadata (possibly empty) if successful; error otherwise.
+func (k *KeycloakService) ListPasskeys(userID string) ([]models.CredentialMetadata, error) {
+	credentials, err := k.ListUserCredentials(userID)
 	if err != nil {
 		return nil, err
 	}
-	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
-	if err != nil {
-		return nil, err
+	passkeys := []models.CredentialMetadata{}
+	for _, credential := range credentials {
+		if credential.IsPasskey() {
+			passkeys = append(passkeys, credential)
+		}
 	}
-	req.Header.Add("Content-Type", "application/json")
+	return passkeys, nil
+}
 
-	resp, err := k.doRequest(req)
+// RemovePasskey deletes a WebAuthn credential of a user in Keycloak.
+// The credential is looked up first so that other credential types (e.g. passwords) cannot be removed through it.
+// Input: User ID and credential ID (both strings).
+// Output: ErrCredentialNotFound if the user has no such passkey; other error if the operation fails; nil otherwise.
+func (k *KeycloakService) RemovePasskey(userID, credentialID string) error {
+	passkeys, err := k.ListPasskeys(userID)
 	if err != nil {
-		return nil, err
+		return err
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusNoContent {
-		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return nil, fmt.Errorf("failed to update group, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+	found := false
+	for _, passkey := range passkeys {
+		if passkey.ID == credentialID {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return fmt.Errorf("%w: no passkey %s for user %s", ErrCredentialNotFound, credentialID, userID)
 	}
-	return &group, nil
-}
 
-// DeleteGroup deletes a group by ID in Keycloak.
-// Input: Group ID (string).
-// Output: error if deletion fails; nil otherwise.
-func (k *KeycloakService) DeleteGroup(id string) error {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.config.KeycloakRealm, id)
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/credentials/%s", k.config.KeycloakURL, k.realm, userID, credentialID)
 	req, err := http.NewRequest("DELETE", url, nil)
 	if err != nil {
 		return err
@@ -450,18 +1251,34 @@ func (k *KeycloakService) DeleteGroup(id string) error {
 
 	if resp.StatusCode != http.StatusNoContent {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to delete group, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		return &KeycloakError{Operation: "remove passkey", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 	return nil
 }
 
-// ---------------------- Membership functions ----------------------
+// checkFederatedUser inspects a failed mutating operation on a user. When Keycloak rejected the
+// change (400/403) and the user is linked to a user federation provider, it returns an error wrapping
+// ErrFederatedUser so callers can report that the edit must be made in the federated directory.
+// Otherwise the original error is returned unchanged.
+func (k *KeycloakService) checkFederatedUser(userID string, err error) error {
+	var kcErr *KeycloakError
+	if !errors.As(err, &kcErr) || (kcErr.StatusCode != http.StatusBadRequest && kcErr.StatusCode != http.StatusForbidden) {
+		return err
+	}
+	user, getErr := k.GetUser(userID)
+	if getErr != nil || !user.IsFederated() {
+		return err
+	}
+	return fmt.Errorf("%w: user %s is linked to federation provider %s (%v)", ErrFederatedUser, userID, user.FederationLink, err)
+}
 
-// ListUserGroups retrieves all groups a given user is a member of from Keycloak.
+// ---------------------- User sessions ----------------------
+
+// ListUserSessions retrieves the active sessions of a user from Keycloak.
 // Input: User ID (string).
-// Output: Slice of models.Group if successful; error otherwise.
-func (k *KeycloakService) ListUserGroups(userID string) ([]models.Group, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups", k.config.KeycloakURL, k.config.KeycloakRealm, userID)
+// Output: Slice of models.Session (empty if the user has no session); error otherwise.
+func (k *KeycloakService) ListUserSessions(userID string) ([]models.Session, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/sessions", k.config.KeycloakURL, k.realm, userID)
 	req, err := http.NewRequest("GET", url, nil)
 	if err != nil {
 		return nil, err
@@ -479,27 +1296,24 @@ func (k *KeycloakService) ListUserGroups(userID string) ([]models.Group, error)
 	}
 
 	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("failed to list user groups: status %d, unable to parse error", resp.StatusCode)
-		}
-		return nil, fmt.Errorf("failed to list user groups: %v", errResp)
+		return nil, &KeycloakError{Operation: "list user sessions", StatusCode: resp.StatusCode, Body: string(body)}
 	}
 
-	var groups []models.Group
-	if err := json.Unmarshal(body, &groups); err != nil {
-		log.Error().Msgf("Unable to decode response into []models.Group: %s", string(body))
+	sessions := []models.Session{}
+	if err := json.Unmarshal(body, &sessions); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.Session: %s", string(body))
 		return nil, fmt.Errorf("json: %v", err)
 	}
-	return groups, nil
+	return sessions, nil
 }
 
-// AddUserToGroup assigns a user to a specific group in Keycloak.
-// Input: User ID and Group ID (both strings).
+// LogoutUser ends all active sessions of a user in Keycloak.
+// Keycloak answers 204 whether or not the user had sessions, so the call is idempotent.
+// Input: User ID (string).
 // Output: error if the operation fails; nil otherwise.
-func (k *KeycloakService) AddUserToGroup(userID string, groupID string) error {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups/%s", k.config.KeycloakURL, k.config.KeycloakRealm, userID, groupID)
-	req, err := http.NewRequest("PUT", url, nil)
+func (k *KeycloakService) LogoutUser(userID string) error {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/logout", k.config.KeycloakURL, k.realm, userID)
+	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
 		return err
 	}
@@ -510,42 +1324,147 @@ func (k *KeycloakService) AddUserToGroup(userID string, groupID string) error {
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to add user to group, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		return &KeycloakError{Operation: "logout user", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
 	}
 	return nil
 }
 
-// AddUserToGroupByEmail searches for a user by the provided email and, if exactly one user is found,
-// adds that user to the specified group.
-// Input: email (string) and groupID (string).
-// Output: error if the operation fails; nil otherwise.
-func (k *KeycloakService) AddUserToGroupByEmail(email, groupID string) error {
-	// Search for the user by email.
-	users, err := k.SearchUserByEmail(email)
+// ImpersonateUser opens a Keycloak session on behalf of a user, as the "Impersonate" action of the
+// admin console does. The session is carried by the returned cookies; whoever holds them acts as the user.
+// Keycloak answers 403 when the calling account may not impersonate the user (for whatever reason) and
+// 404 when the feature is disabled on the server, which is told apart from a missing user by looking the user up.
+// Input: User ID (string).
+// Output: Pointer to models.ImpersonationResult if successful; an error wrapping ErrImpersonationForbidden
+// or ErrImpersonationDisabled when impersonation is refused; error otherwise.
+func (k *KeycloakService) ImpersonateUser(userID string) (*models.ImpersonationResult, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/impersonation", k.config.KeycloakURL, k.realm, userID)
+	req, err := http.NewRequest("POST", url, nil)
 	if err != nil {
-		return fmt.Errorf("error searching user by email: %v", err)
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
 	}
-	if len(users) == 0 {
-		return fmt.Errorf("no user found with the provided email")
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	if len(users) > 1 {
-		return fmt.Errorf("multiple users found with the provided email")
+
+	if resp.StatusCode != http.StatusOK {
+		kcErr := &KeycloakError{Operation: "impersonate user", StatusCode: resp.StatusCode, Body: string(body)}
+		switch resp.StatusCode {
+		case http.StatusForbidden:
+			return nil, fmt.Errorf("%w (%v)", ErrImpersonationForbidden, kcErr)
+		case http.StatusNotFound:
+			// A missing user is reported as such; an existing one means the endpoint itself is disabled.
+			if _, getErr := k.GetUser(userID); getErr != nil {
+				return nil, getErr
+			}
+			return nil, fmt.Errorf("%w (%v)", ErrImpersonationDisabled, kcErr)
+		}
+		return nil, kcErr
 	}
-	// Use the found user's ID to add the user to the group.
-	return k.AddUserToGroup(users[0].ID, groupID)
+
+	result := &models.ImpersonationResult{}
+	if err := json.Unmarshal(body, result); err != nil {
+		log.Error().Msgf("Unable to decode response into models.ImpersonationResult: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	result.Cookies = []models.SessionCookie{}
+	for _, cookie := range resp.Cookies() {
+		sessionCookie := models.SessionCookie{Name: cookie.Name, Value: cookie.Value, Path: cookie.Path}
+		if !cookie.Expires.IsZero() {
+			sessionCookie.Expires = cookie.Expires.Unix()
+		}
+		result.Cookies = append(result.Cookies, sessionCookie)
+	}
+	return result, nil
 }
 
-// RemoveUserFromGroup removes a user from a specific group in Keycloak.
-// Input: User ID and Group ID (both strings).
-// Output: error if the operation fails; nil otherwise.
-func (k *KeycloakService) RemoveUserFromGroup(userID string, groupID string) error {
-	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups/%s", k.config.KeycloakURL, k.config.KeycloakRealm, userID, groupID)
-	req, err := http.NewRequest("DELETE", url, nil)
+// ---------------------- Required actions ----------------------
+
+// ListRequiredActions retrieves the aliases of the required actions enabled in the realm,
+// i.e. the values accepted by ExecuteActionsEmail.
+// Input: None.
+// Output: Slice of action aliases (e.g. "VERIFY_EMAIL") if successful; error otherwise.
+func (k *KeycloakService) ListRequiredActions() ([]string, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/authentication/required-actions", k.config.KeycloakURL, k.realm)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	// Reading the realm's authentication flows requires view-realm, which end users lack.
+	resp, err := k.asAdmin().doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list required actions", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var actions []models.RequiredAction
+	if err := json.Unmarshal(body, &actions); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.RequiredAction: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	aliases := []string{}
+	for _, action := range actions {
+		if action.Enabled {
+			aliases = append(aliases, action.Alias)
+		}
+	}
+	return aliases, nil
+}
+
+// SetRequiredActions replaces the actions a user must perform at the next login (e.g. UPDATE_PASSWORD)
+// without emailing them. Only "requiredActions" is changed in the user's current representation, which
+// is sent back whole so that the rest of the user is left untouched; an empty list clears the pending actions.
+// Input: User ID (string) and the required action aliases.
+// Output: error if the operation fails (ErrFederatedUser if the user is read-only federated); nil otherwise.
+func (k *KeycloakService) SetRequiredActions(userID string, actions []string) error {
+	if actions == nil {
+		// A nil slice would be encoded as null, which Keycloak treats as "unchanged".
+		actions = []string{}
+	}
+	return k.modifyUser(userID, "set required actions", func(representation map[string]json.RawMessage) error {
+		value, err := json.Marshal(actions)
+		if err != nil {
+			return err
+		}
+		representation["requiredActions"] = value
+		return nil
+	})
+}
+
+// ExecuteActionsEmail sends the user an email with a link to perform the given required actions.
+// Input: User ID (string) and the action aliases (e.g. "UPDATE_PASSWORD", "VERIFY_EMAIL").
+// Output: error if the operation fails (wrapping ErrEmailNotSent if Keycloak could not send the
+// email, typically because SMTP is not configured in the realm); nil otherwise.
+func (k *KeycloakService) ExecuteActionsEmail(userID string, actions []string) error {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/execute-actions-email", k.config.KeycloakURL, k.realm, userID)
+	payload, err := json.Marshal(actions)
 	if err != nil {
 		return err
 	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
 
 	resp, err := k.doRequest(req)
 	if err != nil {
@@ -553,43 +1472,848 @@ func (k *KeycloakService) RemoveUserFromGroup(userID string, groupID string) err
 	}
 	defer resp.Body.Close()
 
-	if resp.StatusCode != http.StatusNoContent {
+	if resp.StatusCode != http.StatusNoContent && resp.StatusCode != http.StatusOK {
 		bodyBytes, _ := ioutil.ReadAll(resp.Body)
-		return fmt.Errorf("failed to remove user from group, status: %d, response: %s", resp.StatusCode, string(bodyBytes))
+		kcErr := &KeycloakError{Operation: "execute actions email", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		// Keycloak answers 500 "Failed to send execute actions email" when the realm's SMTP server
+		// is missing or rejects the message.
+		if resp.StatusCode == http.StatusInternalServerError && strings.Contains(kcErr.Body, "Failed to send") {
+			return fmt.Errorf("%w: %w", ErrEmailNotSent, kcErr)
+		}
+		return kcErr
 	}
 	return nil
 }
 
-// ListGroupUsers retrieves all users that are members of a specific group in Keycloak.
-// Input: Group ID (string).
-// Output: Slice of models.User if successful; error otherwise.
-func (k *KeycloakService) ListGroupUsers(groupID string) ([]models.User, error) {
-	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s/members", k.config.KeycloakURL, k.config.KeycloakRealm, groupID)
-	req, err := http.NewRequest("GET", url, nil)
+// ---------------------- Group CRUD operations ----------------------
+
+// ListGroupsWithUsers retrieves all groups and for each group, fetches its associated users.
+// It does not recurse into subgroups: only top-level groups get an entry and their members are
+// the direct members of that group. Subgroups are still visible through each Group's SubGroups field.
+// Member lookups run in parallel, bounded by Config.KeycloakConcurrency, and the result keeps the
+// order of ListGroups. The first failing lookup cancels the remaining ones and its error is returned.
+// The result is cached for Config.GroupCacheTTL when Config.GroupCacheEnabled is set.
+// Output: a slice of models.GroupWithUsers; error otherwise.
+func (k *KeycloakService) ListGroupsWithUsers() ([]models.GroupWithUsers, error) {
+	cached, err := k.cachedGroupListing(groupsWithUsersCacheKey, func() (interface{}, error) {
+		return k.listGroupsWithUsers()
+	})
 	if err != nil {
 		return nil, err
 	}
+	// Copy the slice so that callers may reorder it without altering the cached listing.
+	return append([]models.GroupWithUsers(nil), cached.([]models.GroupWithUsers)...), nil
+}
 
-	resp, err := k.doRequest(req)
+// listGroupsWithUsers is ListGroupsWithUsers without the cache.
+func (k *KeycloakService) listGroupsWithUsers() ([]models.GroupWithUsers, error) {
+	groups, err := k.ListGroups()
 	if err != nil {
 		return nil, err
 	}
-	defer resp.Body.Close()
 
-	body, err := ioutil.ReadAll(resp.Body)
+	// Each goroutine writes only its own index, so no locking is needed and order is preserved.
+	result := make([]models.GroupWithUsers, len(groups))
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, group := range groups {
+		i, group := i, group
+		g.Go(func() error {
+			users, err := k.listGroupUsers(ctx, group.ID, false)
+			if err != nil {
+				return fmt.Errorf("failed to get users for group %s: %w", group.ID, err)
+			}
+			result[i] = models.GroupWithUsers{
+				Group: group,
+				Users: users,
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// concurrencyLimit normalizes a configured concurrency value, treating unset or invalid values as 1.
+func concurrencyLimit(configured int) int {
+	if configured < 1 {
+		return 1
+	}
+	return configured
+}
+
+// ListGroupsWithMemberCounts retrieves all groups and counts the direct members of each one.
+// Counting is done in parallel, bounded by Config.KeycloakConcurrency, and the result keeps the order of ListGroups.
+// Output: a slice of models.GroupWithMemberCount; error otherwise.
+func (k *KeycloakService) ListGroupsWithMemberCounts() ([]models.GroupWithMemberCount, error) {
+	groups, err := k.ListGroups()
 	if err != nil {
 		return nil, err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		var errResp map[string]interface{}
-		if err := json.Unmarshal(body, &errResp); err != nil {
-			return nil, fmt.Errorf("failed to list group users: status %d, unable to parse error", resp.StatusCode)
+	result := make([]models.GroupWithMemberCount, len(groups))
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, group := range groups {
+		i, group := i, group
+		g.Go(func() error {
+			count, err := k.countGroupMembers(ctx, group.ID)
+			if err != nil {
+				return fmt.Errorf("failed to count members of group %s: %w", group.ID, err)
+			}
+			result[i] = models.GroupWithMemberCount{Group: group, MemberCount: count}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// CountGroupMembers counts the direct members of a group without returning them.
+// Input: Group ID (string).
+// Output: The number of direct members if successful; error otherwise (a *KeycloakError with status 404 if the group does not exist).
+func (k *KeycloakService) CountGroupMembers(groupID string) (int, error) {
+	return k.countGroupMembers(context.Background(), groupID)
+}
+
+// countGroupMembers counts the direct members of a group. Keycloak has no count endpoint for
+// group members, so the brief member representation is paged through until a short page is returned.
+func (k *KeycloakService) countGroupMembers(ctx context.Context, groupID string) (int, error) {
+	baseURL := fmt.Sprintf("%s/admin/realms/%s/groups/%s/members", k.config.KeycloakURL, k.realm, groupID)
+	count := 0
+	for first := 0; ; first += userPageSize {
+		url := fmt.Sprintf("%s?briefRepresentation=true&first=%d&max=%d", baseURL, first, userPageSize)
+		req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+		if err != nil {
+			return 0, err
+		}
+
+		resp, err := k.doRequest(req)
+		if err != nil {
+			return 0, err
+		}
+		body, err := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		if err != nil {
+			return 0, err
+		}
+
+		if resp.StatusCode != http.StatusOK {
+			return 0, &KeycloakError{Operation: "count group members", StatusCode: resp.StatusCode, Body: string(body)}
+		}
+
+		// Only the number of entries matters, so decode into raw messages.
+		var page []json.RawMessage
+		if err := json.Unmarshal(body, &page); err != nil {
+			return 0, fmt.Errorf("json: %v", err)
+		}
+		count += len(page)
+		if len(page) < userPageSize {
+			return count, nil
 		}
-		return nil, fmt.Errorf("failed to list group users: %v", errResp)
 	}
+}
 
-	var users []models.User
+// ListGroups retrieves all groups from Keycloak.
+// The result is cached for Config.GroupCacheTTL when Config.GroupCacheEnabled is set.
+// Input: None.
+// Output: Slice of models.Group if successful; error otherwise.
+func (k *KeycloakService) ListGroups() ([]models.Group, error) {
+	cached, err := k.cachedGroupListing(groupsCacheKey, func() (interface{}, error) {
+		return k.listGroups()
+	})
+	if err != nil {
+		return nil, err
+	}
+	// Copy the slice so that callers may reorder it without altering the cached listing.
+	return append([]models.Group(nil), cached.([]models.Group)...), nil
+}
+
+// listGroups is ListGroups without the cache.
+func (k *KeycloakService) listGroups() ([]models.Group, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/groups", k.config.KeycloakURL, k.realm)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	// Check for non-OK status.
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list groups", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var groups []models.Group
+	if err := json.Unmarshal(body, &groups); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.Group: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return groups, nil
+}
+
+// CreateGroup creates a new group in Keycloak.
+// Input: models.Group representing the group to create.
+// Output: Pointer to models.Group on success; error otherwise.
+func (k *KeycloakService) CreateGroup(group models.Group) (*models.Group, error) {
+	defer k.InvalidateGroupCache()
+	url := fmt.Sprintf("%s/admin/realms/%s/groups", k.config.KeycloakURL, k.realm)
+	payload, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "create group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return &group, nil
+}
+
+// CreateSubGroup creates a new child group under the given parent group in Keycloak.
+// Input: Parent group ID (string) and models.Group representing the child group to create.
+// Output: Pointer to models.Group on success (with the ID taken from the Location header when present); error otherwise.
+func (k *KeycloakService) CreateSubGroup(parentID string, group models.Group) (*models.Group, error) {
+	defer k.InvalidateGroupCache()
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s/children", k.config.KeycloakURL, k.realm, parentID)
+	payload, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("POST", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusCreated && resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "create subgroup", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	if id := idFromLocation(resp.Header.Get("Location")); id != "" {
+		group.ID = id
+	}
+	return &group, nil
+}
+
+// ListSubGroups retrieves the direct child groups of a group from Keycloak.
+// Input: Parent group ID (string).
+// Output: Slice of models.Group if successful; error otherwise.
+func (k *KeycloakService) ListSubGroups(parentID string) ([]models.Group, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s/children", k.config.KeycloakURL, k.realm, parentID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list subgroups", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var groups []models.Group
+	if err := json.Unmarshal(body, &groups); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.Group: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return groups, nil
+}
+
+// GetGroup retrieves a group by ID from Keycloak.
+// Input: Group ID (string).
+// Output: Pointer to models.Group if found; error otherwise. Only the error returned when the group does not exist
+// matches ErrNotFound; any other Keycloak status is a *KeycloakError to be reported as an upstream failure.
+func (k *KeycloakService) GetGroup(id string) (*models.Group, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.realm, id)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "get group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	var group models.Group
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// GetGroupByPath retrieves a group by its full path (e.g. "/engineering/backend") from Keycloak.
+// Leading and trailing slashes are optional; each segment is escaped, so names may contain spaces.
+// Input: Group path (string).
+// Output: Pointer to models.Group if found; error otherwise (a *KeycloakError with status 404 if no group has that path).
+func (k *KeycloakService) GetGroupByPath(path string) (*models.Group, error) {
+	segments := strings.Split(strings.Trim(path, "/"), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	endpoint := fmt.Sprintf("%s/admin/realms/%s/group-by-path/%s", k.config.KeycloakURL, k.realm, strings.Join(segments, "/"))
+	req, err := http.NewRequest("GET", endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "get group by path", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	var group models.Group
+	if err := json.NewDecoder(resp.Body).Decode(&group); err != nil {
+		return nil, err
+	}
+	return &group, nil
+}
+
+// UpdateGroup updates an existing group in Keycloak.
+// Input: Group ID (string) and models.Group with updated data.
+// Output: Pointer to models.Group on success; error otherwise.
+func (k *KeycloakService) UpdateGroup(id string, group models.Group) (*models.Group, error) {
+	defer k.InvalidateGroupCache()
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.realm, id)
+	payload, err := json.Marshal(group)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest("PUT", url, bytes.NewBuffer(payload))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "update group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return &group, nil
+}
+
+// DeleteGroup deletes a group by ID in Keycloak.
+// Input: Group ID (string).
+// Output: error if deletion fails; nil otherwise.
+func (k *KeycloakService) DeleteGroup(id string) error {
+	defer k.InvalidateGroupCache()
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s", k.config.KeycloakURL, k.realm, id)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return &KeycloakError{Operation: "delete group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return nil
+}
+
+// ---------------------- Membership functions ----------------------
+
+// ListUserGroups retrieves all groups a given user is a member of from Keycloak.
+// Input: User ID (string).
+// Output: Slice of models.Group if successful; error otherwise.
+func (k *KeycloakService) ListUserGroups(userID string) ([]models.Group, error) {
+	return k.listUserGroups(context.Background(), userID)
+}
+
+// userGroupPageSize is the number of groups requested per page when paging through a user's groups.
+// Keycloak returns at most 100 groups per call when no page is given.
+const userGroupPageSize = 100
+
+// listUserGroups is ListUserGroups bound to ctx, so parallel lookups can be cancelled.
+func (k *KeycloakService) listUserGroups(ctx context.Context, userID string) ([]models.Group, error) {
+	var groups []models.Group
+	for first := 0; ; first += userGroupPageSize {
+		page, err := k.listUserGroupsPage(ctx, userID, first)
+		if err != nil {
+			return nil, err
+		}
+		groups = append(groups, page...)
+		if len(page) < userGroupPageSize {
+			return groups, nil
+		}
+	}
+}
+
+// listUserGroupsPage retrieves one page of the groups a user is a direct member of.
+func (k *KeycloakService) listUserGroupsPage(ctx context.Context, userID string, first int) ([]models.Group, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups?first=%d&max=%d",
+		k.config.KeycloakURL, k.realm, userID, first, userGroupPageSize)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list user groups", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var groups []models.Group
+	if err := json.Unmarshal(body, &groups); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.Group: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return groups, nil
+}
+
+// MembershipMatrix builds a flat user -> group paths mapping for the whole realm (e.g. for access reviews).
+// Users are paged through with ListAllUsers and their groups are fetched in parallel, bounded by
+// Config.KeycloakConcurrency. Rows keep the order in which Keycloak lists the users.
+// Input: None.
+// Output: Slice of models.UserMemberships (one per user) if successful; error otherwise.
+func (k *KeycloakService) MembershipMatrix() ([]models.UserMemberships, error) {
+	users, _, err := k.ListAllUsers(UserFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]models.UserMemberships, len(users))
+	g, ctx := errgroup.WithContext(context.Background())
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, user := range users {
+		i, user := i, user
+		g.Go(func() error {
+			groups, err := k.listUserGroups(ctx, user.ID)
+			if err != nil {
+				return fmt.Errorf("failed to get groups for user %s: %w", user.ID, err)
+			}
+			paths := make([]string, 0, len(groups))
+			for _, group := range groups {
+				paths = append(paths, group.Path)
+			}
+			rows[i] = models.UserMemberships{
+				UserID:   user.ID,
+				Username: user.Username,
+				Email:    user.Email,
+				Groups:   paths,
+			}
+			return nil
+		})
+	}
+	if err := g.Wait(); err != nil {
+		return nil, err
+	}
+	return rows, nil
+}
+
+// AddUserToGroup assigns a user to a specific group in Keycloak.
+// Input: User ID and Group ID (both strings).
+// Output: error if the operation fails (ErrUserNotFound / ErrGroupNotFound if either does not exist); nil otherwise.
+func (k *KeycloakService) AddUserToGroup(userID string, groupID string) error {
+	defer k.InvalidateGroupCache()
+	if k.config.MembershipPrevalidate {
+		if err := k.checkMembershipTargets(userID, groupID); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups/%s", k.config.KeycloakURL, k.realm, userID, groupID)
+	req, err := http.NewRequest("PUT", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		err := &KeycloakError{Operation: "add user to group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		return membershipError(userID, groupID, err)
+	}
+	return nil
+}
+
+// EnsureUserInGroup makes a user a member of a group, treating an existing membership as success so
+// that reruns (e.g. of an onboarding script) are harmless. Membership is checked before the change,
+// which is skipped when the user already is a member, and again after it, so that a change Keycloak
+// acknowledged (or rejected as a conflict) without the user ending up in the group is reported.
+// Input: User ID and Group ID (both strings).
+// Output: Whether the user was added (false if already a member); error if the user is not a member
+// afterwards (ErrUserNotFound / ErrGroupNotFound if either does not exist).
+func (k *KeycloakService) EnsureUserInGroup(userID string, groupID string) (bool, error) {
+	member, err := k.isGroupMember(userID, groupID)
+	if err != nil || member {
+		return false, err
+	}
+	if err := k.AddUserToGroup(userID, groupID); err != nil {
+		// Some Keycloak versions answer 409 when the membership already exists (e.g. a concurrent add);
+		// the check below decides whether that is a failure.
+		var kcErr *KeycloakError
+		if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusConflict {
+			return false, err
+		}
+	}
+	member, err = k.isGroupMember(userID, groupID)
+	if err != nil {
+		return false, fmt.Errorf("error verifying membership of user %s in group %s: %w", userID, groupID, err)
+	}
+	if !member {
+		return false, fmt.Errorf("user %s is not a member of group %s after being added", userID, groupID)
+	}
+	return true, nil
+}
+
+// IsUserInGroup reports whether a user is a direct member of a group. The user's groups are paged
+// through and the lookup stops at the page containing the group, so users in many groups are handled
+// without fetching all of them. The group is only looked up when the user is not a member of it.
+// Input: User ID and Group ID (both strings).
+// Output: Whether the user is a member of the group; error otherwise (ErrUserNotFound / ErrGroupNotFound
+// if either does not exist).
+func (k *KeycloakService) IsUserInGroup(userID string, groupID string) (bool, error) {
+	member, err := k.isGroupMember(userID, groupID)
+	if err != nil || member {
+		return member, err
+	}
+	if _, err := k.GetGroup(groupID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return false, fmt.Errorf("%w with ID %s", ErrGroupNotFound, groupID)
+		}
+		return false, err
+	}
+	return false, nil
+}
+
+// isGroupMember reports whether a user is a direct member of a group, paging through the user's groups
+// until the group is found.
+func (k *KeycloakService) isGroupMember(userID, groupID string) (bool, error) {
+	for first := 0; ; first += userGroupPageSize {
+		page, err := k.listUserGroupsPage(context.Background(), userID, first)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return false, fmt.Errorf("%w with ID %s", ErrUserNotFound, userID)
+			}
+			return false, err
+		}
+		for _, group := range page {
+			if group.ID == groupID {
+				return true, nil
+			}
+		}
+		if len(page) < userGroupPageSize {
+			return false, nil
+		}
+	}
+}
+
+// AddUserToGroups adds a user to several groups through AddUserToGroup, in parallel bounded by
+// Config.KeycloakConcurrency. A failing group does not stop the others.
+// Input: User ID (string) and the group IDs.
+// Output: The error of each group (nil on success), aligned with groupIDs.
+func (k *KeycloakService) AddUserToGroups(userID string, groupIDs []string) []error {
+	errs := make([]error, len(groupIDs))
+	// Each goroutine writes only its own index, so no locking is needed and order is preserved.
+	var g errgroup.Group
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, groupID := range groupIDs {
+		i, groupID := i, groupID
+		g.Go(func() error {
+			errs[i] = k.AddUserToGroup(userID, groupID)
+			return nil
+		})
+	}
+	g.Wait()
+	return errs
+}
+
+// FindUserByEmail resolves the single user registered with the given email.
+// Keycloak's search index may lag right after a user is created, so when the search returns no
+// result it is retried up to Config.EmailLookupRetries times, waiting Config.EmailLookupRetryDelay in between.
+// Input: email (string).
+// Output: Pointer to models.User; ErrUserNotFound or ErrAmbiguousUser (wrapped) if not exactly one user matches.
+func (k *KeycloakService) FindUserByEmail(email string) (*models.User, error) {
+	for attempt := 0; ; attempt++ {
+		users, err := k.SearchUserByEmail(email)
+		if err != nil {
+			return nil, fmt.Errorf("error searching user by email: %w", err)
+		}
+		if len(users) > 1 {
+			return nil, fmt.Errorf("%w with the provided email", ErrAmbiguousUser)
+		}
+		if len(users) == 1 {
+			return &users[0], nil
+		}
+		if attempt >= k.config.EmailLookupRetries {
+			return nil, fmt.Errorf("%w with the provided email", ErrUserNotFound)
+		}
+		log.Info().Msgf("No user found for email yet, retrying lookup (attempt %d)", attempt+1)
+		time.Sleep(k.config.EmailLookupRetryDelay)
+	}
+}
+
+// AddUserToGroupByEmail searches for a user by the provided email and, if exactly one user is found,
+// adds that user to the specified group.
+// Input: email (string) and groupID (string).
+// Output: error if the operation fails (ErrUserNotFound / ErrAmbiguousUser when the email does not
+// resolve to exactly one user); nil otherwise.
+func (k *KeycloakService) AddUserToGroupByEmail(email, groupID string) error {
+	// Search for the user by email.
+	user, err := k.FindUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	// Use the found user's ID to add the user to the group.
+	return k.AddUserToGroup(user.ID, groupID)
+}
+
+// AddUserToGroupByEmailAndPath is AddUserToGroupByEmail with the group given by its path
+// (e.g. "/engineering/backend") instead of its ID.
+// Input: email (string) and group path (string).
+// Output: error if the operation fails (ErrUserNotFound / ErrAmbiguousUser when the email does not
+// resolve to exactly one user, ErrGroupNotFound when no group has that path); nil otherwise.
+func (k *KeycloakService) AddUserToGroupByEmailAndPath(email, groupPath string) error {
+	user, err := k.FindUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	group, err := k.GetGroupByPath(groupPath)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w with path %s", ErrGroupNotFound, groupPath)
+		}
+		return err
+	}
+	return k.AddUserToGroup(user.ID, group.ID)
+}
+
+// RemoveUserFromGroup removes a user from a specific group in Keycloak.
+// Input: User ID and Group ID (both strings).
+// Output: error if the operation fails (ErrUserNotFound / ErrGroupNotFound if either does not exist); nil otherwise.
+func (k *KeycloakService) RemoveUserFromGroup(userID string, groupID string) error {
+	defer k.InvalidateGroupCache()
+	if k.config.MembershipPrevalidate {
+		if err := k.checkMembershipTargets(userID, groupID); err != nil {
+			return err
+		}
+	}
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/groups/%s", k.config.KeycloakURL, k.realm, userID, groupID)
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		err := &KeycloakError{Operation: "remove user from group", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+		return membershipError(userID, groupID, err)
+	}
+	return nil
+}
+
+// RemoveUserFromAllGroups removes a user from every group it is a direct member of (e.g. when offboarding),
+// through RemoveUserFromGroup, in parallel bounded by Config.KeycloakConcurrency. A failing group does not
+// stop the others.
+// Input: User ID (string).
+// Output: The groups the user was a member of and the error of each removal (nil on success), aligned with
+// them; error if the groups cannot be listed (ErrUserNotFound if the user does not exist).
+func (k *KeycloakService) RemoveUserFromAllGroups(userID string) ([]models.Group, []error, error) {
+	groups, err := k.ListUserGroups(userID)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil, fmt.Errorf("%w with ID %s", ErrUserNotFound, userID)
+		}
+		return nil, nil, err
+	}
+	errs := make([]error, len(groups))
+	// Each goroutine writes only its own index, so no locking is needed and order is preserved.
+	var g errgroup.Group
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, group := range groups {
+		i, groupID := i, group.ID
+		g.Go(func() error {
+			errs[i] = k.RemoveUserFromGroup(userID, groupID)
+			return nil
+		})
+	}
+	g.Wait()
+	return groups, errs, nil
+}
+
+// MoveUserBetweenGroups transfers a user from one group to another without ever leaving the user in
+// neither group: the user is added to the destination first and only then removed from the source.
+//   - If adding to the destination fails, the source membership is left untouched.
+//   - If removing from the source fails, the addition is rolled back (best effort) so the user ends up
+//     as before the move; should the rollback fail too, the user is left in both groups and the error says so.
+//     A user who was already in the destination before the move keeps that membership: only a membership
+//     created by the move is rolled back.
+//
+// Input: User ID, source group ID and destination group ID (strings).
+// Output: error if the move did not complete; nil otherwise.
+func (k *KeycloakService) MoveUserBetweenGroups(userID, fromGroupID, toGroupID string) error {
+	alreadyMember, err := k.IsUserInGroup(userID, toGroupID)
+	if err != nil {
+		return err
+	}
+	if !alreadyMember {
+		if err := k.AddUserToGroup(userID, toGroupID); err != nil {
+			return err
+		}
+	}
+	removeErr := k.RemoveUserFromGroup(userID, fromGroupID)
+	if removeErr == nil || alreadyMember {
+		return removeErr
+	}
+	if rollbackErr := k.RemoveUserFromGroup(userID, toGroupID); rollbackErr != nil {
+		log.Error().Err(rollbackErr).Str("userId", userID).Str("groupId", toGroupID).
+			Msg("Unable to roll back group move, user is left in both groups")
+		return fmt.Errorf("user %s is now in both groups %s and %s: %w", userID, fromGroupID, toGroupID, removeErr)
+	}
+	return removeErr
+}
+
+// checkMembershipTargets verifies that both the user and the group of a membership change exist,
+// for deployments that prefer an extra lookup over relying on Keycloak's error messages
+// (Config.MembershipPrevalidate).
+func (k *KeycloakService) checkMembershipTargets(userID, groupID string) error {
+	if _, err := k.GetUser(userID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w with ID %s", ErrUserNotFound, userID)
+		}
+		return err
+	}
+	if _, err := k.GetGroup(groupID); err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return fmt.Errorf("%w with ID %s", ErrGroupNotFound, groupID)
+		}
+		return err
+	}
+	return nil
+}
+
+// membershipError refines a failed membership change. Keycloak answers 404 both for an unknown
+// user and for an unknown group and only tells them apart in the error message of the body.
+func membershipError(userID, groupID string, err *KeycloakError) error {
+	if err.StatusCode != http.StatusNotFound {
+		return err
+	}
+	body := strings.ToLower(err.Body)
+	switch {
+	case strings.Contains(body, "user not found"):
+		return fmt.Errorf("%w with ID %s", ErrUserNotFound, userID)
+	case strings.Contains(body, "group not found"):
+		return fmt.Errorf("%w with ID %s", ErrGroupNotFound, groupID)
+	}
+	return err
+}
+
+// ListGroupUsers retrieves all users that are members of a specific group in Keycloak.
+// Input: Group ID (string) and whether to request Keycloak's brief user representation (see models.User).
+// Output: Slice of models.User if successful; error otherwise.
+func (k *KeycloakService) ListGroupUsers(groupID string, brief bool) ([]models.User, error) {
+	return k.listGroupUsers(context.Background(), groupID, brief)
+}
+
+// listGroupUsers is ListGroupUsers bound to ctx, so parallel lookups can be cancelled.
+func (k *KeycloakService) listGroupUsers(ctx context.Context, groupID string, brief bool) ([]models.User, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/groups/%s/members", k.config.KeycloakURL, k.realm, groupID)
+	if brief {
+		url += "?briefRepresentation=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list group users", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var users []models.User
 	if err := json.Unmarshal(body, &users); err != nil {
 		log.Error().Msgf("Unable to decode response into []models.User: %s", string(body))
 		return nil, fmt.Errorf("json: %v", err)
@@ -597,11 +2321,359 @@ func (k *KeycloakService) ListGroupUsers(groupID string) ([]models.User, error)
 	return users, nil
 }
 
+// ---------------------- Role functions ----------------------
+
+// GetRealmRole retrieves a realm role by name from Keycloak.
+// Input: Role name (string).
+// Output: Pointer to models.Role if found; error otherwise (a *KeycloakError with status 404 if the role does not exist).
+func (k *KeycloakService) GetRealmRole(roleName string) (*models.Role, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/roles/%s", k.config.KeycloakURL, k.realm, url.PathEscape(roleName))
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return nil, &KeycloakError{Operation: "get realm role", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	var role models.Role
+	if err := json.NewDecoder(resp.Body).Decode(&role); err != nil {
+		return nil, err
+	}
+	return &role, nil
+}
+
+// ListUserRealmRoles retrieves the realm roles directly assigned to a user in Keycloak.
+// Input: User ID (string).
+// Output: Slice of models.Role if successful; error otherwise.
+func (k *KeycloakService) ListUserRealmRoles(userID string) ([]models.Role, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/role-mappings/realm", k.config.KeycloakURL, k.realm, userID)
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "list user realm roles", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var roles []models.Role
+	if err := json.Unmarshal(body, &roles); err != nil {
+		log.Error().Msgf("Unable to decode response into []models.Role: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return roles, nil
+}
+
+// AddRealmRoleToUser assigns a realm role to a user in Keycloak.
+// The role representation is resolved by name first, as Keycloak's role-mapping endpoint requires it.
+// Input: User ID and role name (both strings).
+// Output: error if the operation fails; nil otherwise.
+func (k *KeycloakService) AddRealmRoleToUser(userID, roleName string) error {
+	return k.changeUserRealmRole("POST", "add realm role to user", userID, roleName)
+}
+
+// RemoveRealmRoleFromUser removes a realm role from a user in Keycloak.
+// Input: User ID and role name (both strings).
+// Output: error if the operation fails; nil otherwise.
+func (k *KeycloakService) RemoveRealmRoleFromUser(userID, roleName string) error {
+	return k.changeUserRealmRole("DELETE", "remove realm role from user", userID, roleName)
+}
+
+// changeUserRealmRole resolves roleName and sends it to the user's realm role-mapping endpoint
+// with the given method (POST to add, DELETE to remove).
+func (k *KeycloakService) changeUserRealmRole(method, operation, userID, roleName string) error {
+	role, err := k.GetRealmRole(roleName)
+	if err != nil {
+		return err
+	}
+
+	url := fmt.Sprintf("%s/admin/realms/%s/users/%s/role-mappings/realm", k.config.KeycloakURL, k.realm, userID)
+	payload, err := json.Marshal([]models.Role{*role})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(method, url, bytes.NewBuffer(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Add("Content-Type", "application/json")
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return &KeycloakError{Operation: operation, StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return nil
+}
+
+// ListUsersWithRealmRole retrieves every user that has the given realm role assigned directly.
+// Input: Role name (string).
+// Output: Slice of models.User if successful; error otherwise (a *KeycloakError with status 404 if the role does not exist).
+func (k *KeycloakService) ListUsersWithRealmRole(roleName string) ([]models.User, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/roles/%s/users", k.config.KeycloakURL, k.realm, url.PathEscape(roleName))
+	return k.listAllUserPages(url, "list users with realm role")
+}
+
+// DeleteRealmRole deletes a realm role by name in Keycloak. Users holding the role lose it.
+// Input: Role name (string).
+// Output: error if deletion fails; nil otherwise.
+func (k *KeycloakService) DeleteRealmRole(roleName string) error {
+	url := fmt.Sprintf("%s/admin/realms/%s/roles/%s", k.config.KeycloakURL, k.realm, url.PathEscape(roleName))
+	req, err := http.NewRequest("DELETE", url, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusNoContent {
+		bodyBytes, _ := ioutil.ReadAll(resp.Body)
+		return &KeycloakError{Operation: "delete realm role", StatusCode: resp.StatusCode, Body: string(bodyBytes)}
+	}
+	return nil
+}
+
+// ---------------------- Default assignments ----------------------
+
+// BackfillDefaults ensures every user of the realm has the realm roles in Config.DefaultRoles and
+// belongs to the groups in Config.DefaultGroups. Only missing assignments are added, so running it
+// again is harmless. Users are processed in parallel, bounded by Config.KeycloakConcurrency, and a
+// failing user does not stop the others.
+// Output: Pointer to models.BackfillResult listing the changed and failed users; error if the users
+// cannot be listed or a default role or group does not exist.
+func (k *KeycloakService) BackfillDefaults() (*models.BackfillResult, error) {
+	result := &models.BackfillResult{Changes: []models.BackfillChange{}}
+	if len(k.config.DefaultRoles) == 0 && len(k.config.DefaultGroups) == 0 {
+		return result, nil
+	}
+	// Fail before touching any user if the configuration references unknown roles or groups.
+	for _, roleName := range k.config.DefaultRoles {
+		if _, err := k.GetRealmRole(roleName); err != nil {
+			return nil, fmt.Errorf("default role %s: %w", roleName, err)
+		}
+	}
+	for _, groupID := range k.config.DefaultGroups {
+		if _, err := k.GetGroup(groupID); err != nil {
+			return nil, fmt.Errorf("default group %s: %w", groupID, err)
+		}
+	}
+
+	users, _, err := k.ListAllUsers(UserFilter{})
+	if err != nil {
+		return nil, err
+	}
+
+	// Each goroutine writes only its own index, so no locking is needed and order is preserved.
+	changes := make([]models.BackfillChange, len(users))
+	var g errgroup.Group
+	g.SetLimit(concurrencyLimit(k.config.KeycloakConcurrency))
+	for i, user := range users {
+		i, user := i, user
+		g.Go(func() error {
+			changes[i] = k.backfillUserDefaults(user)
+			return nil
+		})
+	}
+	g.Wait()
+
+	result.UsersScanned = len(users)
+	for _, change := range changes {
+		switch {
+		case change.Error != "":
+			result.UsersFailed++
+		case len(change.AddedRoles) > 0 || len(change.AddedGroups) > 0:
+			result.UsersChanged++
+		default:
+			continue
+		}
+		result.Changes = append(result.Changes, change)
+	}
+	return result, nil
+}
+
+// backfillUserDefaults adds the default roles and groups a single user is missing.
+// Assignments made before an error are still reported.
+func (k *KeycloakService) backfillUserDefaults(user models.User) models.BackfillChange {
+	change := models.BackfillChange{UserID: user.ID, Username: user.Username}
+
+	roles, err := k.ListUserRealmRoles(user.ID)
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+	hasRole := make(map[string]bool, len(roles))
+	for _, role := range roles {
+		hasRole[role.Name] = true
+	}
+	for _, roleName := range k.config.DefaultRoles {
+		if hasRole[roleName] {
+			continue
+		}
+		if err := k.AddRealmRoleToUser(user.ID, roleName); err != nil {
+			change.Error = err.Error()
+			return change
+		}
+		change.AddedRoles = append(change.AddedRoles, roleName)
+	}
+
+	groups, err := k.ListUserGroups(user.ID)
+	if err != nil {
+		change.Error = err.Error()
+		return change
+	}
+	inGroup := make(map[string]bool, len(groups))
+	for _, group := range groups {
+		inGroup[group.ID] = true
+	}
+	for _, groupID := range k.config.DefaultGroups {
+		if inGroup[groupID] {
+			continue
+		}
+		if err := k.AddUserToGroup(user.ID, groupID); err != nil {
+			change.Error = err.Error()
+			return change
+		}
+		change.AddedGroups = append(change.AddedGroups, groupID)
+	}
+	return change
+}
+
+// ---------------------- User storage functions ----------------------
+
+// SyncUserStorage triggers a synchronization of a user storage provider (e.g. LDAP) in Keycloak.
+// Input: the provider component ID (string) and the sync action, either "triggerFullSync" or
+// "triggerChangedUsersSync".
+// Output: Pointer to models.SyncResult describing the synchronization; error otherwise.
+func (k *KeycloakService) SyncUserStorage(componentID, action string) (*models.SyncResult, error) {
+	url := fmt.Sprintf("%s/admin/realms/%s/user-storage/%s/sync?action=%s", k.config.KeycloakURL, k.realm, componentID, action)
+	req, err := http.NewRequest("POST", url, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := k.doRequest(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, &KeycloakError{Operation: "sync user storage", StatusCode: resp.StatusCode, Body: string(body)}
+	}
+
+	var result models.SyncResult
+	if err := json.Unmarshal(body, &result); err != nil {
+		log.Error().Msgf("Unable to decode response into models.SyncResult: %s", string(body))
+		return nil, fmt.Errorf("json: %v", err)
+	}
+	return &result, nil
+}
+
+// ---------------------- Realm selection ----------------------
+
+// ForRealm returns a KeycloakService whose Admin API calls target realm instead of the configured one,
+// e.g. to serve a tenant living in its own realm. It shares the admin session of k, so the admin user
+// must be allowed to manage realm: only users of the master realm can manage other realms.
+// Input: Realm name (string); empty means the realm targeted by k.
+// Output: k itself when realm is empty or already targeted; a lightweight copy otherwise.
+func (k *KeycloakService) ForRealm(realm string) *KeycloakService {
+	if realm == "" || realm == k.realm {
+		return k
+	}
+	return &KeycloakService{adminSession: k.adminSession, realm: realm, callerToken: k.callerToken}
+}
+
+// WithCallerToken returns a KeycloakService making its Admin API calls with token, the caller's own
+// Keycloak access token, instead of the admin token, so that Keycloak enforces the caller's permissions
+// and records the caller in its admin events. It targets the same realm as k.
+// Input: Caller's access token (string); empty means the admin token.
+// Output: k itself when it already uses that token; a lightweight copy otherwise.
+func (k *KeycloakService) WithCallerToken(token string) *KeycloakService {
+	if token == k.callerToken {
+		return k
+	}
+	return &KeycloakService{adminSession: k.adminSession, realm: k.realm, callerToken: token}
+}
+
+// WithScope returns a KeycloakService targeting the realm of scope with its caller token, as ForRealm and
+// WithCallerToken do.
+func (k *KeycloakService) WithScope(scope Scope) *KeycloakService {
+	return k.ForRealm(scope.Realm).WithCallerToken(scope.CallerToken)
+}
+
+// ScopedUsers implements UserProvider with WithScope.
+func (k *KeycloakService) ScopedUsers(scope Scope) UserProvider {
+	return k.WithScope(scope)
+}
+
+// ScopedGroups implements GroupProvider with WithScope.
+func (k *KeycloakService) ScopedGroups(scope Scope) GroupProvider {
+	return k.WithScope(scope)
+}
+
+// ScopedMemberships implements MembershipProvider with WithScope.
+func (k *KeycloakService) ScopedMemberships(scope Scope) MembershipProvider {
+	return k.WithScope(scope)
+}
+
+// ScopedRoles implements RoleProvider with WithScope.
+func (k *KeycloakService) ScopedRoles(scope Scope) RoleProvider {
+	return k.WithScope(scope)
+}
+
+// asAdmin returns k making its calls with the admin token, for operations that read realm configuration
+// callers are usually not allowed to see.
+func (k *KeycloakService) asAdmin() *KeycloakService {
+	return k.WithCallerToken("")
+}
+
+// Realm returns the realm targeted by the Admin API calls of k.
+func (k *KeycloakService) Realm() string {
+	return k.realm
+}
+
 // ---------------------- Testing Helpers ----------------------
 
 // SetToken allows overriding the admin token (useful for testing).
+// Its expiry is unknown, so it is only renewed once Keycloak rejects it.
 func (k *KeycloakService) SetToken(token string) {
+	k.tokenMu.Lock()
+	defer k.tokenMu.Unlock()
 	k.token = token
+	k.tokenExpiry = time.Time{}
 }
 
 // SetClient allows overriding the HTTP client (useful for testing).
@@ -0,0 +1,109 @@
+package services
+
+import "ms-user/models"
+
+// The interfaces below describe the subsets of KeycloakService each HTTP handler depends on.
+// Handlers accept them instead of the concrete type so they can be unit-tested with hand-written mocks.
+
+// Scope selects the realm and the credentials of a provider's calls for one request. The zero value
+// keeps the provider's own realm and the admin token.
+type Scope struct {
+	Realm       string // Realm the calls target; "" for the provider's own realm.
+	CallerToken string // Caller's Keycloak access token, used instead of the admin token; "" for the admin token.
+}
+
+// UserProvider covers user CRUD, lifecycle and credential operations.
+type UserProvider interface {
+	// ScopedUsers returns the provider making its calls in scope.
+	ScopedUsers(scope Scope) UserProvider
+	ListUsers(filter UserFilter, max int) ([]models.User, int, error)
+	ListUsersPage(filter UserFilter, first, max int) ([]models.User, error)
+	CountUsers() (int, error)
+	CreateUser(user models.User) (*models.User, error)
+	CreateUsers(users []models.User) ([]*models.User, []error)
+	GetUser(id string) (*models.User, error)
+	GetUserDetails(id string) (*models.UserDetails, error)
+	SearchUsers(params map[string]string) ([]models.User, error)
+	GetUserByUsername(username string) (*models.User, error)
+	UpdateUser(id string, update models.UserUpdate) (*models.User, error)
+	DeleteUser(id string) error
+	SetUserEnabled(userID string, enabled bool) error
+	UpdateUserAttributes(userID string, attrs map[string][]string) (map[string][]string, error)
+	ResetPassword(userID string, newPassword string, temporary bool) error
+	ListPasskeys(userID string) ([]models.CredentialMetadata, error)
+	RemovePasskey(userID, credentialID string) error
+	ListUserSessions(userID string) ([]models.Session, error)
+	LogoutUser(userID string) error
+	ImpersonateUser(userID string) (*models.ImpersonationResult, error)
+	ListRequiredActions() ([]string, error)
+	ExecuteActionsEmail(userID string, actions []string) error
+	SetRequiredActions(userID string, actions []string) error
+}
+
+// GroupProvider covers group CRUD and hierarchy operations.
+type GroupProvider interface {
+	// ScopedGroups returns the provider making its calls in scope.
+	ScopedGroups(scope Scope) GroupProvider
+	ListGroups() ([]models.Group, error)
+	ListGroupsWithUsers() ([]models.GroupWithUsers, error)
+	ListGroupsWithMemberCounts() ([]models.GroupWithMemberCount, error)
+	CountGroupMembers(groupID string) (int, error)
+	CreateGroup(group models.Group) (*models.Group, error)
+	CreateSubGroup(parentID string, group models.Group) (*models.Group, error)
+	ListSubGroups(parentID string) ([]models.Group, error)
+	GetGroup(id string) (*models.Group, error)
+	GetGroupByPath(path string) (*models.Group, error)
+	UpdateGroup(id string, group models.Group) (*models.Group, error)
+	DeleteGroup(id string) error
+}
+
+// MembershipProvider covers user-group membership operations.
+type MembershipProvider interface {
+	// ScopedMemberships returns the provider making its calls in scope.
+	ScopedMemberships(scope Scope) MembershipProvider
+	ListUserGroups(userID string) ([]models.Group, error)
+	IsUserInGroup(userID string, groupID string) (bool, error)
+	AddUserToGroup(userID string, groupID string) error
+	EnsureUserInGroup(userID string, groupID string) (bool, error)
+	AddUserToGroups(userID string, groupIDs []string) []error
+	AddUserToGroupByEmail(email, groupID string) error
+	AddUserToGroupByEmailAndPath(email, groupPath string) error
+	RemoveUserFromGroup(userID string, groupID string) error
+	RemoveUserFromAllGroups(userID string) ([]models.Group, []error, error)
+	MoveUserBetweenGroups(userID, fromGroupID, toGroupID string) error
+	ListGroupUsers(groupID string, brief bool) ([]models.User, error)
+	MembershipMatrix() ([]models.UserMemberships, error)
+}
+
+// RoleProvider covers realm role operations.
+type RoleProvider interface {
+	// ScopedRoles returns the provider making its calls in scope.
+	ScopedRoles(scope Scope) RoleProvider
+	ListUserRealmRoles(userID string) ([]models.Role, error)
+	AddRealmRoleToUser(userID, roleName string) error
+	RemoveRealmRoleFromUser(userID, roleName string) error
+	ListUsersWithRealmRole(roleName string) ([]models.User, error)
+	DeleteRealmRole(roleName string) error
+}
+
+// AdminProvider covers administrative operations.
+type AdminProvider interface {
+	SyncUserStorage(componentID, action string) (*models.SyncResult, error)
+	SelfTest() models.SelfTestReport
+	BackfillDefaults() (*models.BackfillResult, error)
+}
+
+// HealthChecker covers connectivity checks against Keycloak.
+type HealthChecker interface {
+	Ping() error
+}
+
+// Compile-time checks that KeycloakService implements every provider interface.
+var (
+	_ UserProvider       = (*KeycloakService)(nil)
+	_ GroupProvider      = (*KeycloakService)(nil)
+	_ MembershipProvider = (*KeycloakService)(nil)
+	_ RoleProvider       = (*KeycloakService)(nil)
+	_ AdminProvider      = (*KeycloakService)(nil)
+	_ HealthChecker      = (*KeycloakService)(nil)
+)
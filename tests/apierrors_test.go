@@ -0,0 +1,76 @@
+package tests
+
+import (
+	"encoding/json"
+	"ms-user/apierrors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newErrorRouter returns a router with a single route that always fails with 404.
+func newErrorRouter() *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/users/:id", func(c *gin.Context) {
+		apierrors.Respond(c, http.StatusNotFound, apierrors.CodeUserNotFound, "user not found")
+	})
+	return r
+}
+
+// Test for the simple error format
+func TestRespondSimpleFormat(t *testing.T) {
+	apierrors.SetFormat(apierrors.FormatSimple)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/42", nil)
+	newErrorRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+	var body map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+		t.Fatalf("expected JSON body, got %v", err)
+	}
+	if body["code"] != apierrors.CodeUserNotFound || body["message"] != "user not found" {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+	if _, ok := body["details"]; ok {
+		t.Fatalf("expected details to be omitted, got %s", w.Body.String())
+	}
+}
+
+// Test for the RFC 7807 problem+json error format
+func TestRespondProblemFormat(t *testing.T) {
+	apierrors.SetFormat(apierrors.FormatProblem)
+	defer apierrors.SetFormat(apierrors.FormatSimple)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/42", nil)
+	newErrorRouter().ServeHTTP(w, req)
+
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected status 404, got %d", w.Code)
+	}
+	if ct := w.Header().Get("Content-Type"); ct != "application/problem+json" {
+		t.Fatalf("expected application/problem+json, got %q", ct)
+	}
+	var problem apierrors.Problem
+	if err := json.Unmarshal(w.Body.Bytes(), &problem); err != nil {
+		t.Fatalf("expected JSON body, got %v", err)
+	}
+	expected := apierrors.Problem{
+		Type:     apierrors.ProblemTypeBaseURI + "user-not-found",
+		Title:    "Not Found",
+		Status:   http.StatusNotFound,
+		Detail:   "user not found",
+		Instance: "/ms-user/v1/users/42",
+		Code:     apierrors.CodeUserNotFound,
+	}
+	if problem != expected {
+		t.Fatalf("unexpected problem: %+v", problem)
+	}
+}
@@ -0,0 +1,106 @@
+package tests
+
+import (
+	"ms-user/config"
+	"testing"
+	"time"
+)
+
+// validConfig returns a configuration that passes validation.
+func validConfig() config.Config {
+	return config.Config{
+		KeycloakURL:      "https://keycloak.example.com",
+		KeycloakRealm:    "master",
+		KeycloakUsername: "svc-ms-user",
+		KeycloakPassword: "s3cret",
+		ErrorFormat:      "simple",
+		Port:             18080,
+		BasePath:         "ms-user/v1",
+		ShutdownTimeout:  20 * time.Second,
+	}
+}
+
+// Test for Config.Validate
+func TestConfigValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		mutate  func(cfg *config.Config)
+		wantErr bool
+	}{
+		{"valid", func(cfg *config.Config) {}, false},
+		{"empty url", func(cfg *config.Config) { cfg.KeycloakURL = "" }, true},
+		{"relative url", func(cfg *config.Config) { cfg.KeycloakURL = "keycloak:8080" }, true},
+		{"unsupported scheme", func(cfg *config.Config) { cfg.KeycloakURL = "ftp://keycloak" }, true},
+		{"unparseable url", func(cfg *config.Config) { cfg.KeycloakURL = "http://[::1" }, true},
+		{"empty realm", func(cfg *config.Config) { cfg.KeycloakRealm = "" }, true},
+		{"additional realms", func(cfg *config.Config) { cfg.KeycloakRealms = []string{"tenant-a", "tenant-b"} }, false},
+		{"additional realms outside master", func(cfg *config.Config) {
+			cfg.KeycloakRealm, cfg.KeycloakRealms = "tenant-a", []string{"tenant-b"}
+		}, true},
+		{"empty username", func(cfg *config.Config) { cfg.KeycloakUsername = "" }, true},
+		{"unknown error format", func(cfg *config.Config) { cfg.ErrorFormat = "xml" }, true},
+		{"port zero", func(cfg *config.Config) { cfg.Port = 0 }, true},
+		{"port out of range", func(cfg *config.Config) { cfg.Port = 70000 }, true},
+		{"zero shutdown timeout", func(cfg *config.Config) { cfg.ShutdownTimeout = 0 }, true},
+		{"negative max retries", func(cfg *config.Config) { cfg.KeycloakMaxRetries = -1 }, true},
+		{"negative token timeout", func(cfg *config.Config) { cfg.KeycloakTokenTimeout = -time.Second }, true},
+		{"group cache", func(cfg *config.Config) { cfg.GroupCacheEnabled, cfg.GroupCacheTTL = true, 30*time.Second }, false},
+		{"group cache without ttl", func(cfg *config.Config) { cfg.GroupCacheEnabled = true }, true},
+		{"negative rate limit", func(cfg *config.Config) { cfg.RateLimitRPS = -1 }, true},
+		{"rate limit without burst", func(cfg *config.Config) { cfg.RateLimitRPS, cfg.RateLimitBurst = 10, 0 }, true},
+		{"rate limit", func(cfg *config.Config) { cfg.RateLimitRPS, cfg.RateLimitBurst = 10, 20 }, false},
+		{"trusted proxies", func(cfg *config.Config) { cfg.TrustedProxies = []string{"10.0.0.1", "172.16.0.0/12"} }, false},
+		{"invalid trusted proxy", func(cfg *config.Config) { cfg.TrustedProxies = []string{"proxy.local"} }, true},
+		{"impersonation token", func(cfg *config.Config) { cfg.ImpersonationToken = "impersonate" }, false},
+		{"impersonation token reused", func(cfg *config.Config) { cfg.AuthToken, cfg.ImpersonationToken = "token", "token" }, true},
+		{"public base url", func(cfg *config.Config) { cfg.PublicBaseURL = "https://api.example.com" }, false},
+		{"relative public base url", func(cfg *config.Config) { cfg.PublicBaseURL = "api.example.com" }, true},
+	}
+	for _, tt := range tests {
+		cfg := validConfig()
+		tt.mutate(&cfg)
+		err := cfg.Validate()
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: expected error=%v, got %v", tt.name, tt.wantErr, err)
+		}
+	}
+}
+
+// Test for Config.UsesDefaultCredentials
+func TestConfigUsesDefaultCredentials(t *testing.T) {
+	cfg := validConfig()
+	if cfg.UsesDefaultCredentials() {
+		t.Fatalf("expected custom credentials not to be reported as default")
+	}
+	cfg.KeycloakUsername, cfg.KeycloakPassword = "admin", "admin"
+	if !cfg.UsesDefaultCredentials() {
+		t.Fatalf("expected admin/admin to be reported as default")
+	}
+}
+
+// Test that the renamed GROUP_FETCH_CONCURRENCY is still read when KEYCLOAK_CONCURRENCY is not set
+func TestConfigRenamedConcurrencyVariable(t *testing.T) {
+	t.Setenv("GROUP_FETCH_CONCURRENCY", "3")
+	if cfg := config.LoadConfig(); cfg.KeycloakConcurrency != 3 {
+		t.Fatalf("expected GROUP_FETCH_CONCURRENCY to be used, got %d", cfg.KeycloakConcurrency)
+	}
+	if renamed := config.RenamedVariablesSet(); renamed["GROUP_FETCH_CONCURRENCY"] != "KEYCLOAK_CONCURRENCY" {
+		t.Fatalf("expected GROUP_FETCH_CONCURRENCY to be reported as renamed, got %v", renamed)
+	}
+
+	t.Setenv("KEYCLOAK_CONCURRENCY", "5")
+	if cfg := config.LoadConfig(); cfg.KeycloakConcurrency != 5 {
+		t.Fatalf("expected KEYCLOAK_CONCURRENCY to take precedence, got %d", cfg.KeycloakConcurrency)
+	}
+}
+
+// Test that rate limiting is on by default and that RATE_LIMIT_RPS=0 turns it off
+func TestConfigRateLimitDefault(t *testing.T) {
+	if cfg := config.LoadConfig(); cfg.RateLimitRPS <= 0 {
+		t.Fatalf("expected rate limiting to be enabled by default, got %g", cfg.RateLimitRPS)
+	}
+	t.Setenv("RATE_LIMIT_RPS", "0")
+	if cfg := config.LoadConfig(); cfg.RateLimitRPS != 0 {
+		t.Fatalf("expected RATE_LIMIT_RPS=0 to disable rate limiting, got %g", cfg.RateLimitRPS)
+	}
+}
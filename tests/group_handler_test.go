@@ -0,0 +1,465 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"ms-user/config"
+	"ms-user/handlers"
+	"ms-user/middleware"
+	"ms-user/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Test for listing groups sorted by member count
+func TestListGroupsSortedByMembers(t *testing.T) {
+	memberCounts := map[string]int{"1": 2, "2": 150, "3": 0}
+
+	// Test server simulating token endpoint, group listing and paged group members.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/members") {
+			groupID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/groups/"), "/members")
+			var first, max int
+			fmt.Sscan(r.URL.Query().Get("first"), &first)
+			fmt.Sscan(r.URL.Query().Get("max"), &max)
+			users := []models.User{}
+			for i := first; i < memberCounts[groupID] && i < first+max; i++ {
+				users = append(users, models.User{ID: fmt.Sprintf("u%d", i)})
+			}
+			resp, _ := json.Marshal(users)
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"1","name":"Small"},{"id":"2","name":"Large"},{"id":"3","name":"Empty"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	h := handlers.NewGroupHandler(newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups", h.ListGroups)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups?sort=members&order=desc", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var groups []models.GroupWithMemberCount
+	json.Unmarshal(w.Body.Bytes(), &groups)
+	if len(groups) != 3 {
+		t.Fatalf("expected 3 groups, got %d", len(groups))
+	}
+	expected := []struct {
+		name  string
+		count int
+	}{{"Large", 150}, {"Small", 2}, {"Empty", 0}}
+	for i, e := range expected {
+		if groups[i].Name != e.name || groups[i].MemberCount != e.count {
+			t.Fatalf("position %d: expected %s with %d members, got %+v", i, e.name, e.count, groups[i])
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups?sort=name", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for unsupported sort, got %d", w.Code)
+	}
+}
+
+// Test for retrieving groups by path through the group routes
+func TestGetGroupByPath(t *testing.T) {
+	var requestedPaths []string
+
+	// Test server simulating token endpoint and Keycloak's group-by-path endpoint.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		requestedPaths = append(requestedPaths, r.URL.EscapedPath())
+		if r.URL.Path == "/admin/realms/master/group-by-path/engineering/back end" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"g2","name":"back end","path":"/engineering/back end"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"error":"Group path does not exist"}`))
+	}))
+	defer testServer.Close()
+
+	h := handlers.NewGroupHandler(newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups/:id", h.GetGroup)
+	r.GET("/ms-user/v1/groups/by-path/*path", h.GetGroupByPath)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups/by-path/engineering/back%20end", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var group models.Group
+	json.Unmarshal(w.Body.Bytes(), &group)
+	if group.ID != "g2" {
+		t.Fatalf("unexpected group: %+v", group)
+	}
+	if requestedPaths[0] != "/admin/realms/master/group-by-path/engineering/back%20end" {
+		t.Fatalf("expected each segment to be escaped, got %s", requestedPaths[0])
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups/by-path/engineering/missing", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), "GROUP_NOT_FOUND") {
+		t.Fatalf("expected 404 GROUP_NOT_FOUND, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// Test for counting group members past Keycloak's default page size
+func TestCountGroupMembers(t *testing.T) {
+	const members = 250
+	pages := 0
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.URL.Path != "/admin/realms/master/groups/g1/members" {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Could not find group by id"}`))
+			return
+		}
+		pages++
+		var first, max int
+		fmt.Sscan(r.URL.Query().Get("first"), &first)
+		fmt.Sscan(r.URL.Query().Get("max"), &max)
+		users := []models.User{}
+		for i := first; i < members && i < first+max; i++ {
+			users = append(users, models.User{ID: fmt.Sprintf("u%d", i)})
+		}
+		resp, _ := json.Marshal(users)
+		w.Write(resp)
+	}))
+	defer testServer.Close()
+
+	h := handlers.NewGroupHandler(newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups/:id/members/count", h.CountGroupMembers)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups/g1/members/count", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"count":250}` {
+		t.Fatalf("expected a count of 250, got %d: %s", w.Code, w.Body.String())
+	}
+	if pages < 2 {
+		t.Fatalf("expected members to be paged through, got %d request(s)", pages)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups/missing/members/count", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown group, got %d", w.Code)
+	}
+}
+
+// Test that group listings are cached until a group changes and honor If-None-Match
+func TestListGroupsCacheAndETag(t *testing.T) {
+	var mu sync.Mutex
+	name, listCalls, memberCalls := "one", 0, 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups":
+			listCalls++
+			fmt.Fprintf(w, `[{"id":"g1","name":%q}]`, name)
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups/g1/members":
+			memberCalls++
+			w.Write([]byte(`[{"id":"u1","username":"one"}]`))
+		case r.Method == http.MethodPut && r.URL.Path == "/admin/realms/master/groups/g1":
+			name = "renamed"
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:       testServer.URL,
+		KeycloakRealm:     "master",
+		KeycloakUsername:  "admin",
+		KeycloakPassword:  "admin",
+		GroupCacheEnabled: true,
+		GroupCacheTTL:     time.Minute,
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+	h := handlers.NewGroupHandler(kcService)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups", h.ListGroups)
+	r.GET("/ms-user/v1/groups/with-users", h.ListGroupsWithUsers)
+	r.PUT("/ms-user/v1/groups/:id", h.UpdateGroup)
+
+	get := func(path, etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	first := get("/ms-user/v1/groups", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" {
+		t.Fatalf("expected 200 with an ETag, got %d (ETag %q)", first.Code, etag)
+	}
+	if second := get("/ms-user/v1/groups", ""); second.Header().Get("ETag") != etag || second.Body.String() != first.Body.String() {
+		t.Fatalf("expected an identical response, got %s (ETag %q)", second.Body.String(), second.Header().Get("ETag"))
+	}
+	if w := get("/ms-user/v1/groups", `"other", `+etag); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+		t.Fatalf("expected 304 without a body, got %d: %s", w.Code, w.Body.String())
+	}
+	if listCalls != 1 {
+		t.Fatalf("expected the group list to be fetched once, got %d call(s)", listCalls)
+	}
+
+	get("/ms-user/v1/groups/with-users", "")
+	get("/ms-user/v1/groups/with-users", "")
+	if memberCalls != 1 {
+		t.Fatalf("expected the members to be fetched once, got %d call(s)", memberCalls)
+	}
+
+	// Updating a group clears the cache, so the new name is listed and the old ETag no longer matches.
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/groups/g1", strings.NewReader(`{"name":"renamed"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected the update to succeed, got %d: %s", w.Code, w.Body.String())
+	}
+	w = get("/ms-user/v1/groups", etag)
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), "renamed") || w.Header().Get("ETag") == etag {
+		t.Fatalf("expected the renamed group with a new ETag, got %d: %s", w.Code, w.Body.String())
+	}
+	get("/ms-user/v1/groups/with-users", "")
+	if listCalls != 2 || memberCalls != 2 {
+		t.Fatalf("expected the listings to be fetched again after the update, got %d list and %d member call(s)", listCalls, memberCalls)
+	}
+}
+
+// Test that the X-Realm header selects the realm of group requests, within the configured realms
+func TestListGroupsPerRealm(t *testing.T) {
+	var mu sync.Mutex
+	var tokenPaths []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/protocol/openid-connect/token") {
+			mu.Lock()
+			tokenPaths = append(tokenPaths, r.URL.Path)
+			mu.Unlock()
+		}
+		if isTokenRequest(w, r) {
+			return
+		}
+		realm := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/realms/"), "/groups")
+		fmt.Fprintf(w, `[{"id":"g1","name":"%s-group"}]`, realm)
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:       testServer.URL,
+		KeycloakRealm:     "master",
+		KeycloakRealms:    []string{"tenant-a"},
+		KeycloakUsername:  "admin",
+		KeycloakPassword:  "admin",
+		GroupCacheEnabled: true,
+		GroupCacheTTL:     time.Minute,
+	}
+	kcService := newKeycloakService(t, cfg)
+	h := handlers.NewGroupHandler(kcService)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups", middleware.RealmMiddleware(cfg), h.ListGroups)
+
+	tests := []struct {
+		realm  string
+		status int
+		body   string
+	}{
+		{"", http.StatusOK, "master-group"},
+		{"tenant-a", http.StatusOK, "tenant-a-group"},
+		{"master", http.StatusOK, "master-group"},
+		{"tenant-b", http.StatusBadRequest, "VALIDATION_FAILED"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups", nil)
+		if tt.realm != "" {
+			req.Header.Set(middleware.RealmHeader, tt.realm)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Fatalf("realm %q: expected %d with %s, got %d: %s", tt.realm, tt.status, tt.body, w.Code, w.Body.String())
+		}
+	}
+	for _, path := range tokenPaths {
+		if path != "/realms/master/protocol/openid-connect/token" {
+			t.Fatalf("expected admin tokens to come from the master realm, got a request to %s", path)
+		}
+	}
+}
+
+// Test that a caller's Keycloak token replaces the admin token when enabled, and is never cached
+func TestListGroupsWithCallerToken(t *testing.T) {
+	var mu sync.Mutex
+	tokenRequests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			mu.Lock()
+			tokenRequests++
+			mu.Unlock()
+			return
+		}
+		switch r.Header.Get("Authorization") {
+		case "Bearer dummy-token":
+			w.Write([]byte(`[{"id":"g1","name":"admin-group"}]`))
+		case "Bearer alice":
+			w.Write([]byte(`[{"id":"g2","name":"alice-group"}]`))
+		case "Bearer limited":
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:       testServer.URL,
+		KeycloakRealm:     "master",
+		KeycloakUsername:  "admin",
+		KeycloakPassword:  "admin",
+		AuthToken:         "secret-token",
+		GroupCacheEnabled: true,
+		GroupCacheTTL:     time.Minute,
+		CallerTokens:      true,
+	}
+	kcService := newKeycloakService(t, cfg)
+	h := handlers.NewGroupHandler(kcService)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/groups", middleware.AuthMiddleware(cfg), h.ListGroups)
+
+	tests := []struct {
+		callerToken string
+		enabled     bool
+		status      int
+		body        string
+	}{
+		{"", true, http.StatusOK, "admin-group"},
+		{"alice", true, http.StatusOK, "alice-group"},
+		{"Bearer alice", true, http.StatusOK, "alice-group"},
+		{"", true, http.StatusOK, "admin-group"},
+		{"expired", true, http.StatusUnauthorized, "UNAUTHORIZED"},
+		{"limited", true, http.StatusForbidden, "FORBIDDEN"},
+		{"alice", false, http.StatusOK, "admin-group"},
+	}
+	for _, tt := range tests {
+		cfg.CallerTokens = tt.enabled
+		req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups", nil)
+		req.Header.Set("Authorization", "Bearer secret-token")
+		if tt.callerToken != "" {
+			req.Header.Set(middleware.CallerTokenHeader, tt.callerToken)
+		}
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Fatalf("caller token %q (enabled %v): expected %d with %s, got %d: %s",
+				tt.callerToken, tt.enabled, tt.status, tt.body, w.Code, w.Body.String())
+		}
+	}
+	// A rejected caller token must not make the service renew its admin token.
+	if tokenRequests != 1 {
+		t.Fatalf("expected the admin token to be fetched once, got %d token requests", tokenRequests)
+	}
+}
+
+// Test that updating or deleting a user clears the cached groups with their users
+func TestGroupCacheClearedOnUserChanges(t *testing.T) {
+	var mu sync.Mutex
+	memberCalls := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch {
+		case r.URL.Path == "/admin/realms/master/groups":
+			w.Write([]byte(`[{"id":"g1","name":"one"}]`))
+		case r.URL.Path == "/admin/realms/master/groups/g1/members":
+			memberCalls++
+			w.Write([]byte(`[{"id":"u1","username":"one"}]`))
+		case r.URL.Path == "/admin/realms/master/users/u1" && r.Method == http.MethodGet:
+			w.Write([]byte(`{"id":"u1","username":"one"}`))
+		case r.URL.Path == "/admin/realms/master/users/u1":
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:       testServer.URL,
+		KeycloakRealm:     "master",
+		KeycloakUsername:  "admin",
+		KeycloakPassword:  "admin",
+		GroupCacheEnabled: true,
+		GroupCacheTTL:     time.Minute,
+	}
+	kcService := newKeycloakService(t, cfg)
+	firstName := "Renamed"
+	changes := []func() error{
+		func() error {
+			_, err := kcService.UpdateUser("u1", models.UserUpdate{FirstName: &firstName})
+			return err
+		},
+		func() error { return kcService.DeleteUser("u1") },
+	}
+	// Cache the listing, which later iterations find cached again.
+	if _, err := kcService.ListGroupsWithUsers(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	for i, change := range changes {
+		if err := change(); err != nil {
+			t.Fatalf("change %d: expected no error, got %v", i, err)
+		}
+		if _, err := kcService.ListGroupsWithUsers(); err != nil {
+			t.Fatalf("expected no error, got %v", err)
+		}
+		if expected := i + 2; memberCalls != expected {
+			t.Fatalf("change %d: expected the members to be fetched %d times, got %d", i, expected, memberCalls)
+		}
+	}
+}
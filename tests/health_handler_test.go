@@ -0,0 +1,93 @@
+package tests
+
+import (
+	"encoding/json"
+	"ms-user/config"
+	"ms-user/handlers"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newHealthRouter returns a router exposing the health endpoints backed by a fake Keycloak whose
+// token endpoint answers with tokenStatus once the service has authenticated. The Admin API accepts
+// the first token while tokenStatus is 200 and rejects it otherwise. tokenRequests counts logins.
+func newHealthRouter(t *testing.T, tokenStatus int) (*gin.Engine, *httptest.Server, *int) {
+	status := http.StatusOK
+	tokenRequests := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			tokenRequests++
+			w.WriteHeader(status)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.URL.Path == "/admin/realms/master/roles" && status == http.StatusOK {
+			w.Write([]byte(`[]`))
+			return
+		}
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte(`{"error":"HTTP 401 Unauthorized"}`))
+	}))
+	cfg := &config.Config{
+		KeycloakURL:      testServer.URL,
+		KeycloakRealm:    "master",
+		KeycloakUsername: "admin",
+		KeycloakPassword: "admin",
+	}
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	h := handlers.NewHealthHandler(newKeycloakService(t, cfg))
+	status = tokenStatus
+	tokenRequests = 0
+	r.GET("/health", h.Health)
+	r.GET("/ready", h.Ready)
+	return r, testServer, &tokenRequests
+}
+
+// Test for the liveness and readiness probes when Keycloak is available
+func TestReadyWhenKeycloakAvailable(t *testing.T) {
+	r, testServer, tokenRequests := newHealthRouter(t, http.StatusOK)
+	defer testServer.Close()
+
+	for _, path := range []string{"/health", "/ready", "/ready"} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected 200 for %s, got %d", path, w.Code)
+		}
+	}
+	// Probes reuse the cached admin token instead of logging in to Keycloak.
+	if *tokenRequests != 0 {
+		t.Fatalf("expected no token request, got %d", *tokenRequests)
+	}
+}
+
+// Test for the readiness probe when Keycloak rejects the credentials
+func TestReadyWhenCredentialsRejected(t *testing.T) {
+	r, testServer, _ := newHealthRouter(t, http.StatusUnauthorized)
+	defer testServer.Close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ready", nil))
+	if w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", w.Code)
+	}
+	var body map[string]string
+	json.Unmarshal(w.Body.Bytes(), &body)
+	// The reason is generic: Keycloak's response is only logged.
+	if body["status"] != "unavailable" || body["reason"] != "keycloak unavailable" {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	// Liveness does not depend on Keycloak.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 for /health, got %d", w.Code)
+	}
+}
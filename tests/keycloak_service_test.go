@@ -1,15 +1,27 @@
 package tests
 
 import (
+	"bytes"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"ms-user/config"
 	"ms-user/models"
 	"ms-user/services"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"reflect"
+	"sort"
 	"strings"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
 )
 
 // RoundTripFunc is a helper to override http.RoundTripper.
@@ -20,7 +32,7 @@ func (f RoundTripFunc) RoundTrip(req *http.Request) (*http.Response, error) {
 }
 
 // newTestKeycloakService returns a *services.KeycloakService configured to return dummy responses.
-func newTestKeycloakService() *services.KeycloakService {
+func newTestKeycloakService(t *testing.T) *services.KeycloakService {
 	// Create a test server that simulates all endpoints for the fake service.
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Simulate token retrieval.
@@ -76,9 +88,9 @@ func newTestKeycloakService() *services.KeycloakService {
 		KeycloakUsername: "admin",
 		KeycloakPassword: "admin",
 	}
-	ks := services.NewKeycloakService(cfg)
+	ks := newKeycloakService(t, cfg)
 	ks.SetToken("dummy-token")
-	ks.SetClient(newTestClientWithToken(testServer, nil))
+	ks.SetClient(newTestClientWithToken(testServer, t))
 	return ks
 }
 
@@ -113,12 +125,13 @@ func newTestClientWithToken(testServer *httptest.Server, t *testing.T) *http.Cli
 	}
 }
 
-// Test for ListUsers
+// Test that ListUsers returns a bounded first page along with the user count
 func TestListUsers(t *testing.T) {
 	dummyUsers := []models.User{
 		{ID: "1", Username: "user1", Email: "user1@example.com"},
 	}
 	dummyResponse, _ := json.Marshal(dummyUsers)
+	var listQuery string
 
 	// Test server simulating token endpoint and ListUsers.
 	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
@@ -128,7 +141,12 @@ func TestListUsers(t *testing.T) {
 			w.Write([]byte(`{"access_token": "dummy-token"}`))
 			return
 		}
+		if r.URL.Path == "/admin/realms/master/users/count" {
+			w.Write([]byte(`120`))
+			return
+		}
 		// ListUsers endpoint.
+		listQuery = r.URL.RawQuery
 		w.WriteHeader(http.StatusOK)
 		w.Write(dummyResponse)
 	}))
@@ -140,16 +158,19 @@ func TestListUsers(t *testing.T) {
 		KeycloakUsername: "admin",
 		KeycloakPassword: "admin",
 	}
-	kcService := services.NewKeycloakService(cfg)
+	kcService := newKeycloakService(t, cfg)
 	kcService.SetToken("dummy-token")
 	kcService.SetClient(newTestClientWithToken(testServer, t))
 
-	users, err := kcService.ListUsers()
+	users, total, err := kcService.ListUsers(services.UserFilter{}, 100)
 	if err != nil {
 		t.Fatalf("expected no error, got %v", err)
 	}
-	if len(users) != 1 || users[0].Username != "user1" {
-		t.Fatalf("unexpected users: %+v", users)
+	if len(users) != 1 || users[0].Username != "user1" || total != 120 {
+		t.Fatalf("unexpected users or total: %+v, %d", users, total)
+	}
+	if listQuery != "first=0&max=100" {
+		t.Fatalf("expected a single bounded page to be requested, got %q", listQuery)
 	}
 }
 
@@ -188,7 +209,7 @@ func TestSearchUserByEmail(t *testing.T) {
 		KeycloakUsername: "admin",
 		KeycloakPassword: "admin",
 	}
-	kcService := services.NewKeycloakService(cfg)
+	kcService := newKeycloakService(t, cfg)
 	kcService.SetToken("dummy-token")
 	kcService.SetClient(newTestClientWithToken(testServer, t))
 
@@ -201,6 +222,200 @@ func TestSearchUserByEmail(t *testing.T) {
 	}
 }
 
+// Test that SearchUsers sends only the provided criteria, URL-encoded
+func TestSearchUsersEncodesCriteria(t *testing.T) {
+	var query url.Values
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users" {
+			query = r.URL.Query()
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"1","email":"jane+ops@example.com"}]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	users, err := kcService.SearchUsers(map[string]string{
+		"email":     "jane+ops@example.com",
+		"lastName":  "Doe Smith",
+		"firstName": "",
+		"unknown":   "ignored",
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(users) != 1 {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+	// A raw "+" would be decoded by Keycloak as a space.
+	if query.Get("email") != "jane+ops@example.com" || query.Get("lastName") != "Doe Smith" {
+		t.Fatalf("unexpected query: %v", query)
+	}
+	if _, ok := query["firstName"]; ok {
+		t.Fatalf("expected empty criteria to be omitted, got %v", query)
+	}
+	if _, ok := query["unknown"]; ok {
+		t.Fatalf("expected unknown criteria to be omitted, got %v", query)
+	}
+}
+
+// Test that ListRequiredActions returns the aliases of enabled actions only
+func TestListRequiredActions(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/authentication/required-actions" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[
+				{"alias":"CONFIGURE_TOTP","name":"Configure OTP","providerId":"CONFIGURE_TOTP","enabled":true,"defaultAction":false,"priority":10,"config":{}},
+				{"alias":"terms_and_conditions","name":"Terms and Conditions","providerId":"terms_and_conditions","enabled":false,"defaultAction":false,"priority":20,"config":{}},
+				{"alias":"UPDATE_PASSWORD","name":"Update Password","providerId":"UPDATE_PASSWORD","enabled":true,"defaultAction":false,"priority":30,"config":{}},
+				{"alias":"VERIFY_EMAIL","name":"Verify Email","providerId":"VERIFY_EMAIL","enabled":true,"defaultAction":false,"priority":50,"config":{}}
+			]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	actions, err := kcService.ListRequiredActions()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := []string{"CONFIGURE_TOTP", "UPDATE_PASSWORD", "VERIFY_EMAIL"}
+	if strings.Join(actions, ",") != strings.Join(expected, ",") {
+		t.Fatalf("expected %v, got %v", expected, actions)
+	}
+}
+
+// Test that ListAllUsers forwards the state filter to both the listing and the count
+func TestListAllUsersForwardsFilter(t *testing.T) {
+	var queries []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		queries = append(queries, r.URL.Path+" enabled="+r.URL.Query().Get("enabled"))
+		switch r.URL.Path {
+		case "/admin/realms/master/users/count":
+			w.Write([]byte(`1`))
+		case "/admin/realms/master/users":
+			w.Write([]byte(`[{"id":"1","enabled":false,"emailVerified":true}]`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+
+	disabled := false
+	users, total, err := newServiceForServer(testServer, t).ListAllUsers(services.UserFilter{Enabled: &disabled})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(users) != 1 || total != 1 {
+		t.Fatalf("expected 1 user and a total of 1, got %d and %d", len(users), total)
+	}
+	if users[0].Enabled == nil || *users[0].Enabled || users[0].EmailVerified == nil || !*users[0].EmailVerified {
+		t.Fatalf("expected the account state to be decoded, got %+v", users[0])
+	}
+	expected := []string{"/admin/realms/master/users enabled=false", "/admin/realms/master/users/count enabled=false"}
+	if !reflect.DeepEqual(queries, expected) {
+		t.Fatalf("expected %v, got %v", expected, queries)
+	}
+}
+
+// Test that ListAllUsers returns an empty, non-nil slice for an empty realm, so it is encoded as []
+func TestListAllUsersEmptyRealm(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.URL.Path == "/admin/realms/master/users/count" {
+			w.Write([]byte(`0`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer testServer.Close()
+
+	users, _, err := newServiceForServer(testServer, t).ListAllUsers(services.UserFilter{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if body, _ := json.Marshal(users); string(body) != "[]" {
+		t.Fatalf("expected [], got %s", body)
+	}
+}
+
+// Test that ListAllUsers warns when Keycloak counts more users than could be listed
+func TestListAllUsersWarnsOnCountMismatch(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/realms/master/users/count":
+			w.Write([]byte(`250`))
+		case "/admin/realms/master/users":
+			// A server-side cap cuts the listing short after the first short page.
+			w.Write([]byte(`[{"id":"1"},{"id":"2"},{"id":"3"}]`))
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = previous }()
+
+	users, total, err := kcService.ListAllUsers(services.UserFilter{})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(users) != 3 || total != 250 {
+		t.Fatalf("expected 3 users and a total of 250, got %d and %d", len(users), total)
+	}
+	if !strings.Contains(logs.String(), `"level":"warn"`) || !strings.Contains(logs.String(), "pagination may have been incomplete") {
+		t.Fatalf("expected a warning about incomplete pagination, got %q", logs.String())
+	}
+}
+
+// Test for IncompleteListing
+func TestIncompleteListing(t *testing.T) {
+	tests := []struct {
+		listed, total int
+		want          bool
+	}{
+		{100, 100, false},
+		{99, 100, false},   // within the one-user tolerance
+		{995, 1000, false}, // within 1%
+		{3, 250, true},
+		{100, 500, true},
+		{12, 10, true},
+	}
+	for _, tt := range tests {
+		if got := services.IncompleteListing(tt.listed, tt.total); got != tt.want {
+			t.Fatalf("IncompleteListing(%d, %d) = %v, want %v", tt.listed, tt.total, got, tt.want)
+		}
+	}
+}
+
 // Test for ListGroups
 func TestListGroups(t *testing.T) {
 	dummyGroups := []models.Group{
@@ -232,7 +447,7 @@ func TestListGroups(t *testing.T) {
 		KeycloakUsername: "admin",
 		KeycloakPassword: "admin",
 	}
-	kcService := services.NewKeycloakService(cfg)
+	kcService := newKeycloakService(t, cfg)
 	kcService.SetToken("dummy-token")
 	kcService.SetClient(newTestClientWithToken(testServer, t))
 
@@ -286,7 +501,7 @@ func TestListGroupsWithUsers(t *testing.T) {
 		KeycloakUsername: "admin",
 		KeycloakPassword: "admin",
 	}
-	kcService := services.NewKeycloakService(cfg)
+	kcService := newKeycloakService(t, cfg)
 	kcService.SetToken("dummy-token")
 	kcService.SetClient(newTestClientWithToken(testServer, t))
 
@@ -304,3 +519,1526 @@ func TestListGroupsWithUsers(t *testing.T) {
 		t.Fatalf("unexpected users: %+v", result[0].Users)
 	}
 }
+
+// newKeycloakService returns a KeycloakService for cfg, failing the test if it cannot get an admin token.
+func newKeycloakService(t *testing.T, cfg *config.Config) *services.KeycloakService {
+	t.Helper()
+	kcService, err := services.NewKeycloakService(cfg)
+	if err != nil {
+		t.Fatalf("expected the service to authenticate, got %v", err)
+	}
+	return kcService
+}
+
+// newServiceForServer returns a *services.KeycloakService pointed at the given test server.
+// The test server is expected to answer the token endpoint.
+func newServiceForServer(testServer *httptest.Server, t *testing.T) *services.KeycloakService {
+	cfg := &config.Config{
+		KeycloakURL:      testServer.URL,
+		KeycloakRealm:    "master",
+		KeycloakUsername: "admin",
+		KeycloakPassword: "admin",
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetToken("dummy-token")
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+	return kcService
+}
+
+// Test for ExecuteActionsEmail reporting a realm without SMTP as ErrEmailNotSent
+func TestExecuteActionsEmailWithoutSMTP(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte(`{"errorMessage":"Failed to send execute actions email"}`))
+	}))
+	defer testServer.Close()
+
+	err := newServiceForServer(testServer, t).ExecuteActionsEmail("1", []string{"VERIFY_EMAIL"})
+	if !errors.Is(err, services.ErrEmailNotSent) {
+		t.Fatalf("expected ErrEmailNotSent, got %v", err)
+	}
+	var kcErr *services.KeycloakError
+	if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusInternalServerError {
+		t.Fatalf("expected the KeycloakError to be kept, got %v", err)
+	}
+}
+
+// Test for UpdateUserAttributes merging the given attributes with the existing ones
+func TestUpdateUserAttributesMerges(t *testing.T) {
+	var sent map[string]json.RawMessage
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.URL.Path != "/admin/realms/master/users/1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		switch r.Method {
+		case http.MethodGet:
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"1","username":"jdoe","attributes":{"department":["sales"],"employeeId":["42"],"costCenter":["cc1"]}}`))
+		case http.MethodPut:
+			json.NewDecoder(r.Body).Decode(&sent)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+	attrs, err := kcService.UpdateUserAttributes("1", map[string][]string{
+		"department": {"engineering"},
+		"costCenter": {},
+	})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	expected := map[string][]string{"department": {"engineering"}, "employeeId": {"42"}}
+	if !reflect.DeepEqual(attrs, expected) {
+		t.Fatalf("expected attributes %v, got %v", expected, attrs)
+	}
+	var sentAttrs map[string][]string
+	json.Unmarshal(sent["attributes"], &sentAttrs)
+	if !reflect.DeepEqual(sentAttrs, expected) || string(sent["username"]) != `"jdoe"` {
+		t.Fatalf("expected the user to be sent back with the merged attributes, got %v", sent)
+	}
+}
+
+// Test for ResetPassword
+func TestResetPassword(t *testing.T) {
+	var received models.Credential
+
+	// Test server simulating token endpoint and the reset-password endpoint.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodPut && r.URL.Path == "/admin/realms/master/users/1/reset-password" {
+			json.NewDecoder(r.Body).Decode(&received)
+			// Simulate a password policy violation for short passwords.
+			if len(received.Value) < 8 {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalidPasswordMinLengthMessage"}`))
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	if err := kcService.ResetPassword("1", "s3cret-password", true); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if received.Type != "password" || received.Value != "s3cret-password" || !received.Temporary {
+		t.Fatalf("unexpected credential payload: %+v", received)
+	}
+
+	err := kcService.ResetPassword("1", "short", false)
+	var kcErr *services.KeycloakError
+	if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected KeycloakError with status 400, got %v", err)
+	}
+}
+
+// Test for federated users in GetUser and mutating operations
+func TestFederatedUser(t *testing.T) {
+	federatedUser := models.User{ID: "1", Username: "ldap-user", FederationLink: "ldap-provider", Origin: "ldap-provider"}
+	localUser := models.User{ID: "2", Username: "local-user"}
+
+	// Test server simulating token endpoint, user lookups and a read-only LDAP provider.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/1" {
+			resp, _ := json.Marshal(federatedUser)
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/2" {
+			resp, _ := json.Marshal(localUser)
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		// Keycloak rejects updates to read-only federated users.
+		if r.Method == http.MethodPut && r.URL.Path == "/admin/realms/master/users/1" {
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`{"errorMessage":"User is read only!"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	user, err := kcService.GetUser("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !user.IsFederated() || user.FederationLink != "ldap-provider" || user.Origin != "ldap-provider" {
+		t.Fatalf("expected federated user, got %+v", user)
+	}
+	user, err = kcService.GetUser("2")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if user.IsFederated() {
+		t.Fatalf("expected local user, got %+v", user)
+	}
+
+	firstName := "New"
+	_, err = kcService.UpdateUser("1", models.UserUpdate{FirstName: &firstName})
+	if !errors.Is(err, services.ErrFederatedUser) {
+		t.Fatalf("expected ErrFederatedUser, got %v", err)
+	}
+	// A rejected update on a local user must not be reported as a federation problem.
+	_, err = kcService.UpdateUser("2", models.UserUpdate{FirstName: &firstName})
+	if err == nil || errors.Is(err, services.ErrFederatedUser) {
+		t.Fatalf("expected a plain error for local user, got %v", err)
+	}
+}
+
+// Test for SyncUserStorage
+func TestSyncUserStorage(t *testing.T) {
+	// Test server simulating token endpoint and the user storage sync endpoint.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodPost && r.URL.Path == "/admin/realms/master/user-storage/ldap-1/sync" {
+			if r.URL.Query().Get("action") != "triggerFullSync" {
+				w.WriteHeader(http.StatusBadRequest)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"ignored":false,"added":3,"updated":2,"removed":1,"failed":0,"status":"3 imported users, 2 updated users, 1 removed users"}`))
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	result, err := kcService.SyncUserStorage("ldap-1", "triggerFullSync")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.Added != 3 || result.Updated != 2 || result.Removed != 1 || result.Failed != 0 || result.Ignored {
+		t.Fatalf("unexpected sync result: %+v", result)
+	}
+	if result.Status == "" {
+		t.Fatalf("expected status message, got empty")
+	}
+}
+
+// Test for SetUserEnabled
+func TestSetUserEnabled(t *testing.T) {
+	// Simulated stored user representation, including fields the request must not overwrite.
+	stored := map[string]interface{}{
+		"id":         "1",
+		"username":   "user1",
+		"email":      "user1@example.com",
+		"enabled":    true,
+		"attributes": map[string]interface{}{"department": []interface{}{"engineering"}},
+	}
+
+	// Test server simulating token endpoint and Keycloak's full-representation user update semantics.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/1" {
+			json.NewEncoder(w).Encode(stored)
+			return
+		}
+		if r.Method == http.MethodPut && r.URL.Path == "/admin/realms/master/users/1" {
+			// Keycloak replaces the user with the payload, clearing absent fields.
+			stored = map[string]interface{}{}
+			json.NewDecoder(r.Body).Decode(&stored)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	if err := kcService.SetUserEnabled("1", false); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if stored["enabled"] != false {
+		t.Fatalf("expected user to be disabled, got %v", stored["enabled"])
+	}
+	if stored["email"] != "user1@example.com" || stored["username"] != "user1" {
+		t.Fatalf("expected other fields to be preserved, got %+v", stored)
+	}
+	if _, ok := stored["attributes"]; !ok {
+		t.Fatalf("expected attributes to survive, got %+v", stored)
+	}
+}
+
+// Test for CreateUser reading the new user's ID from the Location header
+func TestCreateUserLocationHeader(t *testing.T) {
+	sendLocation := true
+
+	// Test server simulating token endpoint and user creation.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodPost && r.URL.Path == "/admin/realms/master/users" {
+			if sendLocation {
+				w.Header().Set("Location", "http://keycloak/admin/realms/master/users/0b5e7c1a-5b4f-4a8e-9d2f-3c6f1e2a7d90")
+			}
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	user, err := kcService.CreateUser(models.User{Username: "user1", Email: "user1@example.com"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if user.ID != "0b5e7c1a-5b4f-4a8e-9d2f-3c6f1e2a7d90" || user.Username != "user1" {
+		t.Fatalf("unexpected created user: %+v", user)
+	}
+
+	// Without a Location header the input user is returned as before.
+	sendLocation = false
+	user, err = kcService.CreateUser(models.User{Username: "user2"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if user.ID != "" || user.Username != "user2" {
+		t.Fatalf("unexpected created user: %+v", user)
+	}
+}
+
+// Test for ListPasskeys and RemovePasskey with mixed credential types
+func TestPasskeys(t *testing.T) {
+	credentials := `[
+		{"id":"c1","type":"password","createdDate":1700000000000},
+		{"id":"c2","type":"webauthn","userLabel":"YubiKey","createdDate":1700000001000,"credentialData":"{\"publicKey\":\"secret-key\"}"},
+		{"id":"c3","type":"otp","userLabel":"Phone"},
+		{"id":"c4","type":"webauthn-passwordless","userLabel":"Laptop","credentialData":"{\"publicKey\":\"secret-key\"}"}
+	]`
+	var deleted []string
+
+	// Test server simulating token endpoint and the credentials endpoints.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/1/credentials" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(credentials))
+			return
+		}
+		if r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/admin/realms/master/users/1/credentials/") {
+			deleted = append(deleted, strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/1/credentials/"))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	passkeys, err := kcService.ListPasskeys("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(passkeys) != 2 || passkeys[0].Type != models.CredentialTypeWebAuthn || passkeys[1].Type != models.CredentialTypeWebAuthnPasswordless {
+		t.Fatalf("unexpected passkeys: %+v", passkeys)
+	}
+	serialized, _ := json.Marshal(passkeys)
+	if strings.Contains(string(serialized), "secret-key") {
+		t.Fatalf("passkeys must not expose key material: %s", serialized)
+	}
+
+	if err := kcService.RemovePasskey("1", "c4"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	// A password credential must not be removable through the passkey path.
+	if err := kcService.RemovePasskey("1", "c1"); !errors.Is(err, services.ErrCredentialNotFound) {
+		t.Fatalf("expected ErrCredentialNotFound, got %v", err)
+	}
+	if len(deleted) != 1 || deleted[0] != "c4" {
+		t.Fatalf("unexpected deletions: %v", deleted)
+	}
+}
+
+// Test for listing a user's sessions and logging the user out
+func TestUserSessions(t *testing.T) {
+	loggedOut := 0
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/1/sessions":
+			if loggedOut > 0 {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"id":"s1","username":"jdoe","ipAddress":"10.0.0.1","start":1700000000000,"lastAccess":1700000360000,"clients":{"c1":"app"}}]`))
+		case r.Method == http.MethodPost && r.URL.Path == "/admin/realms/master/users/1/logout":
+			loggedOut++
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+	sessions, err := kcService.ListUserSessions("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	expected := models.Session{ID: "s1", IPAddress: "10.0.0.1", Start: 1700000000000, LastAccess: 1700000360000}
+	if len(sessions) != 1 || sessions[0] != expected {
+		t.Fatalf("unexpected sessions: %+v", sessions)
+	}
+
+	// Logging out twice succeeds: the second call finds no session to end.
+	for i := 0; i < 2; i++ {
+		if err := kcService.LogoutUser("1"); err != nil {
+			t.Fatalf("expected no error on logout %d, got %v", i+1, err)
+		}
+	}
+	sessions, err = kcService.ListUserSessions("1")
+	if err != nil || len(sessions) != 0 || loggedOut != 2 {
+		t.Fatalf("expected no session left after logout, got %+v (err %v)", sessions, err)
+	}
+
+	err = kcService.LogoutUser("missing")
+	var kcErr *services.KeycloakError
+	if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected KeycloakError with status 404, got %v", err)
+	}
+}
+
+// Test for CreateSubGroup and ListSubGroups
+func TestSubGroups(t *testing.T) {
+	var created models.Group
+
+	// Test server simulating token endpoint and the group children endpoint.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.URL.Path == "/admin/realms/master/groups/1/children" {
+			if r.Method == http.MethodPost {
+				json.NewDecoder(r.Body).Decode(&created)
+				w.Header().Set("Location", "http://keycloak/admin/realms/master/groups/2")
+				w.WriteHeader(http.StatusCreated)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"2","name":"Backend","subGroups":[{"id":"3","name":"Go"}]}]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	group, err := kcService.CreateSubGroup("1", models.Group{Name: "Backend"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if created.Name != "Backend" || group.ID != "2" {
+		t.Fatalf("unexpected created subgroup: %+v (sent %+v)", group, created)
+	}
+
+	children, err := kcService.ListSubGroups("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(children) != 1 || children[0].Name != "Backend" || len(children[0].SubGroups) != 1 || children[0].SubGroups[0].Name != "Go" {
+		t.Fatalf("unexpected children: %+v", children)
+	}
+}
+
+// Test that ListGroupsWithUsers does not recurse into subgroups
+func TestListGroupsWithUsersDoesNotRecurse(t *testing.T) {
+	var memberRequests []string
+
+	// Test server simulating token endpoint, a group hierarchy and group members.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/members") {
+			memberRequests = append(memberRequests, r.URL.Path)
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"10","username":"user10"}]`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"1","name":"Engineering","subGroups":[{"id":"2","name":"Backend"}]}]`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	result, err := kcService.ListGroupsWithUsers()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(result) != 1 || result[0].Group.ID != "1" {
+		t.Fatalf("expected only the top-level group, got %+v", result)
+	}
+	if len(result[0].Group.SubGroups) != 1 || result[0].Group.SubGroups[0].ID != "2" {
+		t.Fatalf("expected subgroup to be kept on the group, got %+v", result[0].Group)
+	}
+	if len(memberRequests) != 1 || memberRequests[0] != "/admin/realms/master/groups/1/members" {
+		t.Fatalf("expected members to be fetched for the top-level group only, got %v", memberRequests)
+	}
+}
+
+// Test that ListGroupsWithUsers keeps group order regardless of completion order
+func TestListGroupsWithUsersOrdering(t *testing.T) {
+	dummyGroups := []models.Group{
+		{ID: "1", Name: "First"},
+		{ID: "2", Name: "Second"},
+		{ID: "3", Name: "Third"},
+		{ID: "4", Name: "Fourth"},
+	}
+	groupResponse, _ := json.Marshal(dummyGroups)
+
+	// Test server where earlier groups answer later, so lookups complete in reverse order.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/members") {
+			groupID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/groups/"), "/members")
+			delay := map[string]time.Duration{"1": 40, "2": 30, "3": 20, "4": 10}[groupID]
+			time.Sleep(delay * time.Millisecond)
+			resp, _ := json.Marshal([]models.User{{ID: "u" + groupID, Username: "member-of-" + groupID}})
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups" {
+			w.WriteHeader(http.StatusOK)
+			w.Write(groupResponse)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:         testServer.URL,
+		KeycloakRealm:       "master",
+		KeycloakUsername:    "admin",
+		KeycloakPassword:    "admin",
+		KeycloakConcurrency: 4,
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetToken("dummy-token")
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+
+	result, err := kcService.ListGroupsWithUsers()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(result) != len(dummyGroups) {
+		t.Fatalf("expected %d groups, got %d", len(dummyGroups), len(result))
+	}
+	for i, entry := range result {
+		if entry.Group.ID != dummyGroups[i].ID {
+			t.Fatalf("expected group %s at position %d, got %s", dummyGroups[i].ID, i, entry.Group.ID)
+		}
+		if len(entry.Users) != 1 || entry.Users[0].Username != "member-of-"+entry.Group.ID {
+			t.Fatalf("unexpected users for group %s: %+v", entry.Group.ID, entry.Users)
+		}
+	}
+}
+
+// Test for MembershipMatrix
+func TestMembershipMatrix(t *testing.T) {
+	dummyUsers := []models.User{
+		{ID: "1", Username: "alice", Email: "alice@example.com"},
+		{ID: "2", Username: "bob", Email: "bob@example.com"},
+		{ID: "3", Username: "carol", Email: "carol@example.com"},
+	}
+	userGroups := map[string][]models.Group{
+		"1": {{ID: "g1", Name: "backend", Path: "/engineering/backend"}, {ID: "g2", Name: "admins", Path: "/admins"}},
+		"2": {{ID: "g1", Name: "backend", Path: "/engineering/backend"}},
+		"3": {},
+	}
+
+	// Test server simulating token endpoint, paged user listing and user groups.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasSuffix(r.URL.Path, "/groups") {
+			userID := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/"), "/groups")
+			resp, _ := json.Marshal(userGroups[userID])
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users" {
+			if r.URL.Query().Get("first") != "0" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			resp, _ := json.Marshal(dummyUsers)
+			w.WriteHeader(http.StatusOK)
+			w.Write(resp)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	rows, err := kcService.MembershipMatrix()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(rows) != 3 {
+		t.Fatalf("expected 3 rows, got %d", len(rows))
+	}
+	if rows[0].Username != "alice" || strings.Join(rows[0].Groups, ",") != "/engineering/backend,/admins" {
+		t.Fatalf("unexpected row for alice: %+v", rows[0])
+	}
+	if rows[1].Username != "bob" || strings.Join(rows[1].Groups, ",") != "/engineering/backend" {
+		t.Fatalf("unexpected row for bob: %+v", rows[1])
+	}
+	if rows[2].Username != "carol" || len(rows[2].Groups) != 0 {
+		t.Fatalf("unexpected row for carol: %+v", rows[2])
+	}
+}
+
+// Test for realm role assignment
+func TestRealmRoleMappings(t *testing.T) {
+	var mappings []models.Role
+
+	// Test server simulating token endpoint, role lookup and realm role mappings.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/roles/auditor" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"r1","name":"auditor","composite":false}`))
+			return
+		}
+		if r.Method == http.MethodGet && strings.HasPrefix(r.URL.Path, "/admin/realms/master/roles/") {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Could not find role"}`))
+			return
+		}
+		if r.URL.Path == "/admin/realms/master/users/1/role-mappings/realm" {
+			switch r.Method {
+			case http.MethodPost:
+				json.NewDecoder(r.Body).Decode(&mappings)
+				w.WriteHeader(http.StatusNoContent)
+			case http.MethodDelete:
+				mappings = nil
+				w.WriteHeader(http.StatusNoContent)
+			default:
+				resp, _ := json.Marshal(mappings)
+				w.WriteHeader(http.StatusOK)
+				w.Write(resp)
+			}
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	if err := kcService.AddRealmRoleToUser("1", "auditor"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	roles, err := kcService.ListUserRealmRoles("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(roles) != 1 || roles[0].ID != "r1" || roles[0].Name != "auditor" {
+		t.Fatalf("unexpected roles: %+v", roles)
+	}
+	if err := kcService.RemoveRealmRoleFromUser("1", "auditor"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if mappings != nil {
+		t.Fatalf("expected role to be removed, got %+v", mappings)
+	}
+
+	err = kcService.AddRealmRoleToUser("1", "missing")
+	var kcErr *services.KeycloakError
+	if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusNotFound {
+		t.Fatalf("expected KeycloakError with status 404, got %v", err)
+	}
+}
+
+// Test that role names are escaped in the URL, so that "/", "?" or "#" cannot reach another resource
+func TestRealmRoleNameEscaped(t *testing.T) {
+	var paths []string
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		paths = append(paths, r.Method+" "+r.URL.EscapedPath())
+		switch r.Method {
+		case http.MethodGet:
+			w.Write([]byte(`[]`))
+		default:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	if _, err := kcService.ListUsersWithRealmRole("ops/admin?x#y"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if err := kcService.DeleteRealmRole("ops/admin?x#y"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	want := []string{
+		"GET /admin/realms/master/roles/ops%2Fadmin%3Fx%23y/users",
+		"DELETE /admin/realms/master/roles/ops%2Fadmin%3Fx%23y",
+	}
+	if !reflect.DeepEqual(paths, want) {
+		t.Fatalf("expected requests %v, got %v", want, paths)
+	}
+}
+
+// userDetailsServer simulates the user, user groups and realm role mapping endpoints of user "1".
+// The role mappings fail with a 500 when rolesFail is set.
+func userDetailsServer(rolesFail bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/realms/master/users/1":
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"id":"1","username":"jdoe","email":"jdoe@example.com"}`))
+		case "/admin/realms/master/users/1/groups":
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"g1","name":"engineering","path":"/engineering"}]`))
+		case "/admin/realms/master/users/1/role-mappings/realm":
+			if rolesFail {
+				w.WriteHeader(http.StatusInternalServerError)
+				w.Write([]byte(`{"error":"unknown_error"}`))
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"r1","name":"auditor"}]`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+}
+
+// Test for GetUserDetails loading every section
+func TestGetUserDetails(t *testing.T) {
+	testServer := userDetailsServer(false)
+	defer testServer.Close()
+
+	details, err := newServiceForServer(testServer, t).GetUserDetails("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if details.User.ID != "1" || details.User.Username != "jdoe" {
+		t.Fatalf("unexpected user: %+v", details.User)
+	}
+	if len(details.Groups) != 1 || details.Groups[0].ID != "g1" {
+		t.Fatalf("unexpected groups: %+v", details.Groups)
+	}
+	if len(details.Roles) != 1 || details.Roles[0].Name != "auditor" {
+		t.Fatalf("unexpected roles: %+v", details.Roles)
+	}
+	if details.Errors != nil {
+		t.Fatalf("expected no section errors, got %+v", details.Errors)
+	}
+}
+
+// Test for GetUserDetails keeping the user and groups when the roles cannot be loaded
+func TestGetUserDetailsRolesFail(t *testing.T) {
+	testServer := userDetailsServer(true)
+	defer testServer.Close()
+
+	details, err := newServiceForServer(testServer, t).GetUserDetails("1")
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if details.User.ID != "1" || len(details.Groups) != 1 {
+		t.Fatalf("expected user and groups to be loaded, got %+v", details)
+	}
+	if details.Roles != nil {
+		t.Fatalf("expected roles to be omitted, got %+v", details.Roles)
+	}
+	if _, ok := details.Errors["roles"]; !ok || len(details.Errors) != 1 {
+		t.Fatalf("expected a single error note for roles, got %+v", details.Errors)
+	}
+}
+
+// Test for MoveUserBetweenGroups adding before removing, and rolling back only a membership it created
+func TestMoveUserBetweenGroups(t *testing.T) {
+	var calls []string
+
+	// u1 is already a member of "current". Adding to "bad-dest" and removing from "stuck" fail; every
+	// other membership change succeeds.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.Method == http.MethodGet {
+			if r.URL.Path == "/admin/realms/master/users/u1/groups" {
+				w.Write([]byte(`[{"id":"current","name":"current","path":"/current"}]`))
+			} else {
+				w.Write([]byte(`{"id":"` + strings.TrimPrefix(r.URL.Path, "/admin/realms/master/groups/") + `"}`))
+			}
+			return
+		}
+		groupID := strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/u1/groups/")
+		calls = append(calls, r.Method+" "+groupID)
+		if (r.Method == http.MethodPut && groupID == "bad-dest") || (r.Method == http.MethodDelete && groupID == "stuck") {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	tests := []struct {
+		name      string
+		from, to  string
+		wantErr   bool
+		wantCalls []string
+	}{
+		{"moved", "a", "b", false, []string{"PUT b", "DELETE a"}},
+		{"add fails, source kept", "a", "bad-dest", true, []string{"PUT bad-dest"}},
+		{"remove fails, add rolled back", "stuck", "b", true, []string{"PUT b", "DELETE stuck", "DELETE b"}},
+		{"already in destination", "a", "current", false, []string{"DELETE a"}},
+		{"remove fails, existing membership kept", "stuck", "current", true, []string{"DELETE stuck"}},
+	}
+	for _, tt := range tests {
+		calls = nil
+		err := kcService.MoveUserBetweenGroups("u1", tt.from, tt.to)
+		if (err != nil) != tt.wantErr {
+			t.Fatalf("%s: expected error %v, got %v", tt.name, tt.wantErr, err)
+		}
+		if !reflect.DeepEqual(calls, tt.wantCalls) {
+			t.Fatalf("%s: expected calls %v, got %v", tt.name, tt.wantCalls, calls)
+		}
+	}
+}
+
+// Test for AddUserToGroupByEmailAndPath resolving the group path, and reporting an unknown path
+func TestAddUserToGroupByEmailAndPath(t *testing.T) {
+	var added []string
+
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch {
+		case r.URL.Path == "/admin/realms/master/users" && r.URL.Query().Get("email") == "jdoe@example.com":
+			w.Write([]byte(`[{"id":"u1","email":"jdoe@example.com"}]`))
+		case r.URL.Path == "/admin/realms/master/group-by-path/engineering/backend":
+			w.Write([]byte(`{"id":"g2","name":"backend","path":"/engineering/backend"}`))
+		case r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/admin/realms/master/users/u1/groups/"):
+			added = append(added, strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/u1/groups/"))
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+	if err := kcService.AddUserToGroupByEmailAndPath("jdoe@example.com", "/engineering/backend"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(added) != 1 || added[0] != "g2" {
+		t.Fatalf("expected user to be added to g2, got %v", added)
+	}
+
+	err := kcService.AddUserToGroupByEmailAndPath("jdoe@example.com", "/engineering/missing")
+	if !errors.Is(err, services.ErrGroupNotFound) {
+		t.Fatalf("expected ErrGroupNotFound, got %v", err)
+	}
+}
+
+// Test for AddUserToGroupByEmail retrying when the first search returns no user
+func TestAddUserToGroupByEmailRetriesEmptySearch(t *testing.T) {
+	searches := 0
+	var added string
+
+	// Test server where the user only becomes searchable on the second attempt.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users" {
+			searches++
+			w.WriteHeader(http.StatusOK)
+			if searches == 1 {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"id":"1","username":"user1","email":"user1@example.com"}]`))
+			return
+		}
+		if r.Method == http.MethodPut && strings.HasPrefix(r.URL.Path, "/admin/realms/master/users/") {
+			added = r.URL.Path
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:           testServer.URL,
+		KeycloakRealm:         "master",
+		KeycloakUsername:      "admin",
+		KeycloakPassword:      "admin",
+		EmailLookupRetries:    2,
+		EmailLookupRetryDelay: time.Millisecond,
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetToken("dummy-token")
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+
+	if err := kcService.AddUserToGroupByEmail("user1@example.com", "g1"); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if searches != 2 {
+		t.Fatalf("expected 2 searches, got %d", searches)
+	}
+	if added != "/admin/realms/master/users/1/groups/g1" {
+		t.Fatalf("unexpected membership request: %s", added)
+	}
+
+	// Without retries the same lag surfaces as ErrUserNotFound.
+	searches = 0
+	cfg.EmailLookupRetries = 0
+	if err := kcService.AddUserToGroupByEmail("user1@example.com", "g1"); !errors.Is(err, services.ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+}
+
+// Test for SelfTest when one step fails
+func TestSelfTestReportsFailedStep(t *testing.T) {
+	// Test server where the token and group listing work but counting users fails.
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/groups" {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`[{"id":"1","name":"Admins"}]`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/count" {
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte(`{"error":"unknown_error"}`))
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+
+	kcService := newServiceForServer(testServer, t)
+
+	report := kcService.SelfTest()
+	if report.Passed {
+		t.Fatalf("expected overall failure, got %+v", report)
+	}
+	if len(report.Steps) != 3 {
+		t.Fatalf("expected 3 steps, got %+v", report.Steps)
+	}
+	if !report.Steps[0].Passed || !report.Steps[1].Passed {
+		t.Fatalf("expected token and list_groups to pass, got %+v", report.Steps)
+	}
+	if report.Steps[2].Name != "count_users" || report.Steps[2].Passed || report.Steps[2].Error == "" {
+		t.Fatalf("expected count_users to fail with an error, got %+v", report.Steps[2])
+	}
+}
+
+// newRetryingService returns a service pointed at testServer that retries throttled requests quickly.
+// The test server must still answer the token request made by NewKeycloakService (see isTokenRequest).
+func newRetryingService(testServer *httptest.Server, t *testing.T, maxRetries int) *services.KeycloakService {
+	cfg := &config.Config{
+		KeycloakURL:            testServer.URL,
+		KeycloakRealm:          "master",
+		KeycloakUsername:       "admin",
+		KeycloakPassword:       "admin",
+		KeycloakMaxRetries:     maxRetries,
+		KeycloakRetryBaseDelay: time.Millisecond,
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetToken("dummy-token")
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+	return kcService
+}
+
+// isTokenRequest answers the admin token request made directly against the test server, if r is one.
+func isTokenRequest(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+		w.Write([]byte(`{"access_token": "dummy-token"}`))
+		return true
+	}
+	return false
+}
+
+// Test that 429 and 503 responses are retried until Keycloak recovers
+func TestDoRequestRetriesThrottledRequests(t *testing.T) {
+	calls := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		calls++
+		switch calls {
+		case 1:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		case 2:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		default:
+			w.Write([]byte(`42`))
+		}
+	}))
+	defer testServer.Close()
+
+	count, err := newRetryingService(testServer, t, 3).CountUsers()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if count != 42 || calls != 3 {
+		t.Fatalf("expected 42 after 3 calls, got %d after %d calls", count, calls)
+	}
+}
+
+// Test that a 503 answered to a POST is only retried when Keycloak sends Retry-After, so that a creation
+// a proxy reported as failed after Keycloak applied it is not made twice
+func TestDoRequestRetriesPostOnlyWithRetryAfter(t *testing.T) {
+	for _, retryAfter := range []string{"", "0"} {
+		calls := 0
+		testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if isTokenRequest(w, r) {
+				return
+			}
+			calls++
+			if calls == 1 {
+				if retryAfter != "" {
+					w.Header().Set("Retry-After", retryAfter)
+				}
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Header().Set("Location", "/admin/realms/master/users/u1")
+			w.WriteHeader(http.StatusCreated)
+		}))
+
+		_, err := newRetryingService(testServer, t, 3).CreateUser(models.User{Username: "alice"})
+		testServer.Close()
+		if retryAfter == "" {
+			var kcErr *services.KeycloakError
+			if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusServiceUnavailable || calls != 1 {
+				t.Fatalf("expected a single call failing with 503, got %v after %d calls", err, calls)
+			}
+			continue
+		}
+		if err != nil || calls != 2 {
+			t.Fatalf("expected the creation to be retried once, got %v after %d calls", err, calls)
+		}
+	}
+}
+
+// Test that retries stop after KeycloakMaxRetries and the last response is returned
+func TestDoRequestGivesUpAfterMaxRetries(t *testing.T) {
+	calls := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		calls++
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer testServer.Close()
+
+	_, err := newRetryingService(testServer, t, 2).CountUsers()
+	var kcErr *services.KeycloakError
+	if !errors.As(err, &kcErr) || kcErr.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected a 429 KeycloakError, got %v", err)
+	}
+	if calls != 3 {
+		t.Fatalf("expected 1 call and 2 retries, got %d calls", calls)
+	}
+}
+
+// Test that the 401 token refresh composes with throttling retries and resends the request body
+func TestDoRequestRefreshesTokenThenRetriesThrottled(t *testing.T) {
+	var statuses []int
+	var bodies []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		status := http.StatusCreated
+		switch len(bodies) {
+		case 1:
+			status = http.StatusUnauthorized
+		case 2:
+			status = http.StatusTooManyRequests
+		}
+		statuses = append(statuses, status)
+		w.WriteHeader(status)
+	}))
+	defer testServer.Close()
+
+	_, err := newRetryingService(testServer, t, 1).CreateUser(models.User{Username: "alice"})
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if len(bodies) != 3 {
+		t.Fatalf("expected 3 calls, got %v", statuses)
+	}
+	for i, body := range bodies {
+		if !strings.Contains(body, `"username":"alice"`) {
+			t.Fatalf("call %d: expected the user payload to be resent, got %q", i+1, body)
+		}
+	}
+}
+
+// tokenGrantServer simulates Keycloak's token endpoint and the user count endpoint.
+// Each password login issues a new access token ("a1", "a2", ...) valid for expiresIn seconds along with
+// the refresh token "r1"; the refresh_token grant issues a new access token too unless refreshFails is set.
+// The count endpoint only accepts access tokens for which valid returns true.
+// Grant types are recorded in grants, and the tokens presented to the count endpoint in used.
+type tokenGrantServer struct {
+	*httptest.Server
+	mu     sync.Mutex
+	grants []string
+	used   []string
+}
+
+func newTokenGrantServer(expiresIn int, refreshFails bool, valid func(token string) bool) *tokenGrantServer {
+	ts := &tokenGrantServer{}
+	issued := 0
+	ts.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts.mu.Lock()
+		defer ts.mu.Unlock()
+		if strings.HasSuffix(r.URL.Path, "/protocol/openid-connect/token") {
+			r.ParseForm()
+			grant := r.PostForm.Get("grant_type")
+			ts.grants = append(ts.grants, grant)
+			if grant == "refresh_token" && (refreshFails || r.PostForm.Get("refresh_token") != "r1") {
+				w.WriteHeader(http.StatusBadRequest)
+				w.Write([]byte(`{"error":"invalid_grant","error_description":"Token is not active"}`))
+				return
+			}
+			issued++
+			fmt.Fprintf(w, `{"access_token":"a%d","expires_in":%d,"refresh_token":"r1","refresh_expires_in":1800}`, issued, expiresIn)
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		ts.used = append(ts.used, token)
+		if !valid(token) {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		w.Write([]byte(`1`))
+	}))
+	return ts
+}
+
+// Test that a rejected admin token is renewed with the refresh_token grant rather than a new login
+func TestTokenRenewedWithRefreshGrant(t *testing.T) {
+	ts := newTokenGrantServer(300, false, func(token string) bool { return token == "a2" })
+	defer ts.Close()
+
+	kcService := newKeycloakService(t, &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	if _, err := kcService.CountUsers(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(ts.grants, []string{"password", "refresh_token"}) {
+		t.Fatalf("expected a login then a refresh, got %v", ts.grants)
+	}
+}
+
+// Test that concurrent requests rejected with the same token renew it only once
+func TestTokenRenewedOnceForConcurrent401s(t *testing.T) {
+	ts := newTokenGrantServer(300, false, func(token string) bool { return token != "a1" })
+	defer ts.Close()
+
+	kcService := newKeycloakService(t, &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	var wg sync.WaitGroup
+	errs := make([]error, 10)
+	for i := range errs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			_, errs[i] = kcService.CountUsers()
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			t.Fatalf("request %d: expected no error, got %v", i, err)
+		}
+	}
+	if !reflect.DeepEqual(ts.grants, []string{"password", "refresh_token"}) {
+		t.Fatalf("expected a login then a single refresh, got %v", ts.grants)
+	}
+}
+
+// Test that a full login is made again when the refresh token is rejected
+func TestTokenRefreshFallsBackToLogin(t *testing.T) {
+	ts := newTokenGrantServer(300, true, func(token string) bool { return token == "a2" })
+	defer ts.Close()
+
+	kcService := newKeycloakService(t, &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	if _, err := kcService.CountUsers(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(ts.grants, []string{"password", "refresh_token", "password"}) {
+		t.Fatalf("expected a login, a failed refresh and a new login, got %v", ts.grants)
+	}
+}
+
+// Test that a token about to expire is refreshed before the request instead of after a 401
+func TestTokenRefreshedBeforeExpiry(t *testing.T) {
+	// The token expires within the renewal margin as soon as it is issued.
+	ts := newTokenGrantServer(10, false, func(token string) bool { return true })
+	defer ts.Close()
+
+	kcService := newKeycloakService(t, &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	if _, err := kcService.CountUsers(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if !reflect.DeepEqual(ts.grants, []string{"password", "refresh_token"}) {
+		t.Fatalf("expected a login then a refresh, got %v", ts.grants)
+	}
+	if !reflect.DeepEqual(ts.used, []string{"a2"}) {
+		t.Fatalf("expected only the renewed token to be used, got %v", ts.used)
+	}
+}
+
+// Test that BackfillDefaults only assigns the defaults users are missing
+func TestBackfillDefaultsOnlyChangesUsersMissingDefaults(t *testing.T) {
+	roles := map[string]string{
+		"u1": `[{"id":"r1","name":"member"}]`,
+		"u2": `[]`,
+		"u3": `[{"id":"r1","name":"member"}]`,
+	}
+	groups := map[string]string{
+		"u1": `[{"id":"g1","name":"everyone"}]`,
+		"u2": `[{"id":"g1","name":"everyone"}]`,
+		"u3": `[]`,
+	}
+	var mu sync.Mutex
+	var writes []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		path := strings.TrimPrefix(r.URL.Path, "/admin/realms/master")
+		parts := strings.Split(strings.Trim(path, "/"), "/")
+		switch {
+		case r.Method == http.MethodGet && path == "/roles/member":
+			w.Write([]byte(`{"id":"r1","name":"member"}`))
+		case r.Method == http.MethodGet && path == "/groups/g1":
+			w.Write([]byte(`{"id":"g1","name":"everyone"}`))
+		case r.Method == http.MethodGet && path == "/users/count":
+			w.Write([]byte(`3`))
+		case r.Method == http.MethodGet && path == "/users":
+			w.Write([]byte(`[{"id":"u1","username":"one"},{"id":"u2","username":"two"},{"id":"u3","username":"three"}]`))
+		case r.Method == http.MethodGet && len(parts) == 4 && parts[2] == "role-mappings":
+			w.Write([]byte(roles[parts[1]]))
+		case r.Method == http.MethodGet && len(parts) == 3 && parts[2] == "groups":
+			w.Write([]byte(groups[parts[1]]))
+		case r.Method == http.MethodPost || r.Method == http.MethodPut:
+			mu.Lock()
+			writes = append(writes, r.Method+" "+path)
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{
+		KeycloakURL:         testServer.URL,
+		KeycloakRealm:       "master",
+		KeycloakUsername:    "admin",
+		KeycloakPassword:    "admin",
+		KeycloakConcurrency: 2,
+		DefaultRoles:        []string{"member"},
+		DefaultGroups:       []string{"g1"},
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetToken("dummy-token")
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+
+	result, err := kcService.BackfillDefaults()
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if result.UsersScanned != 3 || result.UsersChanged != 2 || result.UsersFailed != 0 {
+		t.Fatalf("unexpected summary: %+v", result)
+	}
+	expected := []models.BackfillChange{
+		{UserID: "u2", Username: "two", AddedRoles: []string{"member"}},
+		{UserID: "u3", Username: "three", AddedGroups: []string{"g1"}},
+	}
+	if !reflect.DeepEqual(result.Changes, expected) {
+		t.Fatalf("unexpected changes: %+v", result.Changes)
+	}
+	sort.Strings(writes)
+	if strings.Join(writes, ",") != "POST /users/u2/role-mappings/realm,PUT /users/u3/groups/g1" {
+		t.Fatalf("unexpected writes: %v", writes)
+	}
+}
+
+// Test that only Keycloak's 404 is reported as ErrNotFound by GetUser and GetGroup
+func TestGetUserAndGroupNotFoundVsUpstreamFailure(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/missing"):
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Could not find resource"}`))
+		case strings.HasSuffix(r.URL.Path, "/forbidden"):
+			w.WriteHeader(http.StatusForbidden)
+		default:
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+
+	get := map[string]func(id string) error{
+		"user":  func(id string) error { _, err := kcService.GetUser(id); return err },
+		"group": func(id string) error { _, err := kcService.GetGroup(id); return err },
+	}
+	for kind, fn := range get {
+		if err := fn("missing"); !errors.Is(err, services.ErrNotFound) {
+			t.Fatalf("%s: expected ErrNotFound for a 404, got %v", kind, err)
+		}
+		for _, id := range []string{"forbidden", "broken"} {
+			err := fn(id)
+			var kcErr *services.KeycloakError
+			if err == nil || errors.Is(err, services.ErrNotFound) || !errors.As(err, &kcErr) {
+				t.Fatalf("%s %s: expected a KeycloakError other than ErrNotFound, got %v", kind, id, err)
+			}
+		}
+	}
+}
+
+// Test that concurrent requests reuse pooled connections to Keycloak instead of opening new ones
+func TestKeycloakConnectionsReused(t *testing.T) {
+	var mu sync.Mutex
+	opened := 0
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+		w.Write([]byte(`42`))
+	}))
+	ts.Config.ConnState = func(_ net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			mu.Lock()
+			opened++
+			mu.Unlock()
+		}
+	}
+	ts.Start()
+	defer ts.Close()
+
+	kcService := newKeycloakService(t, &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	const parallel, rounds = 10, 5
+	for round := 0; round < rounds; round++ {
+		var wg sync.WaitGroup
+		for i := 0; i < parallel; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := kcService.CountUsers(); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+	}
+	// The default transport keeps 2 idle connections per host and would open ~40 connections here.
+	mu.Lock()
+	defer mu.Unlock()
+	if opened > parallel+1 {
+		t.Fatalf("expected at most %d connections, %d were opened", parallel+1, opened)
+	}
+}
+
+// Test that the initial admin token fetch is retried while Keycloak fails, but not when it rejects the credentials
+func TestNewKeycloakServiceStartupRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		statuses []int // Token endpoint answers, in order; the last one repeats.
+		wantErr  bool
+		attempts int
+	}{
+		{"available", []int{http.StatusOK}, false, 1},
+		{"recovers", []int{http.StatusServiceUnavailable, http.StatusBadGateway, http.StatusOK}, false, 3},
+		{"keeps failing", []int{http.StatusServiceUnavailable}, true, 4}, // The first attempt and 3 retries.
+		{"wrong credentials", []int{http.StatusUnauthorized}, true, 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			status := tt.statuses[len(tt.statuses)-1]
+			if attempts < len(tt.statuses) {
+				status = tt.statuses[attempts]
+			}
+			attempts++
+			w.WriteHeader(status)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+		}))
+		cfg := &config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master", KeycloakStartupRetries: 3,
+			KeycloakStartupBackoff: time.Millisecond}
+		kcService, err := services.NewKeycloakService(cfg)
+		ts.Close()
+		if (err != nil) != tt.wantErr || (kcService == nil) != tt.wantErr {
+			t.Fatalf("%s: expected error=%v, got %v", tt.name, tt.wantErr, err)
+		}
+		if attempts != tt.attempts {
+			t.Fatalf("%s: expected %d token request(s), got %d", tt.name, tt.attempts, attempts)
+		}
+	}
+}
+
+// Test that token fetch failures tell network problems, rejected credentials and other statuses apart
+func TestTokenFetchErrors(t *testing.T) {
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		kind    string
+	}{
+		{"hanging endpoint", func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(300 * time.Millisecond)
+		}, services.TokenFetchNetwork},
+		{"bad credentials", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error":"invalid_grant","error_description":"Invalid user credentials"}`))
+		}, services.TokenFetchBadCredentials},
+		{"unexpected status", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}, services.TokenFetchUnexpectedStatus},
+		{"no token", func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(`{}`))
+		}, services.TokenFetchUnexpectedStatus},
+	}
+	for _, tt := range tests {
+		ts := httptest.NewServer(tt.handler)
+		start := time.Now()
+		_, err := services.NewKeycloakService(&config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master",
+			KeycloakTokenTimeout: 50 * time.Millisecond})
+		elapsed := time.Since(start)
+		ts.CloseClientConnections()
+		ts.Close()
+		var tokenErr *services.TokenFetchError
+		if !errors.Is(err, services.ErrTokenFetch) || !errors.As(err, &tokenErr) || tokenErr.Kind != tt.kind {
+			t.Fatalf("%s: expected a %q token fetch error, got %v", tt.name, tt.kind, err)
+		}
+		if elapsed > 250*time.Millisecond {
+			t.Fatalf("%s: expected the token request to time out, took %s", tt.name, elapsed)
+		}
+	}
+
+	ts := httptest.NewServer(tests[1].handler)
+	defer ts.Close()
+	_, err := services.NewKeycloakService(&config.Config{KeycloakURL: ts.URL, KeycloakRealm: "master"})
+	if err == nil || !strings.Contains(err.Error(), "KEYCLOAK_USERNAME/KEYCLOAK_PASSWORD") {
+		t.Fatalf("expected rejected credentials to point at the configuration, got %v", err)
+	}
+}
@@ -0,0 +1,311 @@
+package tests
+
+import (
+	"encoding/json"
+	"fmt"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"ms-user/handlers"
+	"ms-user/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newMembershipRouter returns a router exposing the membership change routes backed by a fake Keycloak
+// that knows user "u1" (one@example.com) and group "g1" and forbids changes to group "protected". The fake keeps track of
+// whether u1 is a member of g1; the number of membership changes it received is reported by changes.
+func newMembershipRouter(t *testing.T, prevalidate bool) (r *gin.Engine, testServer *httptest.Server, changes func() int) {
+	var mu sync.Mutex
+	member, changeCount := false, 0
+	testServer = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.URL.Path {
+		case "/admin/realms/master/users":
+			w.Write([]byte(`[{"id":"u1","username":"one","email":"one@example.com"}]`))
+		case "/admin/realms/master/users/u1":
+			w.Write([]byte(`{"id":"u1","username":"one"}`))
+		case "/admin/realms/master/users/u1/groups":
+			if member {
+				w.Write([]byte(`[{"id":"g1","name":"everyone","path":"/everyone"}]`))
+			} else {
+				w.Write([]byte(`[]`))
+			}
+		case "/admin/realms/master/groups/g1":
+			w.Write([]byte(`{"id":"g1","name":"everyone"}`))
+		case "/admin/realms/master/groups/protected", "/admin/realms/master/group-by-path/protected":
+			w.Write([]byte(`{"id":"protected","name":"protected","path":"/protected"}`))
+		case "/admin/realms/master/users/u1/groups/g1":
+			changeCount++
+			member = r.Method == http.MethodPut
+			w.WriteHeader(http.StatusNoContent)
+		case "/admin/realms/master/users/u1/groups/protected":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"error":"unknown_error"}`))
+		case "/admin/realms/master/users/u1/groups/missing":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"Group not found"}`))
+		case "/admin/realms/master/users/missing/groups/g1":
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"User not found"}`))
+		default:
+			// Unknown users and groups, including lookups made by the prevalidation, answer a bare 404.
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	cfg := &config.Config{
+		KeycloakURL:           testServer.URL,
+		KeycloakRealm:         "master",
+		KeycloakUsername:      "admin",
+		KeycloakPassword:      "admin",
+		MembershipPrevalidate: prevalidate,
+	}
+	kcService := newKeycloakService(t, cfg)
+	kcService.SetClient(newTestClientWithToken(testServer, t))
+
+	h := handlers.NewMembershipHandler(kcService)
+	gin.SetMode(gin.TestMode)
+	r = gin.New()
+	r.PUT("/ms-user/v1/users/:id/groups/:groupId", h.AddUserToGroup)
+	r.PUT("/ms-user/v1/users/:id/groups", h.AddUserToGroups)
+	r.DELETE("/ms-user/v1/users/:id/groups/:groupId", h.RemoveUserFromGroup)
+	r.PUT("/ms-user/v1/users/email/:email/groups/:groupId", h.AddUserToGroupByEmail)
+	r.PUT("/ms-user/v1/users/email/:email/groups/by-path/*path", h.AddUserToGroupByEmailAndPath)
+	changes = func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return changeCount
+	}
+	return r, testServer, changes
+}
+
+// Test that membership changes report which of the user and the group is missing, or that access was denied
+func TestMembershipChangeFailureModes(t *testing.T) {
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		code   string
+	}{
+		{"success", "/ms-user/v1/users/u1/groups/g1", http.StatusNoContent, ""},
+		{"user not found", "/ms-user/v1/users/missing/groups/g1", http.StatusNotFound, apierrors.CodeUserNotFound},
+		{"group not found", "/ms-user/v1/users/u1/groups/missing", http.StatusNotFound, apierrors.CodeGroupNotFound},
+		{"forbidden", "/ms-user/v1/users/u1/groups/protected", http.StatusForbidden, apierrors.CodeForbidden},
+	}
+	for _, prevalidate := range []bool{false, true} {
+		r, testServer, _ := newMembershipRouter(t, prevalidate)
+		for _, tt := range tests {
+			for _, method := range []string{http.MethodPut, http.MethodDelete} {
+				w := httptest.NewRecorder()
+				r.ServeHTTP(w, httptest.NewRequest(method, tt.path, nil))
+				if w.Code != tt.status {
+					t.Fatalf("%s %s (prevalidate=%v): expected %d, got %d", method, tt.name, prevalidate, tt.status, w.Code)
+				}
+				if tt.code == "" {
+					continue
+				}
+				var apiErr apierrors.APIError
+				json.Unmarshal(w.Body.Bytes(), &apiErr)
+				if apiErr.Code != tt.code {
+					t.Fatalf("%s %s (prevalidate=%v): expected code %s, got %s", method, tt.name, prevalidate, tt.code, w.Body.String())
+				}
+			}
+		}
+		testServer.Close()
+	}
+}
+
+// Test that adding a user found by email to a protected group is reported as 403, like with the user ID
+func TestAddUserToGroupByEmailForbidden(t *testing.T) {
+	r, testServer, _ := newMembershipRouter(t, false)
+	defer testServer.Close()
+
+	for _, path := range []string{
+		"/ms-user/v1/users/email/one@example.com/groups/protected",
+		"/ms-user/v1/users/email/one@example.com/groups/by-path/protected",
+	} {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, path, nil))
+		var apiErr apierrors.APIError
+		json.Unmarshal(w.Body.Bytes(), &apiErr)
+		if w.Code != http.StatusForbidden || apiErr.Code != apierrors.CodeForbidden {
+			t.Fatalf("%s: expected 403 %s, got %d: %s", path, apierrors.CodeForbidden, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Test that adding a user to several groups reports the outcome of each group
+func TestAddUserToGroupsPartialFailure(t *testing.T) {
+	r, testServer, _ := newMembershipRouter(t, false)
+	defer testServer.Close()
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1/groups",
+		strings.NewReader(`{"groupIds":["g1","missing","protected"]}`)))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", w.Code, w.Body.String())
+	}
+	var response models.GroupJoinResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Joined != 1 || response.Failed != 2 || len(response.Results) != 3 {
+		t.Fatalf("unexpected summary: %+v", response)
+	}
+	expected := []models.GroupJoinResult{
+		{GroupID: "g1", Success: true},
+		{GroupID: "missing", Code: apierrors.CodeGroupNotFound},
+		{GroupID: "protected", Code: apierrors.CodeForbidden},
+	}
+	for i, want := range expected {
+		got := response.Results[i]
+		if got.GroupID != want.GroupID || got.Success != want.Success || got.Code != want.Code {
+			t.Fatalf("result %d: expected %+v, got %+v", i, want, got)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1/groups", strings.NewReader(`{"groupIds":[]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty list, got %d", w.Code)
+	}
+}
+
+// Test that adding a user to a group it already belongs to succeeds without changing the membership again
+func TestAddUserToGroupTwice(t *testing.T) {
+	r, testServer, changes := newMembershipRouter(t, false)
+	defer testServer.Close()
+
+	for i := 1; i <= 2; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1/groups/g1", nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("add %d: expected 204, got %d: %s", i, w.Code, w.Body.String())
+		}
+	}
+	if changes() != 1 {
+		t.Fatalf("expected a single membership change, got %d", changes())
+	}
+}
+
+// Test for checking group membership of a user whose groups span several pages
+func TestIsUserInGroup(t *testing.T) {
+	const groups = 250
+	var mu sync.Mutex
+	pages := 0
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/realms/master/users/u1/groups":
+			mu.Lock()
+			pages++
+			mu.Unlock()
+			var first, max int
+			fmt.Sscan(r.URL.Query().Get("first"), &first)
+			fmt.Sscan(r.URL.Query().Get("max"), &max)
+			page := []models.Group{}
+			for i := first; i < groups && i < first+max; i++ {
+				page = append(page, models.Group{ID: fmt.Sprintf("g%d", i)})
+			}
+			resp, _ := json.Marshal(page)
+			w.Write(resp)
+		case "/admin/realms/master/groups/other":
+			w.Write([]byte(`{"id":"other","name":"other"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	h := handlers.NewMembershipHandler(newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/users/:id/groups/:groupId", h.IsUserInGroup)
+
+	tests := []struct {
+		name   string
+		path   string
+		status int
+		body   string
+		pages  int
+	}{
+		{"member on the first page", "/ms-user/v1/users/u1/groups/g5", http.StatusOK, `{"member":true}`, 1},
+		{"member on the last page", "/ms-user/v1/users/u1/groups/g240", http.StatusOK, `{"member":true}`, 3},
+		{"not a member", "/ms-user/v1/users/u1/groups/other", http.StatusOK, `{"member":false}`, 3},
+		{"unknown group", "/ms-user/v1/users/u1/groups/missing", http.StatusNotFound, apierrors.CodeGroupNotFound, 3},
+		{"unknown user", "/ms-user/v1/users/missing/groups/g1", http.StatusNotFound, apierrors.CodeUserNotFound, 0},
+	}
+	for _, tt := range tests {
+		pages = 0
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != tt.status || !strings.Contains(w.Body.String(), tt.body) {
+			t.Fatalf("%s: expected %d with %s, got %d: %s", tt.name, tt.status, tt.body, w.Code, w.Body.String())
+		}
+		if pages != tt.pages {
+			t.Fatalf("%s: expected %d page(s) of groups to be fetched, got %d", tt.name, tt.pages, pages)
+		}
+	}
+}
+
+// Test that removing a user from all groups reports the outcome of each group
+func TestRemoveUserFromAllGroups(t *testing.T) {
+	var mu sync.Mutex
+	var removed []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch {
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/u1/groups":
+			w.Write([]byte(`[{"id":"g1","name":"one","path":"/one"},{"id":"protected","name":"protected","path":"/protected"},{"id":"g2","name":"two","path":"/one/two"}]`))
+		case r.Method == http.MethodDelete && r.URL.Path == "/admin/realms/master/users/u1/groups/protected":
+			w.WriteHeader(http.StatusForbidden)
+		case r.Method == http.MethodDelete && strings.HasPrefix(r.URL.Path, "/admin/realms/master/users/u1/groups/"):
+			mu.Lock()
+			removed = append(removed, strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/u1/groups/"))
+			mu.Unlock()
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"error":"User not found"}`))
+		}
+	}))
+	defer testServer.Close()
+
+	h := handlers.NewMembershipHandler(newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.DELETE("/ms-user/v1/users/:id/groups", h.RemoveUserFromAllGroups)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/users/u1/groups", nil))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", w.Code, w.Body.String())
+	}
+	var response models.GroupLeaveResponse
+	json.Unmarshal(w.Body.Bytes(), &response)
+	if response.Removed != 2 || response.Failed != 1 || len(response.Results) != 3 {
+		t.Fatalf("unexpected summary: %+v", response)
+	}
+	if failed := response.Results[1]; failed.GroupID != "protected" || failed.Success || failed.Code != apierrors.CodeForbidden {
+		t.Fatalf("expected the protected group to fail with FORBIDDEN, got %+v", failed)
+	}
+	if response.Results[2].GroupPath != "/one/two" || len(removed) != 2 {
+		t.Fatalf("expected g1 and g2 to be removed, got %+v (removed %v)", response.Results, removed)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/users/missing/groups", nil))
+	if w.Code != http.StatusNotFound || !strings.Contains(w.Body.String(), apierrors.CodeUserNotFound) {
+		t.Fatalf("expected 404 USER_NOT_FOUND for an unknown user, got %d: %s", w.Code, w.Body.String())
+	}
+}
@@ -0,0 +1,85 @@
+package tests
+
+import (
+	"io/ioutil"
+	"ms-user/config"
+	"ms-user/handlers"
+	"ms-user/metrics"
+	"ms-user/middleware"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// scrapeMetrics returns the current metrics in the Prometheus text format.
+func scrapeMetrics(t *testing.T) string {
+	w := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200 from the metrics handler, got %d", w.Code)
+	}
+	body, _ := ioutil.ReadAll(w.Body)
+	return string(body)
+}
+
+// Test for metrics.KeycloakOperation
+func TestKeycloakOperation(t *testing.T) {
+	tests := []struct {
+		method, path, want string
+	}{
+		{"GET", "/admin/realms/master/users", "GET /users"},
+		{"GET", "/admin/realms/master/users/count", "GET /users/count"},
+		{"PUT", "/admin/realms/master/users/42/groups/7", "PUT /users/{id}/groups/{id}"},
+		{"DELETE", "/admin/realms/master/users/42/credentials/c1", "DELETE /users/{id}/credentials/{id}"},
+		{"GET", "/admin/realms/master/roles/auditor/users", "GET /roles/{id}/users"},
+		{"POST", "/admin/realms/master/user-storage/ldap/sync", "POST /user-storage/{id}/sync"},
+		{"POST", "/realms/master/protocol/openid-connect/token", "POST /protocol/openid-connect/token"},
+	}
+	for _, tt := range tests {
+		if got := metrics.KeycloakOperation(tt.method, tt.path); got != tt.want {
+			t.Fatalf("KeycloakOperation(%s, %s) = %q, want %q", tt.method, tt.path, got, tt.want)
+		}
+	}
+}
+
+// Test that handled requests and Keycloak calls are exposed as Prometheus metrics
+func TestMetricsRecordRequestsAndKeycloakCalls(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/admin/realms/master/users/count" {
+			w.Write([]byte(`7`))
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte(`{"access_token": "dummy-token"}`))
+	}))
+	defer testServer.Close()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.MetricsMiddleware())
+	h := handlers.NewHealthHandler(newKeycloakService(t, &config.Config{KeycloakURL: testServer.URL, KeycloakRealm: "master"}))
+	r.GET("/health", h.Health)
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/health", nil))
+	r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/nowhere", nil))
+
+	if _, err := newServiceForServer(testServer, t).CountUsers(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	body := scrapeMetrics(t)
+	for _, expected := range []string{
+		`ms_user_http_requests_total{operation="health",status="200"}`,
+		`ms_user_http_errors_total{operation="unmatched",status="404"}`,
+		`ms_user_http_request_duration_seconds_count{operation="health"}`,
+		`ms_user_keycloak_requests_total{operation="GET /users/count",status="200"}`,
+		`ms_user_keycloak_request_duration_seconds_count{operation="GET /users/count"}`,
+		`go_goroutines`,
+	} {
+		if !strings.Contains(body, expected) {
+			t.Fatalf("expected metrics to contain %s", expected)
+		}
+	}
+}
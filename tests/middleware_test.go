@@ -0,0 +1,306 @@
+package tests
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"ms-user/middleware"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+// newAuthRouter returns a router protected by AuthMiddleware with a public and a protected route.
+func newAuthRouter(cfg *config.Config) *gin.Engine {
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.AuthMiddleware(cfg))
+	ok := func(c *gin.Context) { c.Status(http.StatusOK) }
+	r.GET("/health", ok)
+	r.GET("/ms-user/v1/users", ok)
+	return r
+}
+
+// Test that public paths skip authentication while other routes still require it
+func TestAuthMiddlewarePublicPaths(t *testing.T) {
+	cfg := &config.Config{AuthToken: "secret-token", PublicPaths: []string{"/health"}}
+	r := newAuthRouter(cfg)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/health", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected public path to skip auth, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil))
+	if w.Code != http.StatusUnauthorized {
+		t.Fatalf("expected protected path to require auth, got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected valid token to pass, got %d", w.Code)
+	}
+}
+
+// Test that the request ID is echoed back, generated when absent, and carried by every log line of the request
+func TestRequestIDMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = previous }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.RequestIDMiddleware(), middleware.LoggingMiddleware())
+	r.GET("/fail", func(c *gin.Context) {
+		middleware.RequestLogger(c).Error().Msg("handler failure")
+		c.Status(http.StatusInternalServerError)
+	})
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/fail", nil)
+	req.Header.Set(middleware.RequestIDHeader, "abc-123")
+	r.ServeHTTP(w, req)
+	if got := w.Header().Get(middleware.RequestIDHeader); got != "abc-123" {
+		t.Fatalf("expected the incoming request ID to be echoed, got %q", got)
+	}
+	lines := 0
+	scanner := bufio.NewScanner(&logs)
+	for scanner.Scan() {
+		var entry map[string]interface{}
+		json.Unmarshal(scanner.Bytes(), &entry)
+		if entry["request_id"] != "abc-123" {
+			t.Fatalf("expected request_id on every log line, got %s", scanner.Text())
+		}
+		lines++
+	}
+	if lines != 2 {
+		t.Fatalf("expected the handler and the request log lines, got %d", lines)
+	}
+
+	for _, incoming := range []string{"", "bad id\nwith newline"} {
+		w = httptest.NewRecorder()
+		req = httptest.NewRequest(http.MethodGet, "/fail", nil)
+		if incoming != "" {
+			req.Header.Set(middleware.RequestIDHeader, incoming)
+		}
+		r.ServeHTTP(w, req)
+		uuidV4 := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+		if got := w.Header().Get(middleware.RequestIDHeader); !uuidV4.MatchString(got) {
+			t.Fatalf("expected a generated UUID for %q, got %q", incoming, got)
+		}
+	}
+}
+
+// Test that requests are logged with structured fields at a level matching their status
+func TestLoggingMiddlewareLevels(t *testing.T) {
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = previous }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.LoggingMiddleware())
+	r.GET("/status/:code", func(c *gin.Context) {
+		code, _ := strconv.Atoi(c.Param("code"))
+		c.String(code, "body")
+	})
+
+	for code, level := range map[int]string{200: "info", 404: "warn", 502: "error"} {
+		logs.Reset()
+		r.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/status/"+strconv.Itoa(code), nil))
+		var entry map[string]interface{}
+		if err := json.Unmarshal(logs.Bytes(), &entry); err != nil {
+			t.Fatalf("expected a JSON log line, got %q", logs.String())
+		}
+		if entry["level"] != level || entry["status"] != float64(code) {
+			t.Fatalf("expected level %s for status %d, got %v", level, code, entry)
+		}
+		if entry["method"] != "GET" || entry["route"] != "/status/:code" || entry["bytes"] != float64(4) {
+			t.Fatalf("missing structured fields: %v", entry)
+		}
+		if _, ok := entry["latency_ms"]; !ok {
+			t.Fatalf("missing latency: %v", entry)
+		}
+	}
+}
+
+// Test that a panicking handler is answered with a JSON 500 and logged with its stack trace
+func TestRecoveryMiddleware(t *testing.T) {
+	var logs bytes.Buffer
+	previous := log.Logger
+	log.Logger = zerolog.New(&logs)
+	defer func() { log.Logger = previous }()
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	// Same order as in main.go.
+	r.Use(middleware.RecoveryMiddleware(), middleware.RequestIDMiddleware(), middleware.LoggingMiddleware(),
+		middleware.MetricsMiddleware())
+	r.GET("/panic", func(c *gin.Context) { panic("boom") })
+	// A panic in a middleware is caught too.
+	r.GET("/middleware-panic", func(c *gin.Context) { panic("middleware boom") }, func(c *gin.Context) {})
+
+	req := httptest.NewRequest(http.MethodGet, "/panic", nil)
+	req.Header.Set(middleware.RequestIDHeader, "panic-1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusInternalServerError || !strings.Contains(w.Body.String(), `"code":"INTERNAL_ERROR"`) {
+		t.Fatalf("expected a JSON 500, got %d: %s", w.Code, w.Body.String())
+	}
+	if w.Header().Get(middleware.RequestIDHeader) != "panic-1" {
+		t.Fatalf("expected the request ID to be echoed, got %q", w.Header().Get(middleware.RequestIDHeader))
+	}
+	if !strings.Contains(logs.String(), `"panic":"boom"`) || !strings.Contains(logs.String(), `"stack":`) {
+		t.Fatalf("expected the panic and its stack to be logged, got %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"request_id":"panic-1"`) {
+		t.Fatalf("expected the panic to be logged with the request ID, got %q", logs.String())
+	}
+	if !strings.Contains(logs.String(), `"status":500`) {
+		t.Fatalf("expected the request to be logged with status 500, got %q", logs.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/middleware-panic", nil))
+	if w.Code != http.StatusInternalServerError || !strings.Contains(logs.String(), `"panic":"middleware boom"`) {
+		t.Fatalf("expected a panicking middleware to be recovered, got %d", w.Code)
+	}
+
+	// The 500 follows the configured error format like any other error.
+	apierrors.SetFormat(apierrors.FormatProblem)
+	defer apierrors.SetFormat(apierrors.FormatSimple)
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/panic", nil))
+	if w.Header().Get("Content-Type") != "application/problem+json" || !strings.Contains(w.Body.String(), `"status":500`) {
+		t.Fatalf("expected a Problem Details 500, got %s: %s", w.Header().Get("Content-Type"), w.Body.String())
+	}
+}
+
+// Test that CORS preflight requests are answered before authentication and allowed origins are echoed
+func TestCORSMiddleware(t *testing.T) {
+	cfg := &config.Config{AuthToken: "secret-token", CORSAllowedOrigins: []string{"https://admin.example.com"}}
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.CORSMiddleware(cfg))
+	r.Use(middleware.AuthMiddleware(cfg))
+	r.GET("/ms-user/v1/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodOptions, "/ms-user/v1/users", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	req.Header.Set("Access-Control-Request-Headers", "authorization")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected preflight to get 204 without a token, got %d", w.Code)
+	}
+	if w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" ||
+		!strings.Contains(w.Header().Get("Access-Control-Allow-Headers"), "Authorization") {
+		t.Fatalf("missing preflight headers: %v", w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil)
+	req.Header.Set("Origin", "https://admin.example.com")
+	req.Header.Set("Authorization", "Bearer secret-token")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK || w.Header().Get("Access-Control-Allow-Origin") != "https://admin.example.com" {
+		t.Fatalf("expected the allowed origin to be echoed, got %d %v", w.Code, w.Header())
+	}
+
+	w = httptest.NewRecorder()
+	req = httptest.NewRequest(http.MethodOptions, "/ms-user/v1/users", nil)
+	req.Header.Set("Origin", "https://evil.example.com")
+	req.Header.Set("Access-Control-Request-Method", "GET")
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusForbidden || w.Header().Get("Access-Control-Allow-Origin") != "" {
+		t.Fatalf("expected preflight from an unknown origin to be refused, got %d %v", w.Code, w.Header())
+	}
+}
+
+// Test for RateLimitMiddleware at the burst boundary, per client and globally
+func TestRateLimitMiddleware(t *testing.T) {
+	for _, perClient := range []bool{true, false} {
+		// One token every 2 seconds: the bucket cannot refill while the test runs.
+		cfg := &config.Config{RateLimitRPS: 0.5, RateLimitBurst: 2, RateLimitPerClient: perClient}
+		gin.SetMode(gin.TestMode)
+		r := gin.New()
+		r.Use(middleware.RateLimitMiddleware(cfg))
+		r.GET("/ms-user/v1/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+		call := func(ip string) *httptest.ResponseRecorder {
+			req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil)
+			req.RemoteAddr = ip + ":40000"
+			w := httptest.NewRecorder()
+			r.ServeHTTP(w, req)
+			return w
+		}
+
+		for i := 0; i < cfg.RateLimitBurst; i++ {
+			if w := call("192.0.2.1"); w.Code != http.StatusOK {
+				t.Fatalf("perClient=%v: request %d within the burst got %d", perClient, i+1, w.Code)
+			}
+		}
+		w := call("192.0.2.1")
+		if w.Code != http.StatusTooManyRequests || !strings.Contains(w.Body.String(), "RATE_LIMITED") {
+			t.Fatalf("perClient=%v: expected 429 RATE_LIMITED past the burst, got %d: %s", perClient, w.Code, w.Body.String())
+		}
+		if retryAfter, err := strconv.Atoi(w.Header().Get("Retry-After")); err != nil || retryAfter < 1 || retryAfter > 2 {
+			t.Fatalf("perClient=%v: expected Retry-After of 1-2 seconds, got %q", perClient, w.Header().Get("Retry-After"))
+		}
+
+		// Another client has its own bucket only when limiting per client.
+		expected := http.StatusOK
+		if !perClient {
+			expected = http.StatusTooManyRequests
+		}
+		if w := call("192.0.2.2"); w.Code != expected {
+			t.Fatalf("perClient=%v: expected %d for another client, got %d", perClient, expected, w.Code)
+		}
+	}
+
+	// Without trusted proxies, a client cannot get a new bucket by rotating X-Forwarded-For.
+	r := gin.New()
+	if err := r.SetTrustedProxies(nil); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	r.Use(middleware.RateLimitMiddleware(&config.Config{RateLimitRPS: 0.5, RateLimitBurst: 1, RateLimitPerClient: true}))
+	r.GET("/ms-user/v1/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for i, forwardedFor := range []string{"198.51.100.1", "198.51.100.2"} {
+		req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil)
+		req.RemoteAddr = "192.0.2.1:40000"
+		req.Header.Set("X-Forwarded-For", forwardedFor)
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		if expected := []int{http.StatusOK, http.StatusTooManyRequests}[i]; w.Code != expected {
+			t.Fatalf("X-Forwarded-For %s: expected %d, got %d", forwardedFor, expected, w.Code)
+		}
+	}
+
+	// Rate limiting is disabled when RateLimitRPS is 0.
+	r = gin.New()
+	r.Use(middleware.RateLimitMiddleware(&config.Config{}))
+	r.GET("/ms-user/v1/users", func(c *gin.Context) { c.Status(http.StatusOK) })
+	for i := 0; i < 100; i++ {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("expected no limit when disabled, got %d on request %d", w.Code, i+1)
+		}
+	}
+}
@@ -0,0 +1,123 @@
+package tests
+
+import (
+	"encoding/json"
+	"ms-user/handlers"
+	"ms-user/models"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// newRoleTestServer simulates Keycloak with an "auditor" role held by two users.
+// deleted is set to true when the role deletion endpoint is called.
+func newRoleTestServer(deleted *bool) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Token endpoint.
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/roles/auditor/users" {
+			w.WriteHeader(http.StatusOK)
+			if r.URL.Query().Get("first") != "0" {
+				w.Write([]byte(`[]`))
+				return
+			}
+			w.Write([]byte(`[{"id":"1","username":"alice"},{"id":"2","username":"bob"}]`))
+			return
+		}
+		if r.Method == http.MethodDelete && r.URL.Path == "/admin/realms/master/roles/auditor" {
+			*deleted = true
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.WriteHeader(http.StatusNotFound)
+	}))
+}
+
+// newRoleRouter returns a router exposing the role routes backed by the given test server.
+func newRoleRouter(testServer *httptest.Server, t *testing.T) *gin.Engine {
+	h := handlers.NewRoleHandler(newServiceForServer(testServer, t))
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/roles/:name/users", h.ListRoleUsers)
+	r.DELETE("/ms-user/v1/roles/:name", h.DeleteRole)
+	return r
+}
+
+// Test for listing the users holding a realm role
+func TestListRoleUsers(t *testing.T) {
+	deleted := false
+	testServer := newRoleTestServer(&deleted)
+	defer testServer.Close()
+	r := newRoleRouter(testServer, t)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/roles/auditor/users", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var users []models.User
+	json.Unmarshal(w.Body.Bytes(), &users)
+	if len(users) != 2 || users[0].Username != "alice" || users[1].Username != "bob" {
+		t.Fatalf("unexpected users: %+v", users)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/roles/missing/users", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown role, got %d", w.Code)
+	}
+}
+
+// Test for the realm role deletion dry run
+func TestDeleteRoleDryRun(t *testing.T) {
+	deleted := false
+	testServer := newRoleTestServer(&deleted)
+	defer testServer.Close()
+	r := newRoleRouter(testServer, t)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/roles/auditor?dryRun=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	if deleted {
+		t.Fatalf("dry run must not delete the role")
+	}
+	var body struct {
+		Role          string        `json:"role"`
+		DryRun        bool          `json:"dryRun"`
+		AffectedUsers []models.User `json:"affectedUsers"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if body.Role != "auditor" || !body.DryRun || len(body.AffectedUsers) != 2 {
+		t.Fatalf("unexpected dry run body: %s", w.Body.String())
+	}
+
+	// Other spellings of a boolean are dry runs too; anything else is rejected, never treated as a deletion.
+	for _, value := range []string{"1", "True"} {
+		w = httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/roles/auditor?dryRun="+value, nil))
+		if w.Code != http.StatusOK || deleted {
+			t.Fatalf("dryRun=%s: expected a dry run, got %d (deleted: %v)", value, w.Code, deleted)
+		}
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/roles/auditor?dryRun=yes", nil))
+	if w.Code != http.StatusBadRequest || deleted {
+		t.Fatalf("expected 400 for an invalid dryRun, got %d (deleted: %v)", w.Code, deleted)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodDelete, "/ms-user/v1/roles/auditor", nil))
+	if !deleted {
+		t.Fatalf("expected the role to be deleted without dryRun")
+	}
+}
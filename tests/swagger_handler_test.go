@@ -0,0 +1,101 @@
+package tests
+
+import (
+	"encoding/json"
+	"ms-user/config"
+	"ms-user/handlers"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// routeComment matches the route comments of cmd/app/main.go, e.g. "// GET /ms-user/v1/users/:id - ...".
+var routeComment = regexp.MustCompile(`(GET|POST|PUT|PATCH|DELETE) /ms-user/v1(/[^\s?]*)`)
+
+// routeParam matches gin path parameters (":id", "*path").
+var routeParam = regexp.MustCompile(`[:*](\w+)`)
+
+// newSwaggerRouter returns a router serving the API documentation under the given base path.
+func newSwaggerRouter(basePath string) *gin.Engine {
+	h := handlers.NewSwaggerHandler(&config.Config{BasePath: basePath})
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/"+basePath+"/swagger/*any", h.Serve)
+	return r
+}
+
+// Test that the served OpenAPI specification documents every route registered in main.go
+func TestOpenAPISpecCoversRoutes(t *testing.T) {
+	r := newSwaggerRouter("ms-user/v1")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/swagger/doc.json", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var spec struct {
+		Servers []struct {
+			URL string `json:"url"`
+		} `json:"servers"`
+		Paths      map[string]map[string]interface{} `json:"paths"`
+		Components struct {
+			SecuritySchemes map[string]struct {
+				Scheme string `json:"scheme"`
+			} `json:"securitySchemes"`
+		} `json:"components"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &spec); err != nil {
+		t.Fatalf("expected the specification to be valid JSON: %v", err)
+	}
+	if len(spec.Servers) != 1 || spec.Servers[0].URL != "/ms-user/v1" {
+		t.Fatalf("expected the server URL to be the base path, got %+v", spec.Servers)
+	}
+	if spec.Components.SecuritySchemes["bearerAuth"].Scheme != "bearer" {
+		t.Fatalf("expected a bearer security scheme, got %+v", spec.Components.SecuritySchemes)
+	}
+
+	source, err := os.ReadFile("../cmd/app/main.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	routes := routeComment.FindAllStringSubmatch(string(source), -1)
+	if len(routes) < 40 {
+		t.Fatalf("expected to find the route comments of main.go, found %d", len(routes))
+	}
+	for _, route := range routes {
+		method, path := strings.ToLower(route[1]), routeParam.ReplaceAllString(route[2], "{$1}")
+		if strings.HasPrefix(path, "/swagger/") {
+			continue
+		}
+		if _, ok := spec.Paths[path][method]; !ok {
+			t.Errorf("%s %s is not documented in docs/openapi.yaml", route[1], path)
+		}
+	}
+}
+
+// Test that the Swagger UI loads the specification from the configured base path
+func TestSwaggerUI(t *testing.T) {
+	r := newSwaggerRouter("users/v2")
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/v2/swagger/index.html", nil))
+	if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `url: "/users/v2/swagger/doc.json"`) {
+		t.Fatalf("expected the UI to load /users/v2/swagger/doc.json, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/v2/swagger/doc.json", nil))
+	if !strings.Contains(w.Body.String(), `"servers":[{"url":"/users/v2"}]`) {
+		t.Fatalf("expected the server URL to follow the base path, got %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/users/v2/swagger/missing.js", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown file, got %d", w.Code)
+	}
+}
@@ -0,0 +1,932 @@
+package tests
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"mime/multipart"
+	"ms-user/apierrors"
+	"ms-user/config"
+	"ms-user/handlers"
+	"ms-user/middleware"
+	"ms-user/models"
+	"ms-user/services"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+// mockUserProvider is a hand-written services.UserProvider for handler tests.
+// Methods that a test does not override panic through the nil embedded interface.
+type mockUserProvider struct {
+	services.UserProvider
+	getUser             func(id string) (*models.User, error)
+	listUsersPage       func(filter services.UserFilter, first, max int) ([]models.User, error)
+	executeActionsEmail func(userID string, actions []string) error
+	countUsers          func() (int, error)
+	createUsers         func(users []models.User) ([]*models.User, []error)
+	scope               services.Scope // Scope of the last request.
+}
+
+func (m *mockUserProvider) ScopedUsers(scope services.Scope) services.UserProvider {
+	m.scope = scope
+	return m
+}
+
+func (m *mockUserProvider) GetUser(id string) (*models.User, error) {
+	return m.getUser(id)
+}
+
+func (m *mockUserProvider) ListUsersPage(filter services.UserFilter, first, max int) ([]models.User, error) {
+	return m.listUsersPage(filter, first, max)
+}
+
+func (m *mockUserProvider) CreateUsers(users []models.User) ([]*models.User, []error) {
+	return m.createUsers(users)
+}
+
+func (m *mockUserProvider) CountUsers() (int, error) {
+	return m.countUsers()
+}
+
+func (m *mockUserProvider) ListRequiredActions() ([]string, error) {
+	return []string{"UPDATE_PASSWORD", "VERIFY_EMAIL"}, nil
+}
+
+func (m *mockUserProvider) ExecuteActionsEmail(userID string, actions []string) error {
+	return m.executeActionsEmail(userID, actions)
+}
+
+// newUserRouter returns a router exposing the user routes backed by the given provider.
+func newUserRouter(provider services.UserProvider) *gin.Engine {
+	// The config points nowhere: the real service is replaced before any request is made.
+	return newUserRouterWithConfig(&config.Config{KeycloakURL: "http://127.0.0.1:0", KeycloakRealm: "master"}, provider)
+}
+
+// newUserRouterWithConfig is newUserRouter with a caller-provided configuration.
+func newUserRouterWithConfig(cfg *config.Config, provider services.UserProvider) *gin.Engine {
+	h := handlers.NewUserHandler(cfg, provider)
+
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.GET("/ms-user/v1/users", h.ListUsers)
+	r.POST("/ms-user/v1/users", h.CreateUser)
+	r.POST("/ms-user/v1/users/bulk", h.CreateUsersBulk)
+	r.POST("/ms-user/v1/users/import", h.ImportUsers)
+	r.GET("/ms-user/v1/users/search", h.SearchUsers)
+	r.GET("/ms-user/v1/users/count", h.CountUsers)
+	r.GET("/ms-user/v1/users/export", h.ExportUsers)
+	r.GET("/ms-user/v1/users/by-username/:username", h.GetUserByUsername)
+	r.GET("/ms-user/v1/users/:id", h.GetUser)
+	r.PUT("/ms-user/v1/users/:id", h.UpdateUser)
+	r.PUT("/ms-user/v1/users/:id/send-actions-email", h.ExecuteActionsEmail)
+	r.PUT("/ms-user/v1/users/:id/execute-actions-email", h.ExecuteActionsEmail)
+	r.PUT("/ms-user/v1/users/:id/required-actions", h.SetRequiredActions)
+	return r
+}
+
+// Test for GetUser with a mocked provider
+func TestGetUserHandlerWithMock(t *testing.T) {
+	mock := &mockUserProvider{getUser: func(id string) (*models.User, error) {
+		if id == "1" {
+			return &models.User{ID: "1", Username: "user1"}, nil
+		}
+		return nil, &services.KeycloakError{Operation: "get user", StatusCode: http.StatusNotFound}
+	}}
+	r := newUserRouter(mock)
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/1", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	if user.Username != "user1" {
+		t.Fatalf("unexpected user: %+v", user)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/2", nil))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404, got %d", w.Code)
+	}
+	var apiErr apierrors.APIError
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	if apiErr.Code != apierrors.CodeUserNotFound {
+		t.Fatalf("expected code %s, got %+v", apierrors.CodeUserNotFound, apiErr)
+	}
+}
+
+// Test that service errors are mapped to machine-readable codes and statuses
+func TestGetUserHandlerErrorCodes(t *testing.T) {
+	// A real dial error, as returned by http.Client when Keycloak is down.
+	_, dialErr := http.Get("http://127.0.0.1:0")
+	if dialErr == nil {
+		t.Fatal("expected a dial error")
+	}
+
+	cases := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"keycloak unreachable", dialErr, http.StatusBadGateway, apierrors.CodeUpstreamUnavailable},
+		{"keycloak error status", &services.KeycloakError{Operation: "get user", StatusCode: http.StatusInternalServerError}, http.StatusBadGateway, apierrors.CodeUpstreamError},
+		{"keycloak unavailable", &services.KeycloakError{Operation: "get user", StatusCode: http.StatusServiceUnavailable}, http.StatusBadGateway, apierrors.CodeUpstreamError},
+		{"keycloak denied access", &services.KeycloakError{Operation: "get user", StatusCode: http.StatusForbidden}, http.StatusBadGateway, apierrors.CodeUpstreamError},
+		{"keycloak rejected request", &services.KeycloakError{Operation: "get user", StatusCode: http.StatusBadRequest, Body: `{"errorMessage":"invalid id"}`}, http.StatusBadRequest, apierrors.CodeValidationFailed},
+		{"unexpected error", errors.New("boom"), http.StatusInternalServerError, apierrors.CodeInternal},
+	}
+	for _, tc := range cases {
+		r := newUserRouter(&mockUserProvider{getUser: func(id string) (*models.User, error) {
+			return nil, tc.err
+		}})
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/1", nil))
+		if w.Code != tc.status {
+			t.Fatalf("%s: expected %d, got %d", tc.name, tc.status, w.Code)
+		}
+		var apiErr apierrors.APIError
+		if err := json.Unmarshal(w.Body.Bytes(), &apiErr); err != nil {
+			t.Fatalf("%s: expected JSON body, got %v", tc.name, err)
+		}
+		if apiErr.Code != tc.code {
+			t.Fatalf("%s: expected code %s, got %+v", tc.name, tc.code, apiErr)
+		}
+	}
+}
+
+// Test that pagination Link headers are built on the configured public base URL
+func TestListUsersPaginationLinkUsesPublicBaseURL(t *testing.T) {
+	mock := &mockUserProvider{listUsersPage: func(filter services.UserFilter, first, max int) ([]models.User, error) {
+		if first != 2 || max != 2 {
+			t.Fatalf("unexpected page first=%d max=%d", first, max)
+		}
+		return []models.User{{ID: "3"}, {ID: "4"}}, nil
+	}}
+	cfg := &config.Config{KeycloakURL: "http://127.0.0.1:0", KeycloakRealm: "master", PublicBaseURL: "https://api.example.com"}
+	r := newUserRouterWithConfig(cfg, mock)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?first=2&max=2", nil)
+	req.Host = "ms-user.internal:18080"
+	r.ServeHTTP(w, req)
+
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d", w.Code)
+	}
+	expected := `<https://api.example.com/ms-user/v1/users?first=4&max=2>; rel="next", ` +
+		`<https://api.example.com/ms-user/v1/users?first=0&max=2>; rel="prev"`
+	if link := w.Header().Get("Link"); link != expected {
+		t.Fatalf("unexpected Link header: %s", link)
+	}
+}
+
+// Test that pagination Link headers fall back to the request host
+func TestListUsersPaginationLinkFallsBackToRequestHost(t *testing.T) {
+	mock := &mockUserProvider{listUsersPage: func(filter services.UserFilter, first, max int) ([]models.User, error) {
+		return []models.User{{ID: "1"}}, nil
+	}}
+	r := newUserRouter(mock)
+
+	w := httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?max=1", nil)
+	req.Host = "ms-user.internal:18080"
+	r.ServeHTTP(w, req)
+
+	expected := `<http://ms-user.internal:18080/ms-user/v1/users?first=1&max=1>; rel="next"`
+	if link := w.Header().Get("Link"); link != expected {
+		t.Fatalf("unexpected Link header: %s", link)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?max=0", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid page size, got %d", w.Code)
+	}
+}
+
+// Test that searching users without any criteria is rejected
+func TestSearchUsersRequiresCriteria(t *testing.T) {
+	r := newUserRouter(&mockUserProvider{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/search", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+}
+
+// Test that a bulk creation reports per-user results and does not stop at the first failure
+func TestCreateUsersBulkPartialSuccess(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost && strings.Contains(r.URL.Path, "/protocol/openid-connect/token") {
+			w.WriteHeader(http.StatusOK)
+			w.Write([]byte(`{"access_token": "dummy-token"}`))
+			return
+		}
+		if r.Method == http.MethodPost && r.URL.Path == "/admin/realms/master/users" {
+			var user models.User
+			json.NewDecoder(r.Body).Decode(&user)
+			if user.Username == "taken" {
+				w.WriteHeader(http.StatusConflict)
+				w.Write([]byte(`{"errorMessage":"User exists with same username"}`))
+				return
+			}
+			w.Header().Set("Location", "http://keycloak/admin/realms/master/users/id-"+user.Username)
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.WriteHeader(http.StatusBadRequest)
+	}))
+	defer testServer.Close()
+	r := newUserRouter(newServiceForServer(testServer, t))
+
+	body := `[{"username":"alice","email":"alice@example.com"},` +
+		`{"username":"taken","email":"taken@example.com"},` +
+		`{"username":"bob","email":"bob@example.com"}]`
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ms-user/v1/users/bulk", strings.NewReader(body)))
+
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", w.Code, w.Body.String())
+	}
+	var response models.BulkUserResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatalf("expected JSON body, got %v", err)
+	}
+	if response.Created != 2 || response.Failed != 1 || len(response.Results) != 3 {
+		t.Fatalf("unexpected summary: %+v", response)
+	}
+	expected := []models.BulkUserResult{
+		{Email: "alice@example.com", Success: true, ID: "id-alice"},
+		{Email: "taken@example.com", Code: apierrors.CodeConflict, Error: "User exists with same username"},
+		{Email: "bob@example.com", Success: true, ID: "id-bob"},
+	}
+	for i, result := range response.Results {
+		if result != expected[i] {
+			t.Fatalf("unexpected result %d: %+v", i, result)
+		}
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ms-user/v1/users/bulk", strings.NewReader(`[]`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an empty batch, got %d", w.Code)
+	}
+}
+
+// Test that execute-actions-email only accepts required actions enabled in the realm
+func TestExecuteActionsEmailValidatesActions(t *testing.T) {
+	var sent []string
+	r := newUserRouter(&mockUserProvider{executeActionsEmail: func(userID string, actions []string) error {
+		sent = actions
+		return nil
+	}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/1/execute-actions-email",
+		strings.NewReader(`{"actions":["VERIFY_EMAIL","RESET_EVERYTHING"]}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d", w.Code)
+	}
+	if sent != nil {
+		t.Fatalf("expected no email to be sent, got %v", sent)
+	}
+	var apiErr struct {
+		Code    string `json:"code"`
+		Details struct {
+			InvalidActions []string `json:"invalidActions"`
+		} `json:"details"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	if apiErr.Code != apierrors.CodeValidationFailed || len(apiErr.Details.InvalidActions) != 1 ||
+		apiErr.Details.InvalidActions[0] != "RESET_EVERYTHING" {
+		t.Fatalf("unexpected body: %s", w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/1/execute-actions-email",
+		strings.NewReader(`{"actions":["VERIFY_EMAIL","UPDATE_PASSWORD"]}`)))
+	if w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d", w.Code)
+	}
+	if strings.Join(sent, ",") != "VERIFY_EMAIL,UPDATE_PASSWORD" {
+		t.Fatalf("unexpected actions sent: %v", sent)
+	}
+}
+
+// Test that send-actions-email and its execute-actions-email alias default to VERIFY_EMAIL, and that
+// SMTP failures are reported clearly
+func TestExecuteActionsEmailDefaults(t *testing.T) {
+	var sent []string
+	smtpConfigured := true
+	r := newUserRouter(&mockUserProvider{executeActionsEmail: func(userID string, actions []string) error {
+		sent = actions
+		if !smtpConfigured {
+			return services.ErrEmailNotSent
+		}
+		return nil
+	}})
+
+	for _, route := range []string{"send-actions-email", "execute-actions-email"} {
+		sent = nil
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/1/"+route, nil))
+		if w.Code != http.StatusNoContent {
+			t.Fatalf("%s: expected 204, got %d: %s", route, w.Code, w.Body.String())
+		}
+		if strings.Join(sent, ",") != "VERIFY_EMAIL" {
+			t.Fatalf("%s: expected the default actions, got %v", route, sent)
+		}
+	}
+
+	smtpConfigured = false
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/1/send-actions-email",
+		strings.NewReader(`{"actions":["VERIFY_EMAIL","UPDATE_PASSWORD"]}`)))
+	if w.Code != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %d", w.Code)
+	}
+	if strings.Join(sent, ",") != "VERIFY_EMAIL,UPDATE_PASSWORD" {
+		t.Fatalf("unexpected actions sent: %v", sent)
+	}
+	var apiErr struct {
+		Code string `json:"code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	if apiErr.Code != apierrors.CodeEmailNotSent {
+		t.Fatalf("expected code %s, got %s", apierrors.CodeEmailNotSent, w.Body.String())
+	}
+}
+
+// Test that the user count endpoint is not mistaken for a user ID
+func TestCountUsers(t *testing.T) {
+	r := newUserRouter(&mockUserProvider{countUsers: func() (int, error) { return 1234, nil }})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/count", nil))
+	if w.Code != http.StatusOK || strings.TrimSpace(w.Body.String()) != `{"count":1234}` {
+		t.Fatalf("expected a count of 1234, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// Test that the enabled and emailVerified filters are validated and forwarded
+func TestListUsersStateFilters(t *testing.T) {
+	var received services.UserFilter
+	r := newUserRouter(&mockUserProvider{listUsersPage: func(filter services.UserFilter, first, max int) ([]models.User, error) {
+		received = filter
+		return []models.User{}, nil
+	}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?first=0&enabled=false&emailVerified=true", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if received.Enabled == nil || *received.Enabled || received.EmailVerified == nil || !*received.EmailVerified {
+		t.Fatalf("expected enabled=false and emailVerified=true, got %+v", received)
+	}
+
+	received = services.UserFilter{}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?first=0", nil))
+	if received.Enabled != nil || received.EmailVerified != nil {
+		t.Fatalf("expected no filter, got %+v", received)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users?enabled=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid filter, got %d", w.Code)
+	}
+}
+
+// Test that the user export pages through every user in CSV and JSON
+func TestExportUsers(t *testing.T) {
+	const total = 250
+	var offsets []int
+	r := newUserRouter(&mockUserProvider{listUsersPage: func(filter services.UserFilter, first, max int) ([]models.User, error) {
+		offsets = append(offsets, first)
+		users := []models.User{}
+		for i := first; i < total && i < first+max; i++ {
+			enabled := i%2 == 0
+			users = append(users, models.User{ID: strconv.Itoa(i), Username: "user" + strconv.Itoa(i), Enabled: &enabled})
+		}
+		return users, nil
+	}})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/export?format=csv", nil))
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/csv" ||
+		!strings.Contains(w.Header().Get("Content-Disposition"), "users.csv") {
+		t.Fatalf("unexpected response: %d %v", w.Code, w.Header())
+	}
+	records, err := csv.NewReader(w.Body).ReadAll()
+	if err != nil {
+		t.Fatalf("expected valid CSV, got %v", err)
+	}
+	if len(records) != total+1 || strings.Join(records[0], ",") != "id,username,email,firstName,lastName,enabled,emailVerified" {
+		t.Fatalf("expected a header and %d rows, got %d rows starting with %v", total, len(records), records[0])
+	}
+	if strings.Join(records[2], ",") != "1,user1,,,,false," {
+		t.Fatalf("unexpected row: %v", records[2])
+	}
+	if !reflect.DeepEqual(offsets, []int{0, 100, 200}) {
+		t.Fatalf("expected users to be paged through, got offsets %v", offsets)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/export?format=json", nil))
+	var users []models.User
+	if err := json.Unmarshal(w.Body.Bytes(), &users); err != nil || len(users) != total {
+		t.Fatalf("expected a JSON array of %d users, got %d (err %v)", total, len(users), err)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/export?format=xml", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown format, got %d", w.Code)
+	}
+}
+
+// newImportRequest returns a multipart request uploading content as the "file" form field.
+func newImportRequest(t *testing.T, query, filename, content string) *http.Request {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("file", filename)
+	if err != nil {
+		t.Fatalf("unable to build the upload: %v", err)
+	}
+	part.Write([]byte(content))
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, "/ms-user/v1/users/import"+query, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// Test for importing users from CSV and JSON files, with malformed rows and existing users
+func TestImportUsers(t *testing.T) {
+	var submitted []string
+	mock := &mockUserProvider{createUsers: func(users []models.User) ([]*models.User, []error) {
+		created := make([]*models.User, len(users))
+		errs := make([]error, len(users))
+		for i, user := range users {
+			submitted = append(submitted, user.Username)
+			switch user.Username {
+			case "taken":
+				errs[i] = &services.KeycloakError{Operation: "create user", StatusCode: http.StatusConflict, Body: `{"errorMessage":"User exists with same username"}`}
+			case "broken":
+				errs[i] = &services.KeycloakError{Operation: "create user", StatusCode: http.StatusInternalServerError}
+			default:
+				created[i] = &models.User{ID: "id-" + user.Username, Username: user.Username}
+			}
+		}
+		return created, errs
+	}}
+	r := newUserRouter(mock)
+
+	csvFile := "username,email,firstName,lastName,enabled\n" +
+		"alice,alice@example.com,Alice,A,true\n" +
+		"taken,taken@example.com,Taken,T,true\n" +
+		"bob,not-an-email,Bob,B,true\n" +
+		"carol,carol@example.com,Carol\n" +
+		"dave,dave@example.com,Dave,D,maybe\n" +
+		"broken,broken@example.com,Broken,B,false\n"
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, newImportRequest(t, "", "users.csv", csvFile))
+	if w.Code != http.StatusMultiStatus {
+		t.Fatalf("expected 207, got %d: %s", w.Code, w.Body.String())
+	}
+	var result models.ImportResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if result.Rows != 6 || result.Valid != 3 || result.Created != 1 || result.Skipped != 1 || result.Failed != 4 {
+		t.Fatalf("unexpected summary: %+v", result)
+	}
+	if len(result.SkippedRows) != 1 || result.SkippedRows[0].Line != 3 {
+		t.Fatalf("expected line 3 to be skipped, got %+v", result.SkippedRows)
+	}
+	var failedLines []int
+	for _, failure := range result.Failures {
+		failedLines = append(failedLines, failure.Line)
+	}
+	if !reflect.DeepEqual(failedLines, []int{4, 5, 6, 7}) {
+		t.Fatalf("expected failures on lines 4 to 7, got %+v", result.Failures)
+	}
+	if !reflect.DeepEqual(submitted, []string{"alice", "taken", "broken"}) {
+		t.Fatalf("expected only valid rows to be submitted, got %v", submitted)
+	}
+
+	submitted = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newImportRequest(t, "", "users.json", `[{"username":"erin","email":"erin@example.com"},{"email":"nobody@example.com"}]`))
+	result = models.ImportResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusMultiStatus || result.Created != 1 || result.Failed != 1 || result.Failures[0].Line != 2 {
+		t.Fatalf("unexpected JSON import result %d: %s", w.Code, w.Body.String())
+	}
+
+	submitted = nil
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newImportRequest(t, "?dryRun=true", "upload", csvFile))
+	result = models.ImportResult{}
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if w.Code != http.StatusOK || !result.DryRun || result.Valid != 3 || result.Created != 0 || len(submitted) != 0 {
+		t.Fatalf("expected a dry run to only validate, got %d: %s (submitted %v)", w.Code, w.Body.String(), submitted)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, newImportRequest(t, "", "users.csv", "email\nalice@example.com\n"))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a username column, got %d", w.Code)
+	}
+}
+
+// Test that invalid users are rejected with the list of invalid fields before Keycloak is called
+func TestCreateUserValidation(t *testing.T) {
+	// The provider panics if called: validation must stop the request first.
+	r := newUserRouter(&mockUserProvider{})
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ms-user/v1/users", strings.NewReader(`{"email":"not-an-email","firstName":"John"}`)))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400, got %d: %s", w.Code, w.Body.String())
+	}
+	var apiErr struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		Details []struct {
+			Field   string `json:"field"`
+			Message string `json:"message"`
+		} `json:"details"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &apiErr)
+	if apiErr.Code != apierrors.CodeValidationFailed || len(apiErr.Details) != 2 {
+		t.Fatalf("expected two invalid fields, got %s", w.Body.String())
+	}
+	if apiErr.Details[0].Field != "username" || apiErr.Details[1].Field != "email" {
+		t.Fatalf("expected username and email to be reported by their JSON names, got %+v", apiErr.Details)
+	}
+	if !strings.Contains(apiErr.Message, "email must be a valid email address") {
+		t.Fatalf("expected the message to name the invalid email, got %q", apiErr.Message)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/ms-user/v1/users/bulk",
+		strings.NewReader(`[{"username":"","email":"a@example.com"}]`)))
+	var bulk models.BulkUserResponse
+	json.Unmarshal(w.Body.Bytes(), &bulk)
+	if w.Code != http.StatusMultiStatus || bulk.Failed != 1 || bulk.Results[0].Code != apierrors.CodeValidationFailed {
+		t.Fatalf("expected the invalid user to be reported in the batch, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// Test that a single-field user update leaves the other fields, including unmodeled ones, intact
+func TestUpdateUserPartial(t *testing.T) {
+	var mu sync.Mutex
+	// The fake replaces the whole stored user on update, as Keycloak does.
+	stored := `{"id":"u1","username":"john","email":"john@example.com","firstName":"John","lastName":"Doe",` +
+		`"enabled":true,"attributes":{"department":["sales"],"employeeId":["42"]},"totp":true}`
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.URL.Path != "/admin/realms/master/users/u1" {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Method == http.MethodPut {
+			body, _ := ioutil.ReadAll(r.Body)
+			stored = string(body)
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		w.Write([]byte(stored))
+	}))
+	defer testServer.Close()
+	r := newUserRouter(newServiceForServer(testServer, t))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1", strings.NewReader(`{"firstName":"Johnny"}`)))
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	expected := models.User{
+		ID: "u1", Username: "john", Email: "john@example.com", FirstName: "Johnny", LastName: "Doe",
+		Enabled:    user.Enabled,
+		Attributes: map[string][]string{"department": {"sales"}, "employeeId": {"42"}},
+	}
+	if !reflect.DeepEqual(user, expected) || user.Enabled == nil || !*user.Enabled {
+		t.Fatalf("expected only the first name to change, got %+v", user)
+	}
+	if !strings.Contains(stored, `"totp":true`) {
+		t.Fatalf("expected fields the service does not model to be sent back, got %s", stored)
+	}
+
+	// Attributes are merged: listed ones are replaced, empty ones removed and the others kept.
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1",
+		strings.NewReader(`{"attributes":{"department":["engineering"],"employeeId":[]}}`)))
+	user = models.User{}
+	json.Unmarshal(w.Body.Bytes(), &user)
+	if w.Code != http.StatusOK || !reflect.DeepEqual(user.Attributes, map[string][]string{"department": {"engineering"}}) ||
+		user.Email != "john@example.com" || user.FirstName != "Johnny" {
+		t.Fatalf("expected the attributes to be merged and the rest kept, got %d: %+v", w.Code, user)
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1", strings.NewReader(`{"email":"nope"}`)))
+	if w.Code != http.StatusBadRequest || !strings.Contains(w.Body.String(), "email must be a valid email address") {
+		t.Fatalf("expected 400 for an invalid email, got %d: %s", w.Code, w.Body.String())
+	}
+
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/missing", strings.NewReader(`{"firstName":"X"}`)))
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("expected 404 for an unknown user, got %d: %s", w.Code, w.Body.String())
+	}
+}
+
+// Test that brief=true forwards briefRepresentation=true and decodes Keycloak's brief users
+func TestListUsersBrief(t *testing.T) {
+	const briefUser = `[{"id":"u1","username":"john","firstName":"John","lastName":"Doe","email":"john@example.com",` +
+		`"emailVerified":true,"createdTimestamp":1700000000000,"enabled":true,"totp":false,"federationLink":"ldap-1"}]`
+	var mu sync.Mutex
+	queries := map[string]string{}
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		mu.Lock()
+		queries[r.URL.Path] = r.URL.RawQuery
+		mu.Unlock()
+		switch r.URL.Path {
+		case "/admin/realms/master/users/count":
+			w.Write([]byte(`1`))
+		case "/admin/realms/master/users", "/admin/realms/master/groups/g1/members":
+			w.Write([]byte(briefUser))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+	kcService := newServiceForServer(testServer, t)
+	r := newUserRouter(kcService)
+	r.GET("/ms-user/v1/groups/:id/users", handlers.NewMembershipHandler(kcService).ListGroupUsers)
+
+	tests := []struct {
+		path     string
+		upstream string
+	}{
+		{"/ms-user/v1/users?brief=true", "/admin/realms/master/users"},
+		{"/ms-user/v1/groups/g1/users?brief=true", "/admin/realms/master/groups/g1/members"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, tt.path, nil))
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: expected 200, got %d: %s", tt.path, w.Code, w.Body.String())
+		}
+		if !strings.Contains(queries[tt.upstream], "briefRepresentation=true") {
+			t.Fatalf("%s: expected briefRepresentation=true to be forwarded, got %q", tt.path, queries[tt.upstream])
+		}
+		var users []models.User
+		json.Unmarshal(w.Body.Bytes(), &users)
+		if len(users) != 1 || users[0].ID != "u1" || users[0].Email != "john@example.com" || users[0].FederationLink != "ldap-1" ||
+			users[0].Enabled == nil || !*users[0].Enabled || users[0].EmailVerified == nil || !*users[0].EmailVerified {
+			t.Fatalf("%s: unexpected users %+v", tt.path, users)
+		}
+	}
+	if strings.Contains(queries["/admin/realms/master/users/count"], "briefRepresentation") {
+		t.Fatalf("expected the user count not to get briefRepresentation, got %q", queries["/admin/realms/master/users/count"])
+	}
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users", nil))
+	if w.Code != http.StatusOK || strings.Contains(queries["/admin/realms/master/users"], "briefRepresentation") {
+		t.Fatalf("expected the full representation by default, got %d with query %q", w.Code, queries["/admin/realms/master/users"])
+	}
+	w = httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/groups/g1/users?brief=maybe", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid brief value, got %d", w.Code)
+	}
+}
+
+// Test for retrieving a user by exact username
+func TestGetUserByUsername(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		if r.URL.Path != "/admin/realms/master/users" || r.URL.Query().Get("exact") != "true" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		switch r.URL.Query().Get("username") {
+		case "jsmith":
+			w.Write([]byte(`[{"id":"u1","username":"jsmith"}]`))
+		case "dup":
+			// Two users differing only in case, as can happen with some federation providers.
+			w.Write([]byte(`[{"id":"u2","username":"dup"},{"id":"u3","username":"DUP"}]`))
+		default:
+			w.Write([]byte(`[]`))
+		}
+	}))
+	defer testServer.Close()
+	r := newUserRouter(newServiceForServer(testServer, t))
+
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/by-username/jsmith", nil))
+	var user models.User
+	json.Unmarshal(w.Body.Bytes(), &user)
+	if w.Code != http.StatusOK || user.ID != "u1" {
+		t.Fatalf("expected user u1, got %d: %s", w.Code, w.Body.String())
+	}
+
+	tests := []struct {
+		username string
+		status   int
+		code     string
+	}{
+		{"nobody", http.StatusNotFound, apierrors.CodeUserNotFound},
+		{"dup", http.StatusBadRequest, apierrors.CodeAmbiguousResult},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/by-username/"+tt.username, nil))
+		var apiErr apierrors.APIError
+		json.Unmarshal(w.Body.Bytes(), &apiErr)
+		if w.Code != tt.status || apiErr.Code != tt.code {
+			t.Fatalf("%s: expected %d %s, got %d: %s", tt.username, tt.status, tt.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Test that impersonation is restricted to the impersonator role and reports when Keycloak disallows it
+func TestImpersonateUser(t *testing.T) {
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch r.URL.Path {
+		case "/admin/realms/master/users/u1/impersonation":
+			http.SetCookie(w, &http.Cookie{Name: "KEYCLOAK_IDENTITY", Value: "identity", Path: "/realms/master/"})
+			w.Write([]byte(`{"sameRealm":true,"redirect":"http://keycloak/realms/master/account"}`))
+		case "/admin/realms/master/users/locked/impersonation":
+			w.WriteHeader(http.StatusForbidden)
+		case "/admin/realms/master/users/locked", "/admin/realms/master/users/disabled":
+			w.Write([]byte(`{"id":"` + strings.TrimPrefix(r.URL.Path, "/admin/realms/master/users/") + `"}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+
+	cfg := &config.Config{KeycloakURL: testServer.URL, KeycloakRealm: "master", AuthToken: "user-token",
+		AdminToken: "admin-token", ImpersonationToken: "impersonation-token"}
+	h := handlers.NewUserHandler(cfg, newServiceForServer(testServer, t))
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.AuthMiddleware(cfg))
+	r.POST("/ms-user/v1/users/:id/impersonate", middleware.ImpersonatorMiddleware(), h.ImpersonateUser)
+
+	impersonate := func(id, token string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodPost, "/ms-user/v1/users/"+id+"/impersonate", nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	for _, token := range []string{"user-token", "admin-token"} {
+		if w := impersonate("u1", token); w.Code != http.StatusForbidden {
+			t.Fatalf("expected 403 for %s, got %d", token, w.Code)
+		}
+	}
+
+	w := impersonate("u1", "impersonation-token")
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	var result models.ImpersonationResult
+	json.Unmarshal(w.Body.Bytes(), &result)
+	if !result.SameRealm || result.Redirect == "" || len(result.Cookies) != 1 || result.Cookies[0].Value != "identity" {
+		t.Fatalf("unexpected result: %+v", result)
+	}
+
+	tests := []struct {
+		id     string
+		status int
+		code   string
+	}{
+		// Keycloak's 403 does not tell a missing role from a refused user, so it is reported as a plain FORBIDDEN.
+		{"locked", http.StatusForbidden, apierrors.CodeForbidden},
+		// The feature being disabled on the server makes the endpoint answer 404 for an existing user.
+		{"disabled", http.StatusForbidden, apierrors.CodeImpersonationDisabled},
+		{"missing", http.StatusNotFound, apierrors.CodeUserNotFound},
+	}
+	for _, tt := range tests {
+		w := impersonate(tt.id, "impersonation-token")
+		var apiErr apierrors.APIError
+		json.Unmarshal(w.Body.Bytes(), &apiErr)
+		if w.Code != tt.status || apiErr.Code != tt.code {
+			t.Fatalf("%s: expected %d %s, got %d: %s", tt.id, tt.status, tt.code, w.Code, w.Body.String())
+		}
+	}
+}
+
+// Test that setting required actions keeps the rest of the user, and that an empty list clears them
+func TestSetRequiredActions(t *testing.T) {
+	stored := `{"id":"u1","username":"jdoe","email":"jdoe@example.com","totp":true,"requiredActions":["VERIFY_EMAIL"]}`
+	var updates []string
+	testServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if isTokenRequest(w, r) {
+			return
+		}
+		switch {
+		case r.URL.Path == "/admin/realms/master/authentication/required-actions":
+			w.Write([]byte(`[{"alias":"UPDATE_PASSWORD","enabled":true},{"alias":"VERIFY_EMAIL","enabled":true}]`))
+		case r.Method == http.MethodGet && r.URL.Path == "/admin/realms/master/users/u1":
+			w.Write([]byte(stored))
+		case r.Method == http.MethodPut && r.URL.Path == "/admin/realms/master/users/u1":
+			// Keycloak replaces the user with the body sent.
+			body, _ := ioutil.ReadAll(r.Body)
+			stored = string(body)
+			updates = append(updates, stored)
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer testServer.Close()
+	r := newUserRouter(newServiceForServer(testServer, t))
+
+	setActions := func(body string) *httptest.ResponseRecorder {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPut, "/ms-user/v1/users/u1/required-actions", strings.NewReader(body)))
+		return w
+	}
+
+	if w := setActions(`{"actions":["UPDATE_PASSWORD"]}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204, got %d: %s", w.Code, w.Body.String())
+	}
+	if w := setActions(`{"actions":[]}`); w.Code != http.StatusNoContent {
+		t.Fatalf("expected 204 when clearing, got %d: %s", w.Code, w.Body.String())
+	}
+	expected := []string{
+		`{"email":"jdoe@example.com","id":"u1","requiredActions":["UPDATE_PASSWORD"],"totp":true,"username":"jdoe"}`,
+		`{"email":"jdoe@example.com","id":"u1","requiredActions":[],"totp":true,"username":"jdoe"}`,
+	}
+	if !reflect.DeepEqual(updates, expected) {
+		t.Fatalf("expected only requiredActions to change, got %v", updates)
+	}
+
+	for _, body := range []string{`{"actions":["DANCE"]}`, `{}`} {
+		if w := setActions(body); w.Code != http.StatusBadRequest {
+			t.Fatalf("%s: expected 400, got %d", body, w.Code)
+		}
+	}
+	if len(updates) != 2 {
+		t.Fatalf("expected invalid requests not to reach Keycloak, got %v", updates)
+	}
+}
+
+// Test that the realm and caller token of a request reach any provider through its scope
+func TestUserProviderScope(t *testing.T) {
+	cfg := &config.Config{KeycloakRealm: "master", KeycloakRealms: []string{"tenant-a"}, AuthToken: "secret-token", CallerTokens: true}
+	mock := &mockUserProvider{countUsers: func() (int, error) { return 1, nil }}
+	h := handlers.NewUserHandler(cfg, mock)
+	gin.SetMode(gin.TestMode)
+	r := gin.New()
+	r.Use(middleware.AuthMiddleware(cfg))
+	r.GET("/ms-user/v1/users/count", middleware.RealmMiddleware(cfg), h.CountUsers)
+
+	req := httptest.NewRequest(http.MethodGet, "/ms-user/v1/users/count", nil)
+	req.Header.Set("Authorization", "Bearer secret-token")
+	req.Header.Set(middleware.RealmHeader, "tenant-a")
+	req.Header.Set(middleware.CallerTokenHeader, "alice")
+	w := httptest.NewRecorder()
+	r.ServeHTTP(w, req)
+	if w.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", w.Code, w.Body.String())
+	}
+	expected := services.Scope{Realm: "tenant-a", CallerToken: "alice"}
+	if mock.scope != expected {
+		t.Fatalf("expected scope %+v, got %+v", expected, mock.scope)
+	}
+}